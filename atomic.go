@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	DEFAULT_FILE_MODE = 0644
+	STDIO_PATH        = "-" // Path meaning stdin for inputs and stdout for outputs
+)
+
+// stdout receives results written to STDIO_PATH. Logs go to stderr, so the two never mix.
+var stdout io.Writer = os.Stdout
+
+/*
+Writes a file so that path holds either its previous content or the complete new content, never a mix.
+
+A path of STDIO_PATH streams the content to stdout instead; a pipe cannot be
+replaced atomically, so callers produce the full result before writing it.
+
+Steps:
+
+ 1. Streams the output of write into a temporary file in the same directory, hashing it on the way
+ 2. Flushes the temporary file to disk
+ 3. Re-reads it and compares the checksum with the bytes that were written
+ 4. Replaces path with it through replaceFileAtomic
+*/
+func writeFileAtomic(path string, write func(writer io.Writer) error) (err error) {
+	defer logging.Trace("write file atomic")()
+
+	if path == STDIO_PATH {
+		bufWriter := bufio.NewWriter(stdout)
+		if err := write(bufWriter); err != nil {
+			return err
+		}
+		return bufWriter.Flush()
+	}
+
+	return replaceFileAtomic(path, func(temp *os.File) error {
+		// Write and hash the content
+		hasher := sha256.New()
+		bufWriter := bufio.NewWriter(io.MultiWriter(temp, hasher))
+		if err := write(bufWriter); err != nil {
+			return err
+		}
+		if err := bufWriter.Flush(); err != nil {
+			return err
+		}
+		if err := temp.Sync(); err != nil {
+			return err
+		}
+
+		// Verify what reached the disk
+		written, err := checksumFile(temp.Name())
+		if err != nil {
+			return err
+		}
+		if [32]byte(hasher.Sum(nil)) != written {
+			return fmt.Errorf("written file %w for %s", errChecksumMismatch, path)
+		}
+		return nil
+	})
+}
+
+/*
+Replaces path with a temporary file filled by fill.
+
+Steps:
+
+ 1. Creates the temporary file in the same directory as path and hands it to fill
+ 2. Flushes it to disk
+ 3. Copies the mode and modification time of the file being replaced, if any
+ 4. Renames the temporary file over path and syncs the directory
+
+The temporary file is removed if any step fails, leaving path untouched.
+*/
+func replaceFileAtomic(path string, fill func(temp *os.File) error) error {
+	mode := os.FileMode(DEFAULT_FILE_MODE)
+	existing, statErr := os.Stat(path)
+	if statErr == nil {
+		if !existing.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		mode = existing.Mode().Perm()
+	}
+
+	dir := filepath.Dir(path)
+	temp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := temp.Name()
+
+	// Remove the temporary file unless it was renamed into place
+	renamed := false
+	defer func() {
+		if !renamed {
+			temp.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	if err := fill(temp); err != nil {
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	// Keep the attributes of the file being replaced
+	if err := os.Chmod(tempPath, mode); err != nil {
+		return err
+	}
+	if statErr == nil {
+		if err := os.Chtimes(tempPath, existing.ModTime(), existing.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	renamed = true
+
+	syncDir(dir)
+	return nil
+}
+
+// writeBytesAtomic writes data to path through writeFileAtomic.
+func writeBytesAtomic(path string, data []byte) error {
+	return writeFileAtomic(path, func(writer io.Writer) error {
+		_, err := writer.Write(data)
+		return err
+	})
+}
+
+// checksumFile returns the SHA-256 of the file at path.
+func checksumFile(path string) ([32]byte, error) {
+	var checksum [32]byte
+
+	file, err := os.Open(path)
+	if err != nil {
+		return checksum, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return checksum, err
+	}
+
+	copy(checksum[:], hasher.Sum(nil))
+	return checksum, nil
+}
+
+// syncDir flushes a directory entry to disk. Not every platform supports it, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
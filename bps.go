@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"mtgapatcher/logging"
+)
+
+/*
+BPS patch support.
+
+A BPS patch is "BPS1", the source, target and metadata sizes, the metadata,
+then actions each encoded as ((length-1) << 2) | command, and finally the
+CRC32 of the source, the target and the patch itself.
+*/
+
+const (
+	BPS_HEADER = "BPS1"
+
+	// Action commands
+	BPS_SOURCE_READ = 0
+	BPS_TARGET_READ = 1
+	BPS_SOURCE_COPY = 2
+	BPS_TARGET_COPY = 3
+)
+
+/*
+Writes a patch in BPS format.
+
+The stretches between patch items become SourceRead actions and the items
+themselves TargetRead actions, mirroring the regions generatePatch found.
+Items must be sorted and must not overlap, which generatePatch guarantees.
+*/
+func writeBPS(patch *PatchFile, original []byte, writer io.Writer) error {
+	defer logging.Trace("write bps")()
+
+	// The patched file is only needed for its CRC32, but building it also verifies the patch
+	modified, err := applyPatch(original, patch)
+	if err != nil {
+		return err
+	}
+
+	items := make([]PatchItem, len(patch.PatchItems))
+	copy(items, patch.PatchItems)
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Offset < items[j].Offset })
+
+	out := []byte(BPS_HEADER)
+	out = appendBeatVarint(out, uint64(len(original)))
+	out = appendBeatVarint(out, uint64(len(modified)))
+	out = appendBeatVarint(out, 0) // No metadata
+
+	appendAction := func(command int, length uint64) {
+		out = appendBeatVarint(out, (length-1)<<2|uint64(command))
+	}
+
+	position := uint64(0)
+	emitGap := func(end uint64) {
+		if position >= end {
+			return
+		}
+		// SourceRead copies the source at the output position, only possible inside the source
+		if copyEnd := min(end, uint64(len(original))); copyEnd > position {
+			appendAction(BPS_SOURCE_READ, copyEnd-position)
+			position = copyEnd
+		}
+		if end > position {
+			appendAction(BPS_TARGET_READ, end-position)
+			out = append(out, modified[position:end]...)
+			position = end
+		}
+	}
+
+	for _, item := range items {
+		start := uint64(item.Offset)
+		end := start + uint64(len(item.Content))
+		if start < position {
+			return errors.New("patch items overlap")
+		}
+		if end > uint64(len(modified)) {
+			return errors.New("patch item exceeds patched length")
+		}
+
+		emitGap(start)
+		if len(item.Content) > 0 {
+			appendAction(BPS_TARGET_READ, uint64(len(item.Content)))
+			out = append(out, item.Content...)
+			position = end
+		}
+	}
+	emitGap(uint64(len(modified)))
+
+	_, err = writer.Write(appendPatchCRCs(out, original, modified))
+	return err
+}
+
+// applyBPS applies a BPS patch to original and returns the result, verifying all three CRC32s.
+func applyBPS(original []byte, reader io.Reader) ([]byte, error) {
+	defer logging.Trace("apply bps")()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(BPS_HEADER)+12 || !bytes.HasPrefix(data, []byte(BPS_HEADER)) {
+		return nil, errors.New("invalid bps file format")
+	}
+
+	targetCRC, err := verifyPatchCRCs(data, original)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bytes.NewReader(data[len(BPS_HEADER) : len(data)-12])
+	sourceSize, err := readBeatVarint(body)
+	if err != nil {
+		return nil, err
+	}
+	targetSize, err := readBeatVarint(body)
+	if err != nil {
+		return nil, err
+	}
+	metadataSize, err := readBeatVarint(body)
+	if err != nil {
+		return nil, err
+	}
+	if sourceSize != uint64(len(original)) {
+		return nil, fmt.Errorf("original file %w", errLengthMismatch)
+	}
+	if targetSize > 1<<32-1 {
+		return nil, fmt.Errorf("target size %d too large", targetSize)
+	}
+	if metadataSize > uint64(body.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body.Seek(int64(metadataSize), io.SeekCurrent)
+
+	// Size the buffer from what the inputs can plausibly produce rather than the untrusted header
+	result := make([]byte, 0, min(targetSize, uint64(len(original))+uint64(len(data))))
+	var sourceOffset, targetOffset int64
+
+	for body.Len() > 0 {
+		action, err := readBeatVarint(body)
+		if err != nil {
+			return nil, err
+		}
+		command := action & 3
+		length := (action >> 2) + 1
+		if uint64(len(result))+length > targetSize {
+			return nil, errors.New("bps actions exceed target size")
+		}
+
+		switch command {
+		case BPS_SOURCE_READ:
+			if uint64(len(result))+length > uint64(len(original)) {
+				return nil, errors.New("bps source read out of range")
+			}
+			result = append(result, original[len(result):uint64(len(result))+length]...)
+
+		case BPS_TARGET_READ:
+			if length > uint64(body.Len()) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			start := len(result)
+			result = append(result, make([]byte, length)...)
+			body.Read(result[start:])
+
+		case BPS_SOURCE_COPY, BPS_TARGET_COPY:
+			relative, err := readBeatVarint(body)
+			if err != nil {
+				return nil, err
+			}
+			delta := int64(relative >> 1)
+			if relative&1 != 0 {
+				delta = -delta
+			}
+
+			if command == BPS_SOURCE_COPY {
+				sourceOffset += delta
+				if sourceOffset < 0 || uint64(sourceOffset)+length > uint64(len(original)) {
+					return nil, errors.New("bps source copy out of range")
+				}
+				result = append(result, original[sourceOffset:uint64(sourceOffset)+length]...)
+				sourceOffset += int64(length)
+			} else {
+				targetOffset += delta
+				if targetOffset < 0 || targetOffset >= int64(len(result)) {
+					return nil, errors.New("bps target copy out of range")
+				}
+				// Target copies may overlap the bytes they produce
+				for i := uint64(0); i < length; i++ {
+					result = append(result, result[targetOffset])
+					targetOffset++
+				}
+			}
+		}
+	}
+
+	if uint64(len(result)) != targetSize {
+		return nil, fmt.Errorf("patched file %w", errLengthMismatch)
+	}
+	if crc32.ChecksumIEEE(result) != targetCRC {
+		return nil, fmt.Errorf("patched file %w", errChecksumMismatch)
+	}
+
+	return result, nil
+}
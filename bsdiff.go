@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"mtgapatcher/logging"
+)
+
+/*
+BSDIFF40 patch support.
+
+A BSDIFF40 patch is a 32 byte header ("BSDIFF40", the compressed lengths of
+the control and diff blocks, the new file size) followed by three bzip2
+blocks: control triples, diff bytes added to the old file and extra bytes
+copied as is. The format carries no checksums, so applying one requires the
+checksums from flags or a sidecar file (see loadPatchChecksums and PatchInfo).
+*/
+
+const (
+	BSDIFF_HEADER      = "BSDIFF40"
+	BSDIFF_HEADER_SIZE = 32
+)
+
+// readOfftin decodes bsdiff's sign-magnitude little-endian 64-bit integer.
+func readOfftin(buf []byte) int64 {
+	value := int64(binary.LittleEndian.Uint64(buf) &^ (1 << 63))
+	if buf[7]&0x80 != 0 {
+		value = -value
+	}
+	return value
+}
+
+func appendOfftin(buf []byte, value int64) []byte {
+	magnitude := uint64(value)
+	if value < 0 {
+		magnitude = uint64(-value) | 1<<63
+	}
+	return binary.LittleEndian.AppendUint64(buf, magnitude)
+}
+
+/*
+Writes a patch in BSDIFF40 format.
+
+The patch maps onto a single control triple: the common prefix of both
+files as diff bytes (zero wherever generatePatch found no change, which
+bzip2 squeezes away) and any growth as extra bytes.
+*/
+func writeBSDIFF(patch *PatchFile, original []byte, writer io.Writer) error {
+	defer logging.Trace("write bsdiff")()
+
+	modified, err := applyPatch(original, patch)
+	if err != nil {
+		return err
+	}
+
+	common := min(len(original), len(modified))
+	diff := make([]byte, common)
+	for _, item := range patch.PatchItems {
+		for i := int(item.Offset); i < common && i < int(item.Offset)+len(item.Content); i++ {
+			diff[i] = modified[i] - original[i]
+		}
+	}
+
+	var control []byte
+	control = appendOfftin(control, int64(common))
+	control = appendOfftin(control, int64(len(modified)-common))
+	control = appendOfftin(control, 0)
+
+	controlBlock := compressBzip2(control)
+	diffBlock := compressBzip2(diff)
+	extraBlock := compressBzip2(modified[common:])
+
+	header := []byte(BSDIFF_HEADER)
+	header = appendOfftin(header, int64(len(controlBlock)))
+	header = appendOfftin(header, int64(len(diffBlock)))
+	header = appendOfftin(header, int64(len(modified)))
+
+	for _, part := range [][]byte{header, controlBlock, diffBlock, extraBlock} {
+		if _, err := writer.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyBSDIFF applies a BSDIFF40 patch to original and returns the result.
+func applyBSDIFF(original []byte, reader io.Reader) ([]byte, error) {
+	defer logging.Trace("apply bsdiff")()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < BSDIFF_HEADER_SIZE || !bytes.HasPrefix(data, []byte(BSDIFF_HEADER)) {
+		return nil, errors.New("invalid bsdiff file format")
+	}
+
+	controlLength := readOfftin(data[8:])
+	diffLength := readOfftin(data[16:])
+	newSize := readOfftin(data[24:])
+	body := int64(len(data) - BSDIFF_HEADER_SIZE)
+	if controlLength < 0 || diffLength < 0 || controlLength > body || diffLength > body-controlLength {
+		return nil, errors.New("bsdiff block lengths out of range")
+	}
+	if newSize < 0 || newSize > 1<<32-1 {
+		return nil, fmt.Errorf("bsdiff new size %d out of range", newSize)
+	}
+
+	blocks := data[BSDIFF_HEADER_SIZE:]
+	control := bzip2.NewReader(bytes.NewReader(blocks[:controlLength]))
+	diff := bzip2.NewReader(bytes.NewReader(blocks[controlLength : controlLength+diffLength]))
+	extra := bzip2.NewReader(bytes.NewReader(blocks[controlLength+diffLength:]))
+
+	// Grow the result as the blocks decode rather than trusting the header size
+	result := make([]byte, 0, min(newSize, int64(len(original))+MAX_PREALLOC_CONTENT))
+	var oldPosition int64
+	triple := make([]byte, 24)
+
+	for int64(len(result)) < newSize {
+		if _, err := io.ReadFull(control, triple); err != nil {
+			return nil, fmt.Errorf("error reading bsdiff control block: %w", err)
+		}
+		newPosition := int64(len(result))
+		diffSize, extraSize, seek := readOfftin(triple), readOfftin(triple[8:]), readOfftin(triple[16:])
+		if diffSize < 0 || extraSize < 0 || diffSize > newSize-newPosition || extraSize > newSize-newPosition-diffSize {
+			return nil, errors.New("bsdiff control data out of range")
+		}
+
+		// Add diff bytes to the old data
+		diffBytes, err := readItemContent(diff, uint32(diffSize))
+		if err != nil {
+			return nil, fmt.Errorf("error reading bsdiff diff block: %w", err)
+		}
+		for i, b := range diffBytes {
+			if position := oldPosition + int64(i); position >= 0 && position < int64(len(original)) {
+				b += original[position]
+			}
+			result = append(result, b)
+		}
+		oldPosition += diffSize
+
+		// Copy extra bytes
+		extraBytes, err := readItemContent(extra, uint32(extraSize))
+		if err != nil {
+			return nil, fmt.Errorf("error reading bsdiff extra block: %w", err)
+		}
+		result = append(result, extraBytes...)
+		oldPosition += seek
+	}
+
+	return result, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	DEFAULT_INDEX_NAME = "index.json"
+	BUILD_NAME_FIELD   = "{name}" // Replaced by the file name of each original matched by a glob
+)
+
+// BuildOptions are the create options a manifest sets for all its patches, or overrides for one.
+type BuildOptions struct {
+	Format  string `json:"format,omitempty"`  // Patch format, mtgadiff when unset
+	Parity  string `json:"parity,omitempty"`  // Parity trailer size, e.g. "10%"
+	Context *int   `json:"context,omitempty"` // Context bytes stored around every change
+	Compat  *bool  `json:"compat,omitempty"`  // Write MTGADIFF revision 1.0
+}
+
+// BuildManifest lists the patches of a release, as read from -manifest.
+type BuildManifest struct {
+	Name     string            `json:"name,omitempty"`     // Release name, copied to the index
+	Version  string            `json:"version,omitempty"`  // Release version, copied to the index
+	Metadata map[string]string `json:"metadata,omitempty"` // Free-form release metadata, copied to the index
+	OutDir   string            `json:"out_dir,omitempty"`  // Directory patches are written to, relative to the manifest
+	Index    string            `json:"index,omitempty"`    // Index file name in OutDir, index.json when unset
+	Defaults BuildOptions      `json:"defaults"`           // Options of every patch
+	Patches  []struct {
+		Original string            `json:"original"`           // Original file or glob, relative to the manifest
+		New      string            `json:"new"`                // Modified file, or the directory holding them for a glob
+		Out      string            `json:"out,omitempty"`      // Patch path relative to OutDir, {name} is the original's file name
+		Metadata map[string]string `json:"metadata,omitempty"` // Free-form patch metadata, copied to the index
+		BuildOptions
+	} `json:"patches"`
+}
+
+// BuildIndex is the summary of a build, written next to the patches it lists.
+type BuildIndex struct {
+	Name     string            `json:"name,omitempty"`
+	Version  string            `json:"version,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Patches  []BuildIndexEntry `json:"patches"`
+}
+
+// BuildIndexEntry describes one produced patch; Name is its path relative to the index.
+type BuildIndexEntry struct {
+	PatchInfo
+	Format   string            `json:"format"`
+	Original string            `json:"original"` // Original file, relative to the manifest
+	New      string            `json:"new"`      // Modified file, relative to the manifest
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// buildJob is one patch to create, with its paths resolved.
+type buildJob struct {
+	opts  *CLIOptions
+	entry BuildIndexEntry
+}
+
+/*
+Creates every patch listed in a manifest and writes a summary index.
+
+Steps:
+
+ 1. Reads the manifest and expands globs into original/modified pairs
+ 2. Checks every output stays inside the output directory and is produced once
+ 3. Creates the patches concurrently with -workers workers
+ 4. Writes the index of every patch, with checksums and sizes, once all succeeded
+
+A failed patch does not stop the others; all failures are logged and no
+index is written, so a release never ships with a partial one.
+*/
+func buildPatches(opts *CLIOptions) error {
+	defer logging.Trace("build patches")()
+
+	if opts.workers < 1 {
+		return fmt.Errorf("%w: workers must be at least 1", errInvalidArguments)
+	}
+
+	data, err := os.ReadFile(opts.manifestPath)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+	manifest := &BuildManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	baseDir := filepath.Dir(opts.manifestPath)
+	outDir := filepath.Join(baseDir, manifest.OutDir)
+	jobs, err := resolveBuildJobs(manifest, baseDir, outDir)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		job.opts.mmap = opts.mmap
+	}
+
+	// Run the jobs; results keep the manifest order whatever order they finish in
+	entries := make([]BuildIndexEntry, len(jobs))
+	errs := make([]error, len(jobs))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(opts.workers, len(jobs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				entries[i], errs[i] = runBuildJob(jobs[i])
+			}
+		}()
+	}
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			logging.Error("Patch failed", "original", jobs[i].entry.Original, "error", err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d patches failed, no index written", failed, len(jobs))
+	}
+
+	indexName := manifest.Index
+	if indexName == "" {
+		indexName = DEFAULT_INDEX_NAME
+	}
+	index := BuildIndex{
+		Name:     manifest.Name,
+		Version:  manifest.Version,
+		Metadata: manifest.Metadata,
+		Patches:  entries,
+	}
+	recordDetails(index)
+	data, err = json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	indexPath := filepath.Join(outDir, indexName)
+	if err := writeBytesAtomic(indexPath, append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+
+	logging.Info("Successfully built patches", "count", len(entries), "index", indexPath)
+	return nil
+}
+
+// resolveBuildJobs expands the manifest into one job per patch, rejecting outputs outside outDir or produced twice.
+func resolveBuildJobs(manifest *BuildManifest, baseDir, outDir string) ([]buildJob, error) {
+	if len(manifest.Patches) == 0 {
+		return nil, errors.New("manifest lists no patches")
+	}
+
+	var jobs []buildJob
+	outputs := map[string]string{}
+	for _, item := range manifest.Patches {
+		if item.Original == "" || item.New == "" {
+			return nil, errors.New("every manifest patch needs an original and a new path")
+		}
+
+		options := manifest.Defaults
+		if item.Format != "" {
+			options.Format = item.Format
+		}
+		if item.Parity != "" {
+			options.Parity = item.Parity
+		}
+		if item.Context != nil {
+			options.Context = item.Context
+		}
+		if item.Compat != nil {
+			options.Compat = item.Compat
+		}
+		if options.Format == "" {
+			options.Format = FORMAT_MTGADIFF
+		}
+		context := 0
+		if options.Context != nil {
+			context = *options.Context
+		}
+		if context < 0 || context > MAX_CONTEXT_SIZE {
+			return nil, fmt.Errorf("%w: %s: context must be between 0 and %d bytes", errInvalidArguments, item.Original, MAX_CONTEXT_SIZE)
+		}
+
+		out := item.Out
+		if out == "" {
+			out = BUILD_NAME_FIELD + buildExtension(options.Format)
+		}
+
+		// A glob pairs every match with the file of the same name in the new directory
+		pairs := [][2]string{{item.Original, item.New}}
+		if strings.ContainsAny(item.Original, "*?[") {
+			matches, err := filepath.Glob(filepath.Join(baseDir, item.Original))
+			if err != nil {
+				return nil, fmt.Errorf("invalid glob %s: %w", item.Original, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("glob %s matches no files", item.Original)
+			}
+			if !strings.Contains(out, BUILD_NAME_FIELD) {
+				return nil, fmt.Errorf("glob %s needs %s in its output name", item.Original, BUILD_NAME_FIELD)
+			}
+			sort.Strings(matches)
+
+			pairs = pairs[:0]
+			for _, match := range matches {
+				original, err := filepath.Rel(baseDir, match)
+				if err != nil {
+					return nil, err
+				}
+				pairs = append(pairs, [2]string{original, filepath.Join(item.New, filepath.Base(match))})
+			}
+		}
+
+		for _, pair := range pairs {
+			name := strings.ReplaceAll(out, BUILD_NAME_FIELD, filepath.Base(pair[0]))
+			if !filepath.IsLocal(name) {
+				return nil, fmt.Errorf("output %s must stay inside the output directory", name)
+			}
+			if previous, ok := outputs[name]; ok {
+				return nil, fmt.Errorf("%s and %s both write %s", previous, pair[0], name)
+			}
+			outputs[name] = pair[0]
+
+			compat := options.Compat != nil && *options.Compat
+			jobs = append(jobs, buildJob{
+				opts: &CLIOptions{
+					mode:         MODE_CREATE,
+					originalPath: filepath.Join(baseDir, pair[0]),
+					newPath:      filepath.Join(baseDir, pair[1]),
+					outputPath:   filepath.Join(outDir, name),
+					format:       options.Format,
+					parity:       options.Parity,
+					contextSize:  context,
+					compat:       compat,
+				},
+				entry: BuildIndexEntry{
+					PatchInfo: PatchInfo{Name: filepath.ToSlash(name)},
+					Format:    options.Format,
+					Original:  filepath.ToSlash(pair[0]),
+					New:       filepath.ToSlash(pair[1]),
+					Metadata:  item.Metadata,
+				},
+			})
+		}
+	}
+	return jobs, nil
+}
+
+// runBuildJob creates the patch of a job and returns its index entry.
+func runBuildJob(job buildJob) (BuildIndexEntry, error) {
+	if err := os.MkdirAll(filepath.Dir(job.opts.outputPath), 0755); err != nil {
+		return job.entry, err
+	}
+
+	patch, err := createPatchFile(job.opts)
+	if err != nil {
+		return job.entry, err
+	}
+
+	entry := job.entry
+	name := entry.Name
+	entry.PatchInfo = newPatchFileInfo(job.opts.outputPath, patch)
+	entry.Name = name
+	return entry, nil
+}
+
+// buildExtension is the default file extension of patches in format.
+func buildExtension(format string) string {
+	if format == FORMAT_MTGADIFF {
+		return PATCH_EXTENSION
+	}
+	return "." + format
+}
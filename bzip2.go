@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+)
+
+/*
+Minimal bzip2 compressor.
+
+The standard library only decompresses bzip2, but BSDIFF40 stores its three
+blocks bzip2 compressed. This encoder writes valid streams without chasing
+ratio: a single Huffman table (duplicated, since the format requires at
+least two) per block and no selector optimisation. compress/bzip2 reads the
+output back.
+*/
+
+const (
+	BZIP2_LEVEL          = 9
+	BZIP2_MAX_BLOCK      = BZIP2_LEVEL*100000 - 20 // RLE1 output per block, with bzip2's safety margin
+	BZIP2_GROUP_SIZE     = 50
+	BZIP2_MAX_CODE_LEN   = 17
+	BZIP2_BLOCK_MAGIC    = 0x314159265359
+	BZIP2_END_MAGIC      = 0x177245385090
+	BZIP2_RUNA           = 0
+	BZIP2_RUNB           = 1
+	BZIP2_HUFFMAN_GROUPS = 2
+)
+
+var bzip2CRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// bzip2BitWriter writes bits most significant first, as bzip2 expects.
+type bzip2BitWriter struct {
+	out   bytes.Buffer
+	bits  uint64
+	count uint
+}
+
+func (w *bzip2BitWriter) write(n uint, value uint64) {
+	for n > 0 {
+		take := min(n, 32)
+		n -= take
+		w.bits = w.bits<<take | (value>>n)&(1<<take-1)
+		w.count += take
+		for w.count >= 8 {
+			w.count -= 8
+			w.out.WriteByte(byte(w.bits >> w.count))
+		}
+	}
+}
+
+func (w *bzip2BitWriter) flush() []byte {
+	if w.count > 0 {
+		w.out.WriteByte(byte(w.bits << (8 - w.count)))
+		w.count = 0
+	}
+	return w.out.Bytes()
+}
+
+// compressBzip2 compresses data into a complete bzip2 stream.
+func compressBzip2(data []byte) []byte {
+	w := &bzip2BitWriter{}
+	w.write(8, 'B')
+	w.write(8, 'Z')
+	w.write(8, 'h')
+	w.write(8, '0'+BZIP2_LEVEL)
+
+	var combinedCRC uint32
+	for len(data) > 0 {
+		block, consumed := bzip2RLE1(data)
+		crc := uint32(0xFFFFFFFF)
+		for _, b := range data[:consumed] {
+			crc = crc<<8 ^ bzip2CRCTable[byte(crc>>24)^b]
+		}
+		crc = ^crc
+		combinedCRC = (combinedCRC<<1 | combinedCRC>>31) ^ crc
+
+		writeBzip2Block(w, block, crc)
+		data = data[consumed:]
+	}
+
+	w.write(48, BZIP2_END_MAGIC)
+	w.write(32, uint64(combinedCRC))
+	return w.flush()
+}
+
+// bzip2RLE1 run-length encodes as much of data as fits in one block, returning the block and the input consumed.
+func bzip2RLE1(data []byte) ([]byte, int) {
+	block := make([]byte, 0, min(len(data), BZIP2_MAX_BLOCK))
+	i := 0
+	for i < len(data) && len(block)+5 <= BZIP2_MAX_BLOCK {
+		run := 1
+		for i+run < len(data) && run < 255 && data[i+run] == data[i] {
+			run++
+		}
+		if run >= 4 {
+			block = append(block, data[i], data[i], data[i], data[i], byte(run-4))
+		} else {
+			block = append(block, data[i:i+run]...)
+		}
+		i += run
+	}
+	return block, i
+}
+
+func writeBzip2Block(w *bzip2BitWriter, block []byte, crc uint32) {
+	// Burrows-Wheeler transform
+	rotations := sortCyclicShifts(block)
+	last := make([]byte, len(block))
+	origPtr := 0
+	for i, start := range rotations {
+		if start == 0 {
+			origPtr = i
+			last[i] = block[len(block)-1]
+		} else {
+			last[i] = block[start-1]
+		}
+	}
+
+	// Map used bytes to a dense alphabet
+	var inUse [256]bool
+	for _, b := range block {
+		inUse[b] = true
+	}
+	var unseqToSeq [256]byte
+	var mtf []byte
+	for b := 0; b < 256; b++ {
+		if inUse[b] {
+			unseqToSeq[b] = byte(len(mtf))
+			mtf = append(mtf, byte(len(mtf)))
+		}
+	}
+	alphaSize := len(mtf) + 2
+	endOfBlock := uint16(len(mtf) + 1)
+
+	// Move-to-front with RUNA/RUNB coding of zero runs
+	symbols := make([]uint16, 0, len(last)+1)
+	zeroRun := 0
+	flushRun := func() {
+		for zeroRun > 0 {
+			if zeroRun&1 == 1 {
+				symbols = append(symbols, BZIP2_RUNA)
+				zeroRun = (zeroRun - 1) >> 1
+			} else {
+				symbols = append(symbols, BZIP2_RUNB)
+				zeroRun = (zeroRun - 2) >> 1
+			}
+		}
+	}
+	for _, b := range last {
+		seq := unseqToSeq[b]
+		position := bytes.IndexByte(mtf, seq)
+		if position == 0 {
+			zeroRun++
+			continue
+		}
+		flushRun()
+		copy(mtf[1:position+1], mtf[:position])
+		mtf[0] = seq
+		symbols = append(symbols, uint16(position+1))
+	}
+	flushRun()
+	symbols = append(symbols, endOfBlock)
+
+	// One Huffman table for the whole block
+	frequencies := make([]int, alphaSize)
+	for _, s := range symbols {
+		frequencies[s]++
+	}
+	lengths := huffmanCodeLengths(frequencies, BZIP2_MAX_CODE_LEN)
+	codes := canonicalHuffmanCodes(lengths)
+
+	// Block header
+	w.write(48, BZIP2_BLOCK_MAGIC)
+	w.write(32, uint64(crc))
+	w.write(1, 0) // Not randomised
+	w.write(24, uint64(origPtr))
+
+	var used uint64
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				used |= 1 << (15 - i)
+				break
+			}
+		}
+	}
+	w.write(16, used)
+	for i := 0; i < 16; i++ {
+		if used&(1<<(15-i)) == 0 {
+			continue
+		}
+		var bits uint64
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				bits |= 1 << (15 - j)
+			}
+		}
+		w.write(16, bits)
+	}
+
+	// Selectors, all pointing at the first table
+	selectors := (len(symbols) + BZIP2_GROUP_SIZE - 1) / BZIP2_GROUP_SIZE
+	w.write(3, BZIP2_HUFFMAN_GROUPS)
+	w.write(15, uint64(selectors))
+	for i := 0; i < selectors; i++ {
+		w.write(1, 0)
+	}
+
+	// Code lengths, delta coded
+	for t := 0; t < BZIP2_HUFFMAN_GROUPS; t++ {
+		current := lengths[0]
+		w.write(5, uint64(current))
+		for _, length := range lengths {
+			for current < length {
+				w.write(2, 2) // 10: increment
+				current++
+			}
+			for current > length {
+				w.write(2, 3) // 11: decrement
+				current--
+			}
+			w.write(1, 0)
+		}
+	}
+
+	for _, s := range symbols {
+		w.write(uint(lengths[s]), uint64(codes[s]))
+	}
+}
+
+/*
+Sorts the cyclic rotations of s, returning their start positions in order.
+
+Prefix doubling with counting sorts, O(n log n): after round h the rotations
+are ordered by their first 2^h bytes.
+*/
+func sortCyclicShifts(s []byte) []int32 {
+	n := len(s)
+	p := make([]int32, n)
+	c := make([]int32, n)
+	count := make([]int32, max(256, n))
+
+	for _, b := range s {
+		count[b]++
+	}
+	for i := 1; i < 256; i++ {
+		count[i] += count[i-1]
+	}
+	for i := n - 1; i >= 0; i-- {
+		count[s[i]]--
+		p[count[s[i]]] = int32(i)
+	}
+	classes := int32(1)
+	for i := 1; i < n; i++ {
+		if s[p[i]] != s[p[i-1]] {
+			classes++
+		}
+		c[p[i]] = classes - 1
+	}
+
+	pn := make([]int32, n)
+	cn := make([]int32, n)
+	for h := 1; h < n && int(classes) < n; h <<= 1 {
+		for i := range p {
+			pn[i] = p[i] - int32(h)
+			if pn[i] < 0 {
+				pn[i] += int32(n)
+			}
+		}
+		clear(count[:classes])
+		for _, i := range pn {
+			count[c[i]]++
+		}
+		for i := int32(1); i < classes; i++ {
+			count[i] += count[i-1]
+		}
+		for i := n - 1; i >= 0; i-- {
+			count[c[pn[i]]]--
+			p[count[c[pn[i]]]] = pn[i]
+		}
+
+		cn[p[0]] = 0
+		classes = 1
+		for i := 1; i < n; i++ {
+			current := [2]int32{c[p[i]], c[(int(p[i])+h)%n]}
+			previous := [2]int32{c[p[i-1]], c[(int(p[i-1])+h)%n]}
+			if current != previous {
+				classes++
+			}
+			cn[p[i]] = classes - 1
+		}
+		c, cn = cn, c
+	}
+
+	return p
+}
+
+type huffmanNode struct {
+	weight int
+	depth  int
+	index  int // Leaf symbol, or -1 for internal nodes
+	left   *huffmanNode
+	right  *huffmanNode
+}
+
+type huffmanQueue []*huffmanNode
+
+func (q huffmanQueue) Len() int { return len(q) }
+func (q huffmanQueue) Less(i, j int) bool {
+	if q[i].weight != q[j].weight {
+		return q[i].weight < q[j].weight
+	}
+	return q[i].depth < q[j].depth
+}
+func (q huffmanQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *huffmanQueue) Push(x any)   { *q = append(*q, x.(*huffmanNode)) }
+func (q *huffmanQueue) Pop() any {
+	old := *q
+	node := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return node
+}
+
+// huffmanCodeLengths builds code lengths for every symbol, flattening the frequencies until no code exceeds maxLength.
+func huffmanCodeLengths(frequencies []int, maxLength int) []int {
+	weights := make([]int, len(frequencies))
+	for i, f := range frequencies {
+		weights[i] = max(f, 1) // Every symbol of the alphabet needs a code
+	}
+
+	for {
+		queue := &huffmanQueue{}
+		for i, weight := range weights {
+			heap.Push(queue, &huffmanNode{weight: weight, index: i})
+		}
+		for queue.Len() > 1 {
+			a := heap.Pop(queue).(*huffmanNode)
+			b := heap.Pop(queue).(*huffmanNode)
+			heap.Push(queue, &huffmanNode{weight: a.weight + b.weight, depth: max(a.depth, b.depth) + 1, index: -1, left: a, right: b})
+		}
+
+		lengths := make([]int, len(weights))
+		longest := 0
+		var walk func(node *huffmanNode, depth int)
+		walk = func(node *huffmanNode, depth int) {
+			if node.index >= 0 {
+				lengths[node.index] = max(depth, 1)
+				longest = max(longest, lengths[node.index])
+				return
+			}
+			walk(node.left, depth+1)
+			walk(node.right, depth+1)
+		}
+		walk(heap.Pop(queue).(*huffmanNode), 0)
+
+		if longest <= maxLength {
+			return lengths
+		}
+		for i := range weights {
+			weights[i] = 1 + weights[i]/2
+		}
+	}
+}
+
+// canonicalHuffmanCodes assigns codes in order of length, then symbol, as bzip2 decoders rebuild them.
+func canonicalHuffmanCodes(lengths []int) []uint32 {
+	order := make([]int, len(lengths))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return lengths[order[i]] < lengths[order[j]] })
+
+	codes := make([]uint32, len(lengths))
+	code := uint32(0)
+	length := lengths[order[0]]
+	for _, symbol := range order {
+		code <<= uint(lengths[symbol] - length)
+		length = lengths[symbol]
+		codes[symbol] = code
+		code++
+	}
+	return codes
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	PATCH_EXTENSION = ".mtgadiff"
+	NEAREST_COUNT   = 5 // Number of known versions listed when no patch matches
+)
+
+// CatalogEntry describes a single patch file found in a catalog directory.
+// Only the patch header is read to fill it in, the patch items stay on disk.
+type CatalogEntry struct {
+	Path             string   // Location of the patch file
+	Size             int64    // Size of the patch file on disk
+	OriginalLength   uint32   // Length of the file the patch applies to
+	OriginalChecksum [32]byte // SHA-256 hash of the file the patch applies to
+	PatchedLength    uint32   // Length of the file the patch produces
+	PatchedChecksum  [32]byte // SHA-256 hash of the file the patch produces
+	ItemCount        uint32   // Number of patch items stored in the patch
+}
+
+// Catalog is an index of the patch files in a directory, keyed by the checksum of the original file.
+type Catalog struct {
+	Dir        string
+	Entries    []CatalogEntry
+	byOriginal map[[32]byte][]int
+}
+
+/*
+Builds a catalog from every patch file below dir.
+
+Files that cannot be opened or do not carry a valid patch header are
+skipped with a warning, so a single broken download does not take the
+whole catalog down.
+*/
+func loadCatalog(dir string) (*Catalog, error) {
+	defer logging.Trace("load catalog")()
+
+	catalog := &Catalog{
+		Dir:        dir,
+		byOriginal: make(map[[32]byte][]int),
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), PATCH_EXTENSION) {
+			return nil
+		}
+
+		entry, err := readCatalogEntry(path)
+		if err != nil {
+			logging.Warn("Skipping patch", "path", path, "error", err)
+			return nil
+		}
+		catalog.add(*entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return catalog, nil
+}
+
+// readCatalogEntry reads the header of the patch file at path.
+func readCatalogEntry(path string) (*CatalogEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header, itemCount, err := readPatchHeader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CatalogEntry{
+		Path:             path,
+		Size:             stat.Size(),
+		OriginalLength:   header.OriginalLength,
+		OriginalChecksum: header.OriginalChecksum,
+		PatchedLength:    header.PatchedLength,
+		PatchedChecksum:  header.PatchedChecksum,
+		ItemCount:        itemCount,
+	}, nil
+}
+
+func (c *Catalog) add(entry CatalogEntry) {
+	c.Entries = append(c.Entries, entry)
+	c.byOriginal[entry.OriginalChecksum] = append(c.byOriginal[entry.OriginalChecksum], len(c.Entries)-1)
+}
+
+// lookup returns every entry whose patch applies to a file with the given checksum.
+func (c *Catalog) lookup(checksum [32]byte) []CatalogEntry {
+	var entries []CatalogEntry
+	for _, i := range c.byOriginal[checksum] {
+		entries = append(entries, c.Entries[i])
+	}
+	return entries
+}
+
+// nearest returns up to n entries whose original length is closest to length.
+func (c *Catalog) nearest(length uint32, n int) []CatalogEntry {
+	entries := make([]CatalogEntry, len(c.Entries))
+	copy(entries, c.Entries)
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return lengthDistance(entries[i].OriginalLength, length) < lengthDistance(entries[j].OriginalLength, length)
+	})
+
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+func lengthDistance(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+/*
+Applies the catalog patch matching the original file.
+
+Steps:
+
+ 1. Hashes the original file
+ 2. Looks the checksum up in the catalog
+ 3. Applies the single matching patch, or lists the nearest known versions when none match
+*/
+func autoPatch(opts *CLIOptions) error {
+	original, release, err := readInputFile(opts.originalPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading original file: %w", err)
+	}
+	defer release()
+
+	catalog, err := loadCatalog(opts.catalogPath)
+	if err != nil {
+		return fmt.Errorf("error loading catalog: %w", err)
+	}
+
+	checksum := sha256.Sum256(original)
+	matches := catalog.lookup(checksum)
+
+	switch len(matches) {
+	case 0:
+		logging.Warn("No patch matches the original file", "catalog", opts.catalogPath, "original", opts.originalPath, "length", len(original), "checksum", fmt.Sprintf("%x", checksum))
+		for _, entry := range catalog.nearest(uint32(len(original)), NEAREST_COUNT) {
+			logging.Info("Nearest known version", "patch", entry.Path, "original_length", entry.OriginalLength, "original_checksum", fmt.Sprintf("%x", entry.OriginalChecksum))
+		}
+		return fmt.Errorf("no matching patch found in catalog")
+
+	case 1:
+		logging.Info("Found matching patch", "patch", matches[0].Path)
+		recordDetails(map[string]string{"catalog_patch": matches[0].Path})
+		return applyPatchPath(original, matches[0].Path, nil, opts.outputPath)
+
+	default:
+		for _, entry := range matches {
+			logging.Info("Candidate patch", "patch", entry.Path, "patched_length", entry.PatchedLength, "patched_checksum", fmt.Sprintf("%x", entry.PatchedChecksum))
+		}
+		return fmt.Errorf("%d patches in catalog match the original file", len(matches))
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"mtgapatcher/helper"
+	"mtgapatcher/logging"
+)
+
+const (
+	DIFF_LINE_WIDTH      = 16 // Bytes shown per hexdump line
+	DEFAULT_DIFF_CONTEXT = 2  // Unchanged lines shown around each region
+
+	COLOR_AUTO   = "auto"
+	COLOR_ALWAYS = "always"
+	COLOR_NEVER  = "never"
+
+	ANSI_RESET = "\x1b[0m"
+	ANSI_RED   = "\x1b[31m"
+	ANSI_GREEN = "\x1b[32m"
+	ANSI_CYAN  = "\x1b[36m"
+)
+
+// DiffRegion is a run of bytes that differ between two files, or that only one of them has.
+type DiffRegion struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+/*
+Finds the regions in which modified differs from original.
+
+Bytes are compared at the same offsets, as generatePatch does: every run of
+differing bytes up to the shorter length is a region, and the bytes past it
+are one more region of their own when the lengths differ.
+*/
+func diffRegions(original, modified []byte) []DiffRegion {
+	minLength := helper.MinInt(len(original), len(modified))
+	var regions []DiffRegion
+
+	start := -1
+	for i := 0; i < minLength; i++ {
+		if original[i] != modified[i] {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			regions = append(regions, DiffRegion{Offset: start, Length: i - start})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		regions = append(regions, DiffRegion{Offset: start, Length: minLength - start})
+	}
+
+	if len(original) != len(modified) {
+		regions = append(regions, DiffRegion{Offset: minLength, Length: max(len(original), len(modified)) - minLength})
+	}
+	return regions
+}
+
+/*
+Finds the regions a patch changes in original.
+
+Those are the patch items, except for a full-file patch: its single item
+rewrites the whole file, so the regions are taken from diffRegions against
+the file it holds instead. Without the original, the items are all there is.
+*/
+func patchRegions(patch *PatchFile, original []byte) []DiffRegion {
+	if patchMode(patch) == PATCH_MODE_FULL_FILE && len(patch.PatchItems) == 1 && original != nil {
+		return diffRegions(original, patch.PatchItems[0].Content)
+	}
+
+	regions := make([]DiffRegion, 0, len(patch.PatchItems))
+	for _, item := range patch.PatchItems {
+		regions = append(regions, DiffRegion{Offset: int(item.Offset), Length: len(item.Content)})
+	}
+	return regions
+}
+
+/*
+Prints a side-by-side hexdump of every region in which the new file differs from the original.
+
+Steps:
+
+ 1. Finds the regions with diffRegions and keeps those overlapping -range
+ 2. Widens each region by -context lines and merges the blocks that touch
+ 3. Prints each block as offset, original bytes and new bytes, highlighting the bytes that differ
+
+With -json the hexdump is left out and the regions are listed in the result instead.
+*/
+func diffFiles(opts *CLIOptions) error {
+	defer logging.Trace("diff files")()
+
+	if opts.contextLines < 0 {
+		return fmt.Errorf("%w: context must be at least 0 lines", errInvalidArguments)
+	}
+	rangeStart, rangeEnd, err := parseOffsetRange(opts.offsetRange)
+	if err != nil {
+		return err
+	}
+	color, err := useColor(opts.color)
+	if err != nil {
+		return err
+	}
+
+	original, releaseOriginal, err := readInputFile(opts.originalPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading original file: %w", err)
+	}
+	defer releaseOriginal()
+	modified, releaseModified, err := readInputFile(opts.newPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading new file: %w", err)
+	}
+	defer releaseModified()
+
+	regions := []DiffRegion{}
+	differing := 0
+	for _, region := range diffRegions(original, modified) {
+		if region.Offset+region.Length > rangeStart && region.Offset < rangeEnd {
+			regions = append(regions, region)
+			differing += region.Length
+		}
+	}
+	recordDetails(map[string]any{"regions": regions, "differing_bytes": differing})
+	if len(regions) == 0 {
+		logging.Info("No differences found", "original", opts.originalPath, "new", opts.newPath)
+		return nil
+	}
+
+	if !opts.json {
+		writer := bufio.NewWriter(stdout)
+		writeDiffBlocks(writer, original, modified, regions, opts.contextLines, color)
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+
+	logging.Info("Compared files", "regions", len(regions), "differing_bytes", differing)
+	return nil
+}
+
+// writeDiffBlocks prints the regions, each widened by context lines, merging blocks that touch or overlap.
+func writeDiffBlocks(writer io.Writer, original, modified []byte, regions []DiffRegion, context int, color bool) {
+	lastLine := (max(len(original), len(modified)) - 1) / DIFF_LINE_WIDTH
+
+	for i := 0; i < len(regions); {
+		first := max(regions[i].Offset/DIFF_LINE_WIDTH-context, 0)
+		last := min((regions[i].Offset+regions[i].Length-1)/DIFF_LINE_WIDTH+context, lastLine)
+		block := []DiffRegion{regions[i]}
+
+		// Later regions whose lines start before this block ends join it
+		for i++; i < len(regions) && regions[i].Offset/DIFF_LINE_WIDTH-context <= last+1; i++ {
+			last = min((regions[i].Offset+regions[i].Length-1)/DIFF_LINE_WIDTH+context, lastLine)
+			block = append(block, regions[i])
+		}
+
+		start, end := block[0].Offset, block[len(block)-1].Offset+block[len(block)-1].Length
+		fmt.Fprintf(writer, "%s@@ 0x%08x-0x%08x @@ %d region(s)%s\n",
+			colorCode(color, ANSI_CYAN), start, end, len(block), colorCode(color, ANSI_RESET))
+		for line := first; line <= last; line++ {
+			writeDiffLine(writer, original, modified, line*DIFF_LINE_WIDTH, color)
+		}
+	}
+}
+
+// writeDiffLine prints one line of both files: offset, original hex and text, then new hex and text.
+func writeDiffLine(writer io.Writer, original, modified []byte, offset int, color bool) {
+	var line strings.Builder
+	fmt.Fprintf(&line, "%08x  ", offset)
+	writeDiffSide(&line, original, modified, offset, ANSI_RED, color)
+	line.WriteString("  ")
+	writeDiffSide(&line, modified, original, offset, ANSI_GREEN, color)
+	line.WriteString("\n")
+	io.WriteString(writer, line.String())
+}
+
+// writeDiffSide prints the hex and text of data at offset, highlighting the bytes other does not share.
+func writeDiffSide(line *strings.Builder, data, other []byte, offset int, highlight string, color bool) {
+	changed := func(i int) bool {
+		return i < len(data) && (i >= len(other) || data[i] != other[i])
+	}
+	paint := func(i int, text string) {
+		if changed(i) {
+			line.WriteString(colorCode(color, highlight))
+			line.WriteString(text)
+			line.WriteString(colorCode(color, ANSI_RESET))
+		} else {
+			line.WriteString(text)
+		}
+	}
+
+	for i := offset; i < offset+DIFF_LINE_WIDTH; i++ {
+		if i == offset+DIFF_LINE_WIDTH/2 {
+			line.WriteString(" ")
+		}
+		if i >= len(data) {
+			line.WriteString("   ")
+			continue
+		}
+		paint(i, fmt.Sprintf("%02x", data[i]))
+		line.WriteString(" ")
+	}
+
+	line.WriteString("|")
+	for i := offset; i < offset+DIFF_LINE_WIDTH; i++ {
+		if i >= len(data) {
+			line.WriteString(" ")
+			continue
+		}
+		char := "."
+		if data[i] >= 0x20 && data[i] < 0x7F {
+			char = string(rune(data[i]))
+		}
+		paint(i, char)
+	}
+	line.WriteString("|")
+}
+
+// colorCode returns code when coloring is on and nothing otherwise.
+func colorCode(color bool, code string) string {
+	if color {
+		return code
+	}
+	return ""
+}
+
+// useColor resolves -color: auto colors a terminal, unless NO_COLOR is set.
+func useColor(mode string) (bool, error) {
+	switch mode {
+	case COLOR_ALWAYS:
+		return true, nil
+	case COLOR_NEVER:
+		return false, nil
+	case COLOR_AUTO:
+		if os.Getenv("NO_COLOR") != "" {
+			return false, nil
+		}
+		file, ok := stdout.(*os.File)
+		if !ok {
+			return false, nil
+		}
+		stat, err := file.Stat()
+		return err == nil && stat.Mode()&os.ModeCharDevice != 0, nil
+	default:
+		return false, fmt.Errorf("%w: unknown color mode %q, expected %s, %s or %s", errInvalidArguments, mode, COLOR_AUTO, COLOR_ALWAYS, COLOR_NEVER)
+	}
+}
+
+/*
+Parses an offset range given as START-END, END excluded.
+
+Offsets are decimal or 0x-prefixed hex; either side may be left out to run
+from the start or to the end of the files. An empty range covers everything.
+*/
+func parseOffsetRange(value string) (int, int, error) {
+	start, end := 0, int(^uint(0)>>1)
+	if value == "" {
+		return start, end, nil
+	}
+
+	startText, endText, found := strings.Cut(value, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("%w: invalid offset range %q, expected START-END", errInvalidArguments, value)
+	}
+	if startText != "" {
+		parsed, err := strconv.ParseUint(startText, 0, 63)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: invalid offset range %q: %w", errInvalidArguments, value, err)
+		}
+		start = int(parsed)
+	}
+	if endText != "" {
+		parsed, err := strconv.ParseUint(endText, 0, 63)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: invalid offset range %q: %w", errInvalidArguments, value, err)
+		}
+		end = int(parsed)
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("%w: invalid offset range %q, END must be past START", errInvalidArguments, value)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	FORMAT_MTGADIFF = "mtgadiff"
+	FORMAT_VCDIFF   = "vcdiff"
+	FORMAT_BPS      = "bps"
+	FORMAT_UPS      = "ups"
+	FORMAT_IPS      = "ips"
+	FORMAT_BSDIFF   = "bsdiff"
+
+	SIDECAR_EXTENSION = ".json"
+)
+
+// PATCH_FORMATS lists the formats accepted by create -format and convert -format.
+var PATCH_FORMATS = []string{FORMAT_MTGADIFF, FORMAT_VCDIFF, FORMAT_BPS, FORMAT_UPS, FORMAT_IPS, FORMAT_BSDIFF}
+
+// writePatchFormat serializes patch to writer in the requested format.
+func writePatchFormat(format string, patch *PatchFile, original []byte, writer io.Writer) error {
+	switch format {
+	case FORMAT_MTGADIFF:
+		return writePatchFile(patch, writer)
+	case FORMAT_VCDIFF:
+		return writeVCDIFF(patch, original, writer)
+	case FORMAT_BPS:
+		return writeBPS(patch, original, writer)
+	case FORMAT_UPS:
+		return writeUPS(patch, original, writer)
+	case FORMAT_IPS:
+		return writeIPS(patch, original, writer)
+	case FORMAT_BSDIFF:
+		return writeBSDIFF(patch, original, writer)
+	default:
+		return fmt.Errorf("unknown patch format %q, expected one of %v", format, PATCH_FORMATS)
+	}
+}
+
+// detectPatchFormat identifies the format of a patch from its leading bytes without consuming them.
+func detectPatchFormat(reader *bufio.Reader) (string, error) {
+	magic, err := reader.Peek(len(IDENTIFIER))
+	if err != nil && len(magic) == 0 {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte(IDENTIFIER)):
+		return FORMAT_MTGADIFF, nil
+	case bytes.HasPrefix(magic, VCDIFF_MAGIC):
+		return FORMAT_VCDIFF, nil
+	case bytes.HasPrefix(magic, []byte(BPS_HEADER)):
+		return FORMAT_BPS, nil
+	case bytes.HasPrefix(magic, []byte(UPS_HEADER)):
+		return FORMAT_UPS, nil
+	case bytes.HasPrefix(magic, []byte(IPS_HEADER)):
+		return FORMAT_IPS, nil
+	case bytes.HasPrefix(magic, []byte(BSDIFF_HEADER)):
+		return FORMAT_BSDIFF, nil
+	default:
+		return "", errors.New("unrecognised patch file format")
+	}
+}
+
+/*
+Detects the format of the patch in reader and applies it to original.
+
+MTGADIFF, BPS and UPS patches verify the original and the result through
+their own checksums. For the other formats the checksums, when given, are
+checked before and after applying; BSDIFF40 patches refuse to apply without
+them since the format has no integrity checks at all.
+*/
+func applyPatchFormat(original []byte, reader io.Reader, checksums *PatchInfo) ([]byte, string, error) {
+	// Any format may carry a parity trailer
+	repaired, err := readRepairedPatch(reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bufReader := bufio.NewReader(repaired)
+	format, err := detectPatchFormat(bufReader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if checksums != nil {
+		if err := verifyChecksums(original, checksums.OriginalLength, checksums.OriginalChecksum); err != nil {
+			return nil, format, fmt.Errorf("original file %w", err)
+		}
+	} else if format == FORMAT_BSDIFF {
+		return nil, format, errors.New("bsdiff patches carry no checksums, supply -original-sha256 and -patched-sha256 or a checksum sidecar file")
+	}
+
+	var result []byte
+	switch format {
+	case FORMAT_VCDIFF:
+		result, err = applyVCDIFF(original, bufReader)
+	case FORMAT_BPS:
+		result, err = applyBPS(original, bufReader)
+	case FORMAT_UPS:
+		result, err = applyUPS(original, bufReader)
+	case FORMAT_IPS:
+		result, err = applyIPS(original, bufReader)
+	case FORMAT_BSDIFF:
+		result, err = applyBSDIFF(original, bufReader)
+	default:
+		var patch *PatchFile
+		if patch, err = readPatchFile(bufReader); err != nil {
+			return nil, format, fmt.Errorf("error reading patch file: %w", err)
+		}
+		result, err = applyPatch(original, patch)
+	}
+	if err != nil {
+		return nil, format, fmt.Errorf("error applying patch: %w", err)
+	}
+
+	if checksums != nil {
+		if err := verifyChecksums(result, checksums.PatchedLength, checksums.PatchedChecksum); err != nil {
+			return nil, format, fmt.Errorf("patched file %w", err)
+		}
+	}
+
+	return result, format, nil
+}
+
+// verifyChecksums checks data against a hex SHA-256 checksum and, when non-zero, a length.
+func verifyChecksums(data []byte, length uint32, checksum string) error {
+	if length != 0 && uint32(len(data)) != length {
+		return errLengthMismatch
+	}
+	if checksum != "" {
+		expected, err := parseChecksum(checksum)
+		if err != nil {
+			return fmt.Errorf("checksum invalid: %w", err)
+		}
+		if sha256.Sum256(data) != expected {
+			return errChecksumMismatch
+		}
+	}
+	return nil
+}
+
+/*
+Collects the checksums guarding a patch format without its own.
+
+Checksums given with -original-sha256 and -patched-sha256 win; otherwise the
+sidecar file (-checksums, or the patch path plus .json) is read when it
+exists. Returns nil when neither is available.
+*/
+func loadPatchChecksums(opts *CLIOptions) (*PatchInfo, error) {
+	if opts.originalChecksum != "" || opts.patchedChecksum != "" {
+		if opts.originalChecksum == "" || opts.patchedChecksum == "" {
+			return nil, fmt.Errorf("%w: both -original-sha256 and -patched-sha256 are required", errInvalidArguments)
+		}
+		return &PatchInfo{
+			OriginalChecksum: opts.originalChecksum,
+			PatchedChecksum:  opts.patchedChecksum,
+		}, nil
+	}
+
+	sidecarPath := opts.checksumPath
+	if sidecarPath == "" {
+		if opts.patchPath == "" || opts.patchPath == STDIO_PATH {
+			return nil, nil
+		}
+		sidecarPath = opts.patchPath + SIDECAR_EXTENSION
+		if _, err := os.Stat(sidecarPath); errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+	}
+
+	data, err := os.ReadFile(sidecarPath)
+	if err != nil {
+		return nil, err
+	}
+	info := &PatchInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("invalid checksum sidecar %s: %w", sidecarPath, err)
+	}
+	if info.OriginalChecksum == "" || info.PatchedChecksum == "" {
+		return nil, fmt.Errorf("checksum sidecar %s is missing checksums", sidecarPath)
+	}
+
+	return info, nil
+}
+
+// writeChecksumSidecar stores the checksums of patch next to the patch file at patchPath.
+func writeChecksumSidecar(patchPath string, patch *PatchFile) error {
+	// A patch on stdout has nothing to sit next to, so the checksums are only logged
+	if patchPath == STDIO_PATH {
+		logging.Warn("No checksum sidecar for a patch written to stdout, apply it with -original-sha256 and -patched-sha256",
+			"original_checksum", fmt.Sprintf("%x", patch.OriginalChecksum), "patched_checksum", fmt.Sprintf("%x", patch.PatchedChecksum))
+		return nil
+	}
+
+	data, err := json.MarshalIndent(newPatchFileInfo(patchPath, patch), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeBytesAtomic(patchPath+SIDECAR_EXTENSION, append(data, '\n'))
+}
+
+// newPatchFileInfo describes patch as written to patchPath, with the size and checksum of the file when it can be read.
+func newPatchFileInfo(patchPath string, patch *PatchFile) PatchInfo {
+	info := PatchInfo{
+		Name:             filepath.Base(patchPath),
+		OriginalLength:   patch.OriginalLength,
+		OriginalChecksum: hex.EncodeToString(patch.OriginalChecksum[:]),
+		PatchedLength:    patch.PatchedLength,
+		PatchedChecksum:  hex.EncodeToString(patch.PatchedChecksum[:]),
+		ItemCount:        uint32(len(patch.PatchItems)),
+	}
+
+	if checksum, err := checksumFile(patchPath); err == nil {
+		if stat, err := os.Stat(patchPath); err == nil {
+			info.Size = stat.Size()
+			info.PatchChecksum = hex.EncodeToString(checksum[:])
+		}
+	}
+	return info
+}
+
+// readPatchAnyFormat reads an MTGADIFF patch as it is, and turns a patch in any other format into one by applying it to original.
+func readPatchAnyFormat(opts *CLIOptions, original, patchData []byte) (*PatchFile, string, error) {
+	format, err := detectPatchFormat(bufio.NewReader(bytes.NewReader(patchData)))
+	if err != nil {
+		// A damaged magic may still be repaired from a parity trailer, which only MTGADIFF reading does
+		format = FORMAT_MTGADIFF
+	}
+
+	if format == FORMAT_MTGADIFF {
+		patch, err := readPatchFile(bytes.NewReader(patchData))
+		if err != nil {
+			return nil, format, fmt.Errorf("error reading patch file: %w", err)
+		}
+		return patch, format, nil
+	}
+
+	checksums, err := loadPatchChecksums(opts)
+	if err != nil {
+		return nil, format, fmt.Errorf("error reading patch checksums: %w", err)
+	}
+	modified, format, err := applyPatchFormat(original, bytes.NewReader(patchData), checksums)
+	if err != nil {
+		return nil, format, err
+	}
+	patch, err := generatePatch(original, modified)
+	if err != nil {
+		return nil, format, fmt.Errorf("error generating patch: %w", err)
+	}
+	return patch, format, nil
+}
+
+/*
+Converts a patch between formats.
+
+The input patch is applied to the original, the result diffed again with
+generatePatch and the PatchFile written in the requested format, so any
+format pair the writers can express converts losslessly.
+*/
+func convertPatchFile(opts *CLIOptions) error {
+	original, release, err := readInputFile(opts.originalPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading original file: %w", err)
+	}
+	defer release()
+
+	patchFile, err := openInput(opts.patchPath)
+	if err != nil {
+		return fmt.Errorf("error opening patch file: %w", err)
+	}
+	defer patchFile.Close()
+
+	checksums, err := loadPatchChecksums(opts)
+	if err != nil {
+		return fmt.Errorf("error reading patch checksums: %w", err)
+	}
+
+	modified, format, err := applyPatchFormat(original, patchFile, checksums)
+	if err != nil {
+		return err
+	}
+
+	patch, err := generatePatch(original, modified)
+	if err != nil {
+		return fmt.Errorf("error generating patch: %w", err)
+	}
+	if opts.compat {
+		patch.Flags = 0
+	}
+
+	recordPatch(patch)
+	recordDetails(map[string]string{"from": format})
+
+	var converted bytes.Buffer
+	if err := writePatchFormat(opts.format, patch, original, &converted); err != nil {
+		return fmt.Errorf("error converting %s patch to %s: %w", format, opts.format, err)
+	}
+
+	if err := writeBytesAtomic(opts.outputPath, converted.Bytes()); err != nil {
+		return fmt.Errorf("error writing patch file: %w", err)
+	}
+
+	if opts.format != FORMAT_MTGADIFF {
+		if err := writeChecksumSidecar(opts.outputPath, patch); err != nil {
+			return fmt.Errorf("error writing checksum sidecar: %w", err)
+		}
+	}
+
+	logging.Info("Successfully converted patch", "from", format, "to", opts.format, "output", opts.outputPath)
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	MAX_CONTEXT_SIZE    = 4096    // Context bytes stored on each side of a hunk
+	FUZZY_SEARCH_WINDOW = 1 << 20 // Distance from its expected offset a hunk is searched for
+
+	// Outcome of a hunk in a fuzzy apply
+	HUNK_EXACT   = "exact"
+	HUNK_SHIFTED = "shifted"
+	HUNK_FAILED  = "failed"
+)
+
+// HunkResult records where a patch item landed during a fuzzy apply.
+type HunkResult struct {
+	Index     int    `json:"index"`      // Position of the item in the patch
+	Offset    uint32 `json:"offset"`     // Offset recorded in the patch
+	AppliedAt int64  `json:"applied_at"` // Offset the item was written at, -1 when it failed
+	Status    string `json:"status"`     // HUNK_EXACT, HUNK_SHIFTED or HUNK_FAILED
+}
+
+// addPatchContext stores up to size original bytes on each side of every item and marks the patch with FLAG_CONTEXT.
+func addPatchContext(patch *PatchFile, original []byte, size int) {
+	defer logging.Trace("add patch context")()
+
+	for i := range patch.PatchItems {
+		item := &patch.PatchItems[i]
+		start := min(int(item.Offset), len(original))
+		end := min(start+len(item.Content), len(original))
+
+		item.ContextBefore = append([]byte{}, original[max(0, start-size):start]...)
+		item.ContextAfter = append([]byte{}, original[end:min(end+size, len(original))]...)
+	}
+	patch.Flags |= FLAG_CONTEXT
+}
+
+// contextMatches reports whether the context of item surrounds a hunk written at offset in original.
+func contextMatches(original []byte, item PatchItem, offset int64) bool {
+	before := offset - int64(len(item.ContextBefore))
+	after := offset + int64(len(item.Content))
+	if before < 0 || offset > int64(len(original)) {
+		return false
+	}
+	if len(item.ContextAfter) > 0 && after+int64(len(item.ContextAfter)) > int64(len(original)) {
+		return false
+	}
+
+	return bytes.Equal(original[before:offset], item.ContextBefore) &&
+		(len(item.ContextAfter) == 0 || bytes.Equal(original[after:after+int64(len(item.ContextAfter))], item.ContextAfter))
+}
+
+/*
+Finds where a hunk belongs in original, starting from its expected offset.
+
+The longer of the two contexts is searched for within FUZZY_SEARCH_WINDOW
+of the expected offset, and every occurrence is checked against both
+contexts. The match nearest the expected offset wins. Returns -1 when the
+contexts are found nowhere in the window.
+*/
+func locateHunk(original []byte, item PatchItem, expected int64) int64 {
+	if contextMatches(original, item, expected) {
+		return expected
+	}
+	if len(item.ContextBefore) == 0 && len(item.ContextAfter) == 0 {
+		return -1
+	}
+
+	// Anchor on the longer context; its distance to the hunk start is fixed
+	anchor, distance := item.ContextBefore, int64(len(item.ContextBefore))
+	if len(item.ContextAfter) > len(item.ContextBefore) {
+		anchor, distance = item.ContextAfter, -int64(len(item.Content))
+	}
+
+	low := max(0, expected-FUZZY_SEARCH_WINDOW-int64(len(anchor)))
+	high := min(int64(len(original)), expected+FUZZY_SEARCH_WINDOW+int64(len(item.Content)+len(anchor)))
+	if low >= high {
+		return -1
+	}
+
+	found := int64(-1)
+	for start := low; start < high; {
+		index := bytes.Index(original[start:high], anchor)
+		if index < 0 {
+			break
+		}
+		candidate := start + int64(index) + distance
+		if contextMatches(original, item, candidate) && (found < 0 || abs(candidate-expected) < abs(found-expected)) {
+			found = candidate
+		}
+		start += int64(index) + 1
+	}
+
+	return found
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+/*
+Applies a patch to an original that may differ from the one it was made for.
+
+An original matching the patch is patched as usual. Otherwise each hunk is
+located by its context, following the shift of the hunk before it, and
+written to a copy of the original resized by the length difference the patch
+records. Returns the outcome of every hunk; no file is produced when any failed.
+*/
+func applyPatchFuzzy(original []byte, patch *PatchFile) ([]byte, []HunkResult, error) {
+	defer logging.Trace("apply patch fuzzy")()
+
+	// Nothing to search for when the original is the expected one
+	if uint32(len(original)) == patch.OriginalLength && sha256.Sum256(original) == patch.OriginalChecksum {
+		result, err := applyPatch(original, patch)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		results := make([]HunkResult, len(patch.PatchItems))
+		for i, item := range patch.PatchItems {
+			results[i] = HunkResult{Index: i, Offset: item.Offset, AppliedAt: int64(item.Offset), Status: HUNK_EXACT}
+		}
+		return result, results, nil
+	}
+
+	if patch.Flags&FLAG_CONTEXT == 0 {
+		return nil, nil, fmt.Errorf("original file %w and the patch has no context, create it with -context", errChecksumMismatch)
+	}
+
+	result, results, failed, err := placeHunks(original, patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if failed > 0 {
+		return nil, results, fmt.Errorf("%d of %d hunks could not be placed", failed, len(results))
+	}
+	return result, results, nil
+}
+
+/*
+Writes every hunk of patch where its context places it in original.
+
+The output is a copy of original resized by the length difference the
+patch records. Hunks that cannot be placed are skipped and counted; the
+caller decides whether a partial result is of any use.
+*/
+func placeHunks(original []byte, patch *PatchFile) ([]byte, []HunkResult, int, error) {
+	length := int64(len(original)) + int64(patch.PatchedLength) - int64(patch.OriginalLength)
+	if length <= 0 {
+		return nil, nil, 0, errors.New("original file is too short for this patch")
+	}
+	result := make([]byte, length)
+	copy(result, original)
+
+	results := make([]HunkResult, len(patch.PatchItems))
+	failed := 0
+	shift := int64(0)
+	for i, item := range patch.PatchItems {
+		results[i] = HunkResult{Index: i, Offset: item.Offset, AppliedAt: int64(item.Offset), Status: HUNK_EXACT}
+		offset := locateHunk(original, item, int64(item.Offset)+shift)
+
+		switch {
+		case offset < 0 || offset+int64(len(item.Content)) > length:
+			results[i].AppliedAt, results[i].Status = -1, HUNK_FAILED
+			failed++
+			continue
+		case offset != int64(item.Offset):
+			results[i].AppliedAt, results[i].Status = offset, HUNK_SHIFTED
+		}
+
+		copy(result[offset:], item.Content)
+		shift = offset - int64(item.Offset)
+	}
+
+	return result, results, failed, nil
+}
+
+// reportHunks logs the hunks that did not apply at their recorded offset and a summary of all of them.
+func reportHunks(results []HunkResult) {
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Status]++
+
+		switch result.Status {
+		case HUNK_SHIFTED:
+			logging.Info("Hunk shifted", "hunk", result.Index, "offset", result.Offset, "shift", result.AppliedAt-int64(result.Offset))
+		case HUNK_FAILED:
+			logging.Warn("Hunk failed, context not found", "hunk", result.Index, "offset", result.Offset)
+		}
+	}
+
+	logging.Info("Hunks placed", HUNK_EXACT, counts[HUNK_EXACT], HUNK_SHIFTED, counts[HUNK_SHIFTED], HUNK_FAILED, counts[HUNK_FAILED])
+}
+
+// applyPatchDataFuzzy applies serialized MTGADIFF patch data with applyPatchFuzzy and writes the result to outputPath.
+func applyPatchDataFuzzy(original, patchData []byte, outputPath string) error {
+	if !bytes.HasPrefix(patchData, []byte(IDENTIFIER)) {
+		return errors.New("fuzzy apply needs an MTGADIFF patch")
+	}
+
+	patch, err := readPatchFile(bytes.NewReader(patchData))
+	if err != nil {
+		return fmt.Errorf("error reading patch file: %w", err)
+	}
+
+	result, hunks, err := applyPatchFuzzy(original, patch)
+	if hunks != nil {
+		reportHunks(hunks)
+		recordDetails(map[string]any{"hunks": hunks})
+	}
+	if err != nil {
+		return fmt.Errorf("error applying patch: %w", err)
+	}
+
+	recordFiles(original, result)
+	commandResult.Format = FORMAT_MTGADIFF
+	if sha256.Sum256(result) != patch.PatchedChecksum {
+		logging.Warn("Result differs from the file the patch was made for, check it before use")
+	}
+
+	if err := writeBytesAtomic(outputPath, result); err != nil {
+		return fmt.Errorf("error writing output file: %w", err)
+	}
+
+	logging.Info("Successfully applied patch", "output", outputPath)
+	return nil
+}
@@ -1,5 +1,3 @@
 module mtgapatcher
 
 go 1.23.5
-
-require github.com/Make-Tarkov-Great-Again/flog/v4/flog v0.0.0-20250120071701-a96c2bec9689
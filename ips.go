@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"mtgapatcher/logging"
+)
+
+/*
+IPS patch support.
+
+An IPS patch is "PATCH", a list of records and "EOF". Each record holds a
+24-bit offset and either a 16-bit length followed by that many bytes, or a
+zero length followed by a 16-bit run length and a single byte to repeat.
+The optional 24-bit value after "EOF" truncates the output.
+*/
+
+const (
+	IPS_HEADER     = "PATCH"
+	IPS_FOOTER     = "EOF"
+	IPS_MAX_OFFSET = 1<<24 - 1
+	IPS_MAX_RECORD = 1<<16 - 1
+	IPS_EOF_OFFSET = 0x454F46 // An offset spelling "EOF" would end the patch early
+)
+
+/*
+Writes a patch in IPS format.
+
+Every patch item is split into records of at most 64 KiB. The format cannot
+address bytes past 16 MiB, so items reaching beyond that are rejected with an
+error rather than silently dropped.
+*/
+func writeIPS(patch *PatchFile, original []byte, writer io.Writer) error {
+	defer logging.Trace("write ips")()
+
+	if uint32(len(original)) != patch.OriginalLength {
+		return fmt.Errorf("original file %w", errLengthMismatch)
+	}
+
+	// The patched bytes are needed to move records off the offset spelling "EOF"
+	modified, err := applyPatch(original, patch)
+	if err != nil {
+		return err
+	}
+
+	out := []byte(IPS_HEADER)
+	end := uint64(len(original))
+
+	addRecord := func(offset uint64, content []byte) error {
+		for len(content) > 0 {
+			size := min(len(content), IPS_MAX_RECORD)
+			chunk := content[:size]
+			if offset == IPS_EOF_OFFSET {
+				// Start one byte earlier so the offset cannot be mistaken for the footer
+				size = min(size, IPS_MAX_RECORD-1)
+				chunk = append([]byte{modified[offset-1]}, content[:size]...)
+				offset--
+			}
+			if offset+uint64(len(chunk)) > IPS_MAX_OFFSET+1 {
+				return fmt.Errorf("ips offsets are 24-bit and cannot hold a change at offset %d", offset)
+			}
+
+			out = append(out, byte(offset>>16), byte(offset>>8), byte(offset))
+			out = binary.BigEndian.AppendUint16(out, uint16(len(chunk)))
+			out = append(out, chunk...)
+			offset += uint64(len(chunk))
+			content = content[size:]
+		}
+		return nil
+	}
+
+	for _, item := range patch.PatchItems {
+		if err := addRecord(uint64(item.Offset), item.Content); err != nil {
+			return err
+		}
+		end = max(end, uint64(item.Offset)+uint64(len(item.Content)))
+	}
+
+	// Bytes past the original that no item covers are zero, as in applyPatch
+	if uint64(patch.PatchedLength) > end {
+		if err := addRecord(end, make([]byte, uint64(patch.PatchedLength)-end)); err != nil {
+			return err
+		}
+	}
+
+	out = append(out, IPS_FOOTER...)
+	if patch.PatchedLength < patch.OriginalLength {
+		if patch.PatchedLength > IPS_MAX_OFFSET {
+			return fmt.Errorf("ips truncation is 24-bit and cannot hold a length of %d", patch.PatchedLength)
+		}
+		out = append(out, byte(patch.PatchedLength>>16), byte(patch.PatchedLength>>8), byte(patch.PatchedLength))
+	}
+
+	_, err = writer.Write(out)
+	return err
+}
+
+// applyIPS applies an IPS patch to original and returns the result.
+func applyIPS(original []byte, reader io.Reader) ([]byte, error) {
+	defer logging.Trace("apply ips")()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(IPS_HEADER)) {
+		return nil, errors.New("invalid ips file format")
+	}
+	data = data[len(IPS_HEADER):]
+
+	result := make([]byte, len(original))
+	copy(result, original)
+
+	for {
+		if len(data) < 3 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if string(data[:3]) == IPS_FOOTER {
+			data = data[3:]
+			break
+		}
+
+		offset := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+		if len(data) < 5 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		data = data[5:]
+
+		var content []byte
+		if size > 0 {
+			if len(data) < size {
+				return nil, io.ErrUnexpectedEOF
+			}
+			content, data = data[:size], data[size:]
+		} else {
+			// RLE record
+			if len(data) < 3 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			content = bytes.Repeat(data[2:3], int(binary.BigEndian.Uint16(data[:2])))
+			data = data[3:]
+		}
+
+		if offset+len(content) > len(result) {
+			result = append(result, make([]byte, offset+len(content)-len(result))...)
+		}
+		copy(result[offset:], content)
+	}
+
+	// Optional truncation extension
+	if len(data) >= 3 {
+		length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+		if length < len(result) {
+			result = result[:length]
+		}
+	}
+
+	return result, nil
+}
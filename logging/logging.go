@@ -0,0 +1,94 @@
+// Package logging is the console logger of the patcher: leveled, structured messages in text or JSON, and timing spans on request.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+
+	TEXT_TIME_LAYOUT = "15:04:05.000"
+)
+
+// Logs at info level and above to stderr until Setup says otherwise
+var logger = newLogger(os.Stderr, slog.LevelInfo, FORMAT_TEXT)
+
+/*
+Configures the logger.
+
+Quiet keeps warnings and errors only, verbose adds debug messages and the
+timing spans of Trace. Format is FORMAT_TEXT or FORMAT_JSON, one object per line.
+*/
+func Setup(writer io.Writer, quiet, verbose bool, format string) error {
+	if quiet && verbose {
+		return fmt.Errorf("-quiet and -verbose cannot be combined")
+	}
+	if format != FORMAT_TEXT && format != FORMAT_JSON {
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, FORMAT_TEXT, FORMAT_JSON)
+	}
+
+	level := slog.LevelInfo
+	if quiet {
+		level = slog.LevelWarn
+	}
+	if verbose {
+		level = slog.LevelDebug
+	}
+
+	logger = newLogger(writer, level, format)
+	return nil
+}
+
+func newLogger(writer io.Writer, level slog.Level, format string) *slog.Logger {
+	if format == FORMAT_JSON {
+		return slog.New(slog.NewJSONHandler(writer, &slog.HandlerOptions{Level: level}))
+	}
+
+	// Wall clock time is all a console reader needs
+	return slog.New(slog.NewTextHandler(writer, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.String(slog.TimeKey, attr.Value.Time().Format(TEXT_TIME_LAYOUT))
+			}
+			return attr
+		},
+	}))
+}
+
+// Debug logs a message only shown with -verbose. Args are alternating keys and values.
+func Debug(msg string, args ...any) { logger.Debug(msg, args...) }
+
+// Info logs a progress message. Args are alternating keys and values.
+func Info(msg string, args ...any) { logger.Info(msg, args...) }
+
+// Warn logs a message the user should act on. Args are alternating keys and values.
+func Warn(msg string, args ...any) { logger.Warn(msg, args...) }
+
+// Error logs a failure. Args are alternating keys and values.
+func Error(msg string, args ...any) { logger.Error(msg, args...) }
+
+/*
+Starts a timing span, ended by calling the returned function:
+
+	defer logging.Trace("apply patch")()
+
+Spans are only logged with -verbose; otherwise Trace does no work at all.
+*/
+func Trace(name string) func() {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		logger.Debug("Span finished", "span", name, "duration", time.Since(start))
+	}
+}
@@ -0,0 +1,42 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	defer Setup(os.Stderr, false, false, FORMAT_TEXT)
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, true, false, FORMAT_JSON); err != nil {
+		t.Fatal(err)
+	}
+	Info("hidden")
+	Trace("hidden")()
+	Warn("shown", "output", "out.bin")
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single JSON line, got %q: %v", buf.String(), err)
+	}
+	if entry["msg"] != "shown" || entry["output"] != "out.bin" {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+
+	buf.Reset()
+	if err := Setup(&buf, false, true, FORMAT_TEXT); err != nil {
+		t.Fatal(err)
+	}
+	Trace("step")()
+	if !strings.Contains(buf.String(), "span=step") {
+		t.Fatalf("expected a span with -verbose, got %q", buf.String())
+	}
+
+	if Setup(&buf, true, true, FORMAT_TEXT) == nil || Setup(&buf, false, false, "xml") == nil {
+		t.Fatal("expected invalid settings to be rejected")
+	}
+}
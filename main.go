@@ -15,7 +15,9 @@
 
   - Major Version: 0x01
 
-  - Minor Version: 0x00
+  - Minor Version: 0x00, or 0x01 for revision 1.1
+
+  - Flags: uint32 (4 bytes, big-endian), revision 1.1 only. 0x01: item CRC32s, 0x02: patch SHA-256, 0x04: context, 0x08: signatures
 
   - Original File Information:
 
@@ -40,6 +42,16 @@
 
   - Content: variable-length byte array
 
+  - Context: with flag 0x04, a uint32 length and the original bytes before the item, then the same after it
+
+  - CRC32: uint32 (4 bytes, big-endian), with flag 0x01. Covers every item field before it
+
+  - Signatures
+    With flag 0x08, the items are followed by a uint32 rule count and the rules (see writeSignatures).
+
+  - Patch Trailer
+    With flag 0x02, the file ends with the SHA-256 of every byte before it (32 bytes).
+
 The utility includes comprehensive error checking for:
   - File format validation
   - Version compatibility
@@ -82,24 +94,46 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/Make-Tarkov-Great-Again/flog/v4/flog"
+	"hash/crc32"
 	"io"
 	"mtgapatcher/helper"
-	"mtgapatcher/util"
 	"os"
+	"runtime"
+	"time"
 	"flag"
 
+	"mtgapatcher/logging"
 )
 
 const (
 	IDENTIFIER    = "MTGADIFF"
 	VERSION_MAJOR = 0x01
 	VERSION_MINOR = 0x00
+
+	// Revision 1.1 adds a flags field after the version
+	VERSION_MINOR_FLAGS = 0x01
+
+	FLAG_ITEM_CRC32     = 1 << 0 // Every item is followed by the CRC32 of its offset, length and content
+	FLAG_PATCH_CHECKSUM = 1 << 1 // The file ends with the SHA-256 of everything before it
+	FLAG_CONTEXT        = 1 << 2 // Every item stores the original bytes around it, for fuzzy apply
+	FLAG_SIGNATURES     = 1 << 3 // A section of byte-pattern rules follows the items
+	FLAG_FULL_FILE      = 1 << 4 // The only item is the whole patched file, the delta having been larger
+
+	KNOWN_PATCH_FLAGS   = FLAG_ITEM_CRC32 | FLAG_PATCH_CHECKSUM | FLAG_CONTEXT | FLAG_SIGNATURES | FLAG_FULL_FILE
+	DEFAULT_PATCH_FLAGS = FLAG_ITEM_CRC32 | FLAG_PATCH_CHECKSUM
+
+	PATCH_MODE_DELTA     = "delta"     // Items hold the runs of changed bytes
+	PATCH_MODE_FULL_FILE = "full-file" // The single item is the whole new file
+
+	MAX_PREALLOC_ITEMS   = 1024      // Patch items allocated ahead of reading them
+	MAX_PREALLOC_CONTENT = 64 * 1024 // Item content allocated ahead of reading it
 )
 
 type PatchItem struct {
-	Offset  uint32 // Position in the file where the patch should be applied | uint32 (4 bytes, big-endian)
-	Content []byte // The actual patch data | variable-length byte array
+	Offset        uint32 // Position in the file where the patch should be applied | uint32 (4 bytes, big-endian)
+	Content       []byte // The actual patch data | variable-length byte array
+	ContextBefore []byte // Original bytes just before Offset, with FLAG_CONTEXT
+	ContextAfter  []byte // Original bytes just after the content, with FLAG_CONTEXT
 }
 
 type PatchFile struct {
@@ -107,12 +141,28 @@ type PatchFile struct {
 	OriginalChecksum [32]byte    // SHA-256 hash of original file
 	PatchedLength    uint32      // Length of the resulting patched file
 	PatchedChecksum  [32]byte    // SHA-256 hash of patched file
+	Flags            uint32      // Optional integrity data, written as revision 1.1 when non-zero
 	PatchItems       []PatchItem // List of patches to apply
+	Signatures       []SignatureRule // Byte-pattern rules applied after the items, with FLAG_SIGNATURES
 }
 
 const (
 	MODE_CREATE = "create"
 	MODE_PATCH  = "patch"
+	MODE_AUTO    = "auto"
+	MODE_UPGRADE = "upgrade"
+	MODE_SERVE   = "serve"
+	MODE_FETCH   = "fetch"
+	MODE_CONVERT = "convert"
+	MODE_APPLY   = "apply"
+	MODE_SELFTEST = "selftest"
+	MODE_BENCH    = "bench"
+	MODE_REPAIR   = "repair"
+	MODE_REBASE   = "rebase"
+	MODE_BUILD    = "build"
+	MODE_DIFF     = "diff"
+	MODE_REPORT   = "report"
+	MODE_STATS    = "stats"
 )
 
 // CLIOptions holds the command line arguments
@@ -122,6 +172,34 @@ type CLIOptions struct {
 	newPath     string
 	patchPath   string
 	outputPath  string
+	catalogPath string
+	targetChecksum string
+	patchURL    string
+	listenAddr  string
+	format      string
+	originalChecksum string
+	patchedChecksum  string
+	checksumPath     string
+	gameDir          string
+	planPath         string
+	recoverMode      string
+	benchRuns        int
+	compat           bool
+	parity           string
+	contextSize      int
+	fuzzy            bool
+	signaturePath    string
+	manifestPath     string
+	workers          int
+	quiet            bool
+	verbose          bool
+	logFormat        string
+	json             bool
+	mmap             bool
+	stream           bool
+	contextLines     int
+	offsetRange      string
+	color            string
 }
 
 func parseFlags() (*CLIOptions, error) {
@@ -132,119 +210,568 @@ func parseFlags() (*CLIOptions, error) {
 	createOriginal := createCmd.String("original", "", "Path to original file")
 	createNew := createCmd.String("new", "", "Path to new/modified file")
 	createOutput := createCmd.String("out", "", "Path to save the patch file")
+	createFormat := createCmd.String("format", FORMAT_MTGADIFF, "Patch format to write: mtgadiff, vcdiff, bps, ups, ips or bsdiff")
+	createParity := createCmd.String("parity", "", "Append Reed-Solomon parity of this size relative to the patch, e.g. 10%, to repair damaged bytes")
+	createContext := createCmd.Int("context", 0, "Store this many original bytes around every change so the patch can be applied with -fuzzy")
+	createSignatures := createCmd.String("signatures", "", "Path to a signature rules file, to create a signature-only patch (-original then only checks the rules)")
+	createCompat := createCmd.Bool("compat", false, "Write MTGADIFF revision 1.0, without item and patch checksums, for older patchers")
+	createStream := createCmd.Bool("stream", false, "Diff the inputs in windows read from disk and stream the patch out, for files larger than memory (up to 4 GiB; applying the patch still loads it and both files)")
 
 	// Patch command
 	patchCmd := flag.NewFlagSet(MODE_PATCH, flag.ExitOnError)
 	patchOriginal := patchCmd.String("original", "", "Path to original file")
 	patchFile := patchCmd.String("patch", "", "Path to patch file")
 	patchOutput := patchCmd.String("out", "", "Path to save the patched file")
-
-	if len(os.Args) < 2 {
-		return nil, fmt.Errorf("expected 'create' or 'patch' subcommands")
-	}
-
-	switch os.Args[1] {
+	patchURL := patchCmd.String("url", "", "Base URL of a patch server to download the patch from instead of -patch")
+	patchTarget := patchCmd.String("target", "", "SHA-256 checksum (hex) of the wanted file, when the server offers several patches")
+	patchOriginalSum := patchCmd.String("original-sha256", "", "Expected SHA-256 checksum (hex) of the original file, for formats without checksums")
+	patchPatchedSum := patchCmd.String("patched-sha256", "", "Expected SHA-256 checksum (hex) of the patched file, for formats without checksums")
+	patchFuzzy := patchCmd.Bool("fuzzy", false, "Relocate hunks by their context when the original does not match the patch")
+	patchChecksums := patchCmd.String("checksums", "", "Path to the checksum sidecar file (default: patch path + "+SIDECAR_EXTENSION+")")
+
+	// Auto command
+	autoCmd := flag.NewFlagSet(MODE_AUTO, flag.ExitOnError)
+	autoOriginal := autoCmd.String("original", "", "Path to original file")
+	autoCatalog := autoCmd.String("catalog", "", "Path to the directory of patch files")
+	autoOutput := autoCmd.String("out", "", "Path to save the patched file")
+
+	// Upgrade command
+	upgradeCmd := flag.NewFlagSet(MODE_UPGRADE, flag.ExitOnError)
+	upgradeOriginal := upgradeCmd.String("original", "", "Path to original file")
+	upgradeCatalog := upgradeCmd.String("catalog", "", "Path to the directory of patch files")
+	upgradeTarget := upgradeCmd.String("target", "", "SHA-256 checksum (hex) of the file to upgrade to")
+	upgradeOutput := upgradeCmd.String("out", "", "Path to save the upgraded file")
+
+	// Serve command
+	serveCmd := flag.NewFlagSet(MODE_SERVE, flag.ExitOnError)
+	serveCatalog := serveCmd.String("catalog", "", "Path to the directory of patch files")
+	serveAddr := serveCmd.String("addr", DEFAULT_LISTEN_ADDR, "Address to listen on")
+
+	// Fetch command
+	fetchCmd := flag.NewFlagSet(MODE_FETCH, flag.ExitOnError)
+	fetchOriginal := fetchCmd.String("original", "", "Path to original file")
+	fetchURL := fetchCmd.String("url", "", "Base URL of the patch server")
+	fetchTarget := fetchCmd.String("target", "", "SHA-256 checksum (hex) of the wanted file, when the server offers several patches")
+	fetchOutput := fetchCmd.String("out", "", "Path to save the downloaded patch file")
+
+	// Convert command
+	convertCmd := flag.NewFlagSet(MODE_CONVERT, flag.ExitOnError)
+	convertOriginal := convertCmd.String("original", "", "Path to original file")
+	convertPatch := convertCmd.String("patch", "", "Path to the patch file to convert, in any supported format")
+	convertFormat := convertCmd.String("format", FORMAT_MTGADIFF, "Patch format to write: mtgadiff, vcdiff, bps, ups, ips or bsdiff")
+	convertCompat := convertCmd.Bool("compat", false, "Write MTGADIFF revision 1.0, without item and patch checksums, for older patchers")
+	convertOutput := convertCmd.String("out", "", "Path to save the converted patch file")
+	convertOriginalSum := convertCmd.String("original-sha256", "", "Expected SHA-256 checksum (hex) of the original file, for formats without checksums")
+	convertPatchedSum := convertCmd.String("patched-sha256", "", "Expected SHA-256 checksum (hex) of the patched file, for formats without checksums")
+	convertChecksums := convertCmd.String("checksums", "", "Path to the checksum sidecar file (default: patch path + "+SIDECAR_EXTENSION+")")
+
+	// Apply command
+	applyCmd := flag.NewFlagSet(MODE_APPLY, flag.ExitOnError)
+	applyDir := applyCmd.String("dir", "", "Path to the game directory")
+	applyPlan := applyCmd.String("plan", "", "Path to the JSON plan listing the files and patches to apply")
+	applyRecover := applyCmd.String("recover", "", "Settle an interrupted transaction: forward or rollback")
+
+	// Rebase command
+	rebaseCmd := flag.NewFlagSet(MODE_REBASE, flag.ExitOnError)
+	rebaseOld := rebaseCmd.String("old", "", "Path to the original file the patch was made for")
+	rebaseNew := rebaseCmd.String("new", "", "Path to the new original file to re-target the patch to")
+	rebasePatch := rebaseCmd.String("patch", "", "Path to the patch file to rebase")
+	rebaseOutput := rebaseCmd.String("out", "", "Path to save the rebased patch file")
+
+	// Repair command
+	repairCmd := flag.NewFlagSet(MODE_REPAIR, flag.ExitOnError)
+	repairPatch := repairCmd.String("patch", "", "Path to the damaged patch file")
+	repairOutput := repairCmd.String("out", "", "Path to save the repaired patch file")
+
+	// Selftest command
+	selftestCmd := flag.NewFlagSet(MODE_SELFTEST, flag.ExitOnError)
+
+	// Bench command
+	benchCmd := flag.NewFlagSet(MODE_BENCH, flag.ExitOnError)
+	benchOriginal := benchCmd.String("original", "", "Path to original file")
+	benchNew := benchCmd.String("new", "", "Path to new/modified file")
+	benchRuns := benchCmd.Int("runs", DEFAULT_BENCH_RUNS, "Number of timed runs per stage, the fastest is reported")
+
+	// Build command
+	buildCmd := flag.NewFlagSet(MODE_BUILD, flag.ExitOnError)
+	buildManifest := buildCmd.String("manifest", "", "Path to the JSON manifest listing the patches to create")
+	buildWorkers := buildCmd.Int("workers", runtime.NumCPU(), "Number of patches created at the same time")
+
+	// Diff command
+	diffCmd := flag.NewFlagSet(MODE_DIFF, flag.ExitOnError)
+	diffOriginal := diffCmd.String("original", "", "Path to original file")
+	diffNew := diffCmd.String("new", "", "Path to new/modified file")
+	diffContext := diffCmd.Int("context", DEFAULT_DIFF_CONTEXT, "Number of unchanged lines shown around each differing region")
+	diffRange := diffCmd.String("range", "", "Only show regions overlapping START-END, e.g. 0x1000-0x2000 (END excluded, either side optional)")
+	diffColor := diffCmd.String("color", COLOR_AUTO, "Highlight differing bytes: auto, always or never")
+
+	// Report command
+	reportCmd := flag.NewFlagSet(MODE_REPORT, flag.ExitOnError)
+	reportPatch := reportCmd.String("patch", "", "Path to the patch file to report on, in any supported format")
+	reportOriginal := reportCmd.String("original", "", "Path to the original file the patch applies to")
+	reportHTML := reportCmd.String("html", "", "Path to save the HTML report")
+	reportChecksums := reportCmd.String("checksums", "", "Path to the checksum sidecar file (default: patch path + "+SIDECAR_EXTENSION+")")
+
+	// Stats command
+	statsCmd := flag.NewFlagSet(MODE_STATS, flag.ExitOnError)
+	statsOriginal := statsCmd.String("original", "", "Path to original file")
+	statsNew := statsCmd.String("new", "", "Path to new/modified file, to diff against the original")
+	statsPatch := statsCmd.String("patch", "", "Path to an existing patch file, in any supported format, instead of -new")
+	statsContext := statsCmd.Int("context", DEFAULT_STATS_CONTEXT, "Context bytes per change for the -context size estimate")
+	statsParity := statsCmd.String("parity", DEFAULT_STATS_PARITY, "Parity size for the -parity size estimate")
+	statsChecksums := statsCmd.String("checksums", "", "Path to the checksum sidecar file (default: patch path + "+SIDECAR_EXTENSION+")")
+
+	// Logging flags are accepted before the subcommand and by every subcommand
+	globalCmd := flag.NewFlagSet("mtgapatcher", flag.ExitOnError)
+	for _, cmd := range []*flag.FlagSet{globalCmd, createCmd, patchCmd, autoCmd, upgradeCmd, serveCmd, fetchCmd, convertCmd,
+		applyCmd, rebaseCmd, repairCmd, selftestCmd, benchCmd, buildCmd, diffCmd, reportCmd, statsCmd} {
+		cmd.BoolVar(&options.quiet, "quiet", false, "Only log warnings and errors")
+		cmd.BoolVar(&options.verbose, "verbose", false, "Log debug messages and the time taken by each step")
+		cmd.StringVar(&options.logFormat, "log-format", logging.FORMAT_TEXT, "Log format: text or json")
+		cmd.BoolVar(&options.json, "json", false, "Print a JSON result object on stdout when the command finishes")
+		cmd.BoolVar(&options.mmap, "mmap", false, "Memory-map input files instead of reading them onto the heap (Linux only)")
+	}
+	globalCmd.Parse(os.Args[1:])
+	args := globalCmd.Args()
+
+	if len(args) < 1 {
+		return options, fmt.Errorf("expected 'create', 'patch', 'auto', 'upgrade', 'serve', 'fetch', 'convert', 'apply', 'rebase', 'repair', 'build', 'diff', 'report', 'stats', 'selftest' or 'bench' subcommands")
+	}
+
+	switch args[0] {
 	case MODE_CREATE:
 		options.mode = MODE_CREATE
-		createCmd.Parse(os.Args[2:])
+		createCmd.Parse(args[1:])
 		options.originalPath = *createOriginal
 		options.newPath = *createNew
 		options.outputPath = *createOutput
+		options.format = *createFormat
+		options.compat = *createCompat
+		options.parity = *createParity
+		options.contextSize = *createContext
+		options.signaturePath = *createSignatures
+		options.stream = *createStream
+
+		// Signature patches need no files, the original only checks the rules
+		if options.signaturePath != "" {
+			if options.outputPath == "" {
+				return options, fmt.Errorf("output path is required")
+			}
+			return options, nil
+		}
 
 	case MODE_PATCH:
 		options.mode = MODE_PATCH
-		patchCmd.Parse(os.Args[2:])
+		patchCmd.Parse(args[1:])
 		options.originalPath = *patchOriginal
 		options.patchPath = *patchFile
 		options.outputPath = *patchOutput
+		options.patchURL = *patchURL
+		options.targetChecksum = *patchTarget
+		options.originalChecksum = *patchOriginalSum
+		options.patchedChecksum = *patchPatchedSum
+		options.checksumPath = *patchChecksums
+		options.fuzzy = *patchFuzzy
+
+	case MODE_AUTO:
+		options.mode = MODE_AUTO
+		autoCmd.Parse(args[1:])
+		options.originalPath = *autoOriginal
+		options.catalogPath = *autoCatalog
+		options.outputPath = *autoOutput
+
+	case MODE_UPGRADE:
+		options.mode = MODE_UPGRADE
+		upgradeCmd.Parse(args[1:])
+		options.originalPath = *upgradeOriginal
+		options.catalogPath = *upgradeCatalog
+		options.targetChecksum = *upgradeTarget
+		options.outputPath = *upgradeOutput
+
+	case MODE_SERVE:
+		options.mode = MODE_SERVE
+		serveCmd.Parse(args[1:])
+		options.catalogPath = *serveCatalog
+		options.listenAddr = *serveAddr
+
+		// Serving needs neither an original nor an output file
+		if options.catalogPath == "" {
+			return options, fmt.Errorf("catalog directory is required for serve mode")
+		}
+		// Catalog patches can be replaced while the server runs
+		if options.mmap {
+			return options, fmt.Errorf("-mmap is not supported in serve mode")
+		}
+		return options, nil
+
+	case MODE_FETCH:
+		options.mode = MODE_FETCH
+		fetchCmd.Parse(args[1:])
+		options.originalPath = *fetchOriginal
+		options.patchURL = *fetchURL
+		options.targetChecksum = *fetchTarget
+		options.outputPath = *fetchOutput
+
+	case MODE_CONVERT:
+		options.mode = MODE_CONVERT
+		convertCmd.Parse(args[1:])
+		options.originalPath = *convertOriginal
+		options.patchPath = *convertPatch
+		options.format = *convertFormat
+		options.compat = *convertCompat
+		options.outputPath = *convertOutput
+		options.originalChecksum = *convertOriginalSum
+		options.patchedChecksum = *convertPatchedSum
+		options.checksumPath = *convertChecksums
+
+	case MODE_APPLY:
+		options.mode = MODE_APPLY
+		applyCmd.Parse(args[1:])
+		options.gameDir = *applyDir
+		options.planPath = *applyPlan
+		options.recoverMode = *applyRecover
+
+		// Files and patches come from the plan, or the journal when recovering
+		if options.gameDir == "" {
+			return options, fmt.Errorf("game directory is required for apply mode")
+		}
+		// The files are replaced and restored as the transaction runs
+		if options.mmap {
+			return options, fmt.Errorf("-mmap is not supported in apply mode")
+		}
+		return options, nil
+
+	case MODE_REBASE:
+		options.mode = MODE_REBASE
+		rebaseCmd.Parse(args[1:])
+		options.originalPath = *rebaseOld
+		options.newPath = *rebaseNew
+		options.patchPath = *rebasePatch
+		options.outputPath = *rebaseOutput
+
+	case MODE_REPAIR:
+		options.mode = MODE_REPAIR
+		repairCmd.Parse(args[1:])
+		options.patchPath = *repairPatch
+		options.outputPath = *repairOutput
+
+		// Repairing needs only the patch
+		if options.patchPath == "" || options.outputPath == "" {
+			return options, fmt.Errorf("patch and output paths are required for repair mode")
+		}
+		return options, nil
+
+	case MODE_SELFTEST:
+		options.mode = MODE_SELFTEST
+		selftestCmd.Parse(args[1:])
+
+		// Inputs are synthesized, nothing to validate
+		return options, nil
+
+	case MODE_BENCH:
+		options.mode = MODE_BENCH
+		benchCmd.Parse(args[1:])
+		options.originalPath = *benchOriginal
+		options.newPath = *benchNew
+		options.benchRuns = *benchRuns
+
+		// Benchmarks write nothing to disk
+		if options.originalPath == "" || options.newPath == "" {
+			return options, fmt.Errorf("original and new file paths are required for bench mode")
+		}
+		return options, checkStdinInputs(options)
+
+	case MODE_BUILD:
+		options.mode = MODE_BUILD
+		buildCmd.Parse(args[1:])
+		options.manifestPath = *buildManifest
+		options.workers = *buildWorkers
+
+		// Files and outputs come from the manifest
+		if options.manifestPath == "" {
+			return options, fmt.Errorf("manifest path is required for build mode")
+		}
+		return options, nil
+
+	case MODE_DIFF:
+		options.mode = MODE_DIFF
+		diffCmd.Parse(args[1:])
+		options.originalPath = *diffOriginal
+		options.newPath = *diffNew
+		options.contextLines = *diffContext
+		options.offsetRange = *diffRange
+		options.color = *diffColor
+
+		// The hexdump goes to stdout, nothing is written to disk
+		if options.originalPath == "" || options.newPath == "" {
+			return options, fmt.Errorf("original and new file paths are required for diff mode")
+		}
+		return options, checkStdinInputs(options)
+
+	case MODE_REPORT:
+		options.mode = MODE_REPORT
+		reportCmd.Parse(args[1:])
+		options.patchPath = *reportPatch
+		options.originalPath = *reportOriginal
+		options.outputPath = *reportHTML
+		options.checksumPath = *reportChecksums
+
+		if options.patchPath == "" {
+			return options, fmt.Errorf("patch file path is required for report mode")
+		}
+		if options.outputPath == "" {
+			return options, fmt.Errorf("html output path is required for report mode")
+		}
+
+	case MODE_STATS:
+		options.mode = MODE_STATS
+		statsCmd.Parse(args[1:])
+		options.originalPath = *statsOriginal
+		options.newPath = *statsNew
+		options.patchPath = *statsPatch
+		options.contextSize = *statsContext
+		options.parity = *statsParity
+		options.checksumPath = *statsChecksums
+
+		// Statistics are logged and written to nothing else
+		if options.patchPath == "" && (options.originalPath == "" || options.newPath == "") {
+			return options, fmt.Errorf("original and new file paths, or a patch file path, are required for stats mode")
+		}
+		if options.patchPath != "" && options.newPath != "" {
+			return options, fmt.Errorf("-new and -patch cannot be combined")
+		}
+		if options.contextSize < 0 || options.contextSize > MAX_CONTEXT_SIZE {
+			return options, fmt.Errorf("context must be between 0 and %d bytes", MAX_CONTEXT_SIZE)
+		}
+		return options, checkStdinInputs(options)
 
 	default:
-		return nil, fmt.Errorf("expected 'create' or 'patch' subcommands")
+		return options, fmt.Errorf("expected 'create', 'patch', 'auto', 'upgrade', 'serve', 'fetch', 'convert', 'apply', 'rebase', 'repair', 'build', 'diff', 'report', 'stats', 'selftest' or 'bench' subcommands")
 	}
 
 	// Validate required fields
 	if options.originalPath == "" {
-		return nil, fmt.Errorf("original file path is required")
+		return options, fmt.Errorf("original file path is required")
 	}
 	if options.outputPath == "" {
-		return nil, fmt.Errorf("output path is required")
+		return options, fmt.Errorf("output path is required")
 	}
 	if options.mode == MODE_CREATE && options.newPath == "" {
-		return nil, fmt.Errorf("new file path is required for create mode")
+		return options, fmt.Errorf("new file path is required for create mode")
+	}
+	if options.mode == MODE_REBASE && (options.newPath == "" || options.patchPath == "") {
+		return options, fmt.Errorf("new original and patch file paths are required for rebase mode")
 	}
-	if options.mode == MODE_PATCH && options.patchPath == "" {
-		return nil, fmt.Errorf("patch file path is required for patch mode")
+	if options.mode == MODE_PATCH && options.patchPath == "" && options.patchURL == "" {
+		return options, fmt.Errorf("patch file path or server URL is required for patch mode")
+	}
+	if options.mode == MODE_PATCH && options.fuzzy && options.patchPath == "" {
+		return options, fmt.Errorf("fuzzy apply needs a local patch file")
+	}
+	if options.mode == MODE_CREATE && (options.contextSize < 0 || options.contextSize > MAX_CONTEXT_SIZE) {
+		return options, fmt.Errorf("context must be between 0 and %d bytes", MAX_CONTEXT_SIZE)
+	}
+	if options.mode == MODE_CONVERT && options.patchPath == "" {
+		return options, fmt.Errorf("patch file path is required for convert mode")
+	}
+	if err := checkStdinInputs(options); err != nil {
+		return options, err
+	}
+	if options.json && options.outputPath == STDIO_PATH {
+		return options, fmt.Errorf("-json cannot be combined with -out=%s, both use stdout", STDIO_PATH)
+	}
+	if options.mode == MODE_FETCH && options.patchURL == "" {
+		return options, fmt.Errorf("server URL is required for fetch mode")
+	}
+	if (options.mode == MODE_AUTO || options.mode == MODE_UPGRADE) && options.catalogPath == "" {
+		return options, fmt.Errorf("catalog directory is required for %s mode", options.mode)
+	}
+	if options.mode == MODE_UPGRADE && options.targetChecksum == "" {
+		return options, fmt.Errorf("target checksum is required for upgrade mode")
 	}
 
 	return options, nil
 }
 
+// checkStdinInputs rejects more than one input read from stdin, which can only be read once.
+func checkStdinInputs(options *CLIOptions) error {
+	count := 0
+	for _, path := range []string{options.originalPath, options.newPath, options.patchPath} {
+		if path == STDIO_PATH {
+			count++
+		}
+	}
+	if count > 1 {
+		return fmt.Errorf("only one of -original, -new and -patch can be read from stdin (%s)", STDIO_PATH)
+	}
+	return nil
+}
 
 func createPatch(opts *CLIOptions) error {
+	if opts.signaturePath != "" {
+		return createSignaturePatch(opts)
+	}
+	if opts.stream {
+		return createStreamingPatch(opts)
+	}
+
+	patch, err := createPatchFile(opts)
+	if err != nil {
+		return err
+	}
+	recordPatch(patch)
+	recordDetails(map[string]string{"mode": patchMode(patch)})
+	return nil
+}
+
+// createPatchFile diffs opts.originalPath against opts.newPath and writes the patch to opts.outputPath, returning it.
+func createPatchFile(opts *CLIOptions) (*PatchFile, error) {
 	// Read original and new files
-	original, err := readFileWithFileRead(opts.originalPath)
+	original, releaseOriginal, err := readInputFile(opts.originalPath, opts.mmap)
 	if err != nil {
-		return fmt.Errorf("error reading original file: %v", err)
+		return nil, fmt.Errorf("error reading original file: %w", err)
 	}
+	defer releaseOriginal()
 
-	modified, err := readFileWithFileRead(opts.newPath)
+	modified, releaseModified, err := readInputFile(opts.newPath, opts.mmap)
 	if err != nil {
-		return fmt.Errorf("error reading new file: %v", err)
+		return nil, fmt.Errorf("error reading new file: %w", err)
 	}
+	defer releaseModified()
 
 	// Generate patch
 	patch, err := generatePatch(original, modified)
 	if err != nil {
-		return fmt.Errorf("error generating patch: %v", err)
+		return nil, fmt.Errorf("error generating patch: %w", err)
+	}
+	logging.Info("Patch mode chosen", "mode", patchMode(patch), "items", len(patch.PatchItems))
+	if opts.compat {
+		patch.Flags = 0
+	}
+
+	// Store context for fuzzy apply
+	if opts.contextSize > 0 {
+		if opts.format != FORMAT_MTGADIFF || opts.compat {
+			return nil, errors.New("context is only stored in MTGADIFF 1.1 patches")
+		}
+		addPatchContext(patch, original, opts.contextSize)
+	}
+
+	if err := writePatchOutput(opts, patch, original); err != nil {
+		return nil, err
+	}
+	return patch, nil
+}
+
+// patchMode names how a patch describes the new file. Revision 1.0 has no flags, so there a single item holding the whole file counts as full-file too.
+func patchMode(patch *PatchFile) string {
+	items := patch.PatchItems
+	if patch.Flags&FLAG_FULL_FILE != 0 || len(items) == 1 && items[0].Offset == 0 && uint32(len(items[0].Content)) == patch.PatchedLength {
+		return PATCH_MODE_FULL_FILE
 	}
+	return PATCH_MODE_DELTA
+}
+
+// writePatchOutput writes a created patch in the requested format, with its parity trailer and checksum sidecar when needed.
+func writePatchOutput(opts *CLIOptions, patch *PatchFile, original []byte) error {
+	// Write patch to file, followed by its parity trailer when requested
+	err := writeFileAtomic(opts.outputPath, func(writer io.Writer) error {
+		if opts.parity == "" {
+			return writePatchFormat(opts.format, patch, original, writer)
+		}
 
-	// Write patch to file
-	patchFile, err := os.Create(opts.outputPath)
+		percent, err := parseParityPercent(opts.parity)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := writePatchFormat(opts.format, patch, original, &buf); err != nil {
+			return err
+		}
+		_, err = writer.Write(appendParity(buf.Bytes(), paritySymbols(percent)))
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("error creating patch file: %v", err)
+		return fmt.Errorf("error writing patch file: %w", err)
 	}
-	defer patchFile.Close()
 
-	if err := writePatchFile(patch, patchFile); err != nil {
-		return fmt.Errorf("error writing patch file: %v", err)
+	if opts.format != FORMAT_MTGADIFF {
+		if err := writeChecksumSidecar(opts.outputPath, patch); err != nil {
+			return fmt.Errorf("error writing checksum sidecar: %w", err)
+		}
 	}
 
-	flog.Info("Successfully created patch file:", opts.outputPath)
+	logging.Info("Successfully created patch file", "output", opts.outputPath)
 	return nil
 }
 
 func applyPatchFile(opts *CLIOptions) error {
+	// Read and check the patch first, so a corrupt patch fails before the original is touched
+	var patchData []byte
+	if opts.patchURL == "" {
+		data, err := readFileWithFileRead(opts.patchPath)
+		if err != nil {
+			return fmt.Errorf("error reading patch file: %w", err)
+		}
+		if data, _, _, err = repairPatchData(data); err != nil {
+			return fmt.Errorf("patch file is damaged beyond repair: %w", err)
+		}
+		if err := verifyPatchData(data); err != nil {
+			return fmt.Errorf("error verifying patch file: %w", err)
+		}
+		patchData = data
+	}
+
 	// Read original file
-	original, err := readFileWithFileRead(opts.originalPath)
+	original, release, err := readInputFile(opts.originalPath, opts.mmap)
 	if err != nil {
-		return fmt.Errorf("error reading original file: %v", err)
+		return fmt.Errorf("error reading original file: %w", err)
 	}
+	defer release()
 
-	// Read patch file
-	patchFile, err := os.Open(opts.patchPath)
+	// Served patches are MTGADIFF, verified against the server metadata and their own checksums
+	if opts.patchURL != "" {
+		return applyRemotePatch(original, opts.patchURL, opts.targetChecksum, opts.outputPath)
+	}
+
+	// Checksums for patch formats that carry none of their own
+	checksums, err := loadPatchChecksums(opts)
 	if err != nil {
-		return fmt.Errorf("error opening patch file: %v", err)
+		return fmt.Errorf("error reading patch checksums: %w", err)
 	}
-	defer patchFile.Close()
+	if opts.fuzzy {
+		return applyPatchDataFuzzy(original, patchData, opts.outputPath)
+	}
+	return applyPatchReader(original, bytes.NewReader(patchData), checksums, opts.outputPath)
+}
 
-	// Read patch data
-	readPatch, err := readPatchFile(patchFile)
+// applyPatchPath reads the patch stored at patchPath, applies it to original and writes the result to outputPath.
+func applyPatchPath(original []byte, patchPath string, checksums *PatchInfo, outputPath string) error {
+	// Read patch file
+	patchFile, err := openInput(patchPath)
 	if err != nil {
-		return fmt.Errorf("error reading patch file: %v", err)
+		return fmt.Errorf("error opening patch file: %w", err)
 	}
+	defer patchFile.Close()
 
-	// Apply patch
-	result, err := applyPatch(original, readPatch)
+	return applyPatchReader(original, patchFile, checksums, outputPath)
+}
+
+// applyPatchReader reads a patch from reader, applies it to original and writes the result to outputPath.
+func applyPatchReader(original []byte, reader io.Reader, checksums *PatchInfo, outputPath string) error {
+	result, format, err := applyPatchFormat(original, reader, checksums)
 	if err != nil {
-		return fmt.Errorf("error applying patch: %v", err)
+		return err
 	}
+	recordFiles(original, result)
+	commandResult.Format = format
 
 	// Write result to output file
-	if err := os.WriteFile(opts.outputPath, result, 0644); err != nil {
-		return fmt.Errorf("error writing output file: %v", err)
+	if err := writeBytesAtomic(outputPath, result); err != nil {
+		return fmt.Errorf("error writing output file: %w", err)
 	}
 
-	flog.Info("Successfully applied patch to:", opts.outputPath)
+	logging.Info("Successfully applied patch", "output", outputPath)
 	return nil
 }
 
@@ -257,18 +784,26 @@ Key features:
  3. Handles files of different sizes
  4. Creates patches for different sections
  5. Includes additional data if modified file is longer
+ 6. Falls back to a full-file patch when the items would take more space than the modified file
 */
 func generatePatch(original, modified []byte) (*PatchFile, error) {
 	if len(original) == 0 || len(modified) == 0 {
-		return nil, errors.New("empty input files")
+		return nil, errEmptyInput
+	}
+	if err := checkPatchLength("original", int64(len(original))); err != nil {
+		return nil, err
 	}
-	defer util.Un(util.Trace("generate patch"))
+	if err := checkPatchLength("new", int64(len(modified))); err != nil {
+		return nil, err
+	}
+	defer logging.Trace("generate patch")()
 
 	patch := &PatchFile{
 		OriginalLength:   uint32(len(original)),
 		OriginalChecksum: sha256.Sum256(original),
 		PatchedLength:    uint32(len(modified)),
 		PatchedChecksum:  sha256.Sum256(modified),
+		Flags:            DEFAULT_PATCH_FLAGS,
 		PatchItems:       []PatchItem{},
 	}
 
@@ -277,46 +812,23 @@ func generatePatch(original, modified []byte) (*PatchFile, error) {
 		return patch, nil
 	}
 
-	minLength := helper.MinInt(len(original), len(modified)) //int(math.Min(float64(len(original)), float64(len(modified))))
-	var currentData []byte
-	diffOffsetStart := 0
-
-	// Compare byte by byte up to the minimum length
-	for i := 0; i < minLength; i++ {
-		//fmt.Printf("\rOn Generating patch file: %d/%d (\"Max\" is estimation)", i, minLength)
-
-		if original[i] != modified[i] {
-			if len(currentData) == 0 {
-				diffOffsetStart = i
-			}
-			currentData = append(currentData, modified[i])
-		} else {
-			if len(currentData) > 0 {
-				patch.PatchItems = append(patch.PatchItems, PatchItem{
-					Offset:  uint32(diffOffsetStart),
-					Content: currentData,
-				})
-				currentData = nil
-			}
+	// Every differing run becomes an item; a region past the end of the modified file is a truncation, which the lengths already describe
+	for _, region := range diffRegions(original, modified) {
+		if region.Offset >= len(modified) {
+			continue
 		}
-	}
-
-	// Add any remaining diff data
-	if len(currentData) > 0 {
+		end := helper.MinInt(region.Offset+region.Length, len(modified))
 		patch.PatchItems = append(patch.PatchItems, PatchItem{
-			Offset:  uint32(diffOffsetStart),
-			Content: currentData,
+			Offset:  uint32(region.Offset),
+			Content: append([]byte(nil), modified[region.Offset:end]...),
 		})
 	}
 
-	// Handle case where patched file is longer
-	if len(modified) > len(original) {
-		extraData := make([]byte, len(modified)-len(original))
-		copy(extraData, modified[len(original):])
-		patch.PatchItems = append(patch.PatchItems, PatchItem{
-			Offset:  uint32(len(original)),
-			Content: extraData,
-		})
+	// A heavily rewritten file is smaller sent whole than as a delta
+	fullFile := PatchItem{Offset: 0, Content: append([]byte(nil), modified...)}
+	if encodedItemsSize(patch.PatchItems, patch.Flags) > encodedItemsSize([]PatchItem{fullFile}, patch.Flags) {
+		patch.PatchItems = []PatchItem{fullFile}
+		patch.Flags |= FLAG_FULL_FILE
 	}
 
 	return patch, nil
@@ -327,21 +839,60 @@ Writes a patch to a file in the specified format.
 Writing sequence:
 
  1. Magic identifier
- 2. Version information
+ 2. Version information, followed by the flags for revision 1.1
  3. Original file metadata
  4. Patched file metadata
  5. Number of patch items
- 6. Individual patch items
+ 6. Individual patch items, each followed by its CRC32 when FLAG_ITEM_CRC32 is set
+ 7. SHA-256 of everything above when FLAG_PATCH_CHECKSUM is set
 */
 func writePatchFile(patch *PatchFile, writer io.Writer) error {
+	// Everything up to the trailer is hashed on the way out
+	out := writer
+	hasher := sha256.New()
+	writer = io.MultiWriter(out, hasher)
+
 	// Write magic identifier
 	if _, err := writer.Write([]byte(IDENTIFIER)); err != nil {
 		return err
 	}
-	defer util.Un(util.Trace("Write patch file"))
+	defer logging.Trace("Write patch file")()
+
+	// Write version, file info and item count
+	if err := writePatchHeader(writer, patch, uint32(len(patch.PatchItems))); err != nil {
+		return err
+	}
+
+	// Write patch items
+	for _, item := range patch.PatchItems {
+		//fmt.Printf("\rOn Writing patch file: %d/%d", i, len(patch.PatchItems)+1)
+
+		if err := writePatchItem(writer, item, patch.Flags); err != nil {
+			return err
+		}
+	}
+
+	// Write signatures
+	if patch.Flags&FLAG_SIGNATURES != 0 {
+		if err := writeSignatures(writer, patch.Signatures); err != nil {
+			return err
+		}
+	}
+
+	// Write whole-patch checksum
+	if patch.Flags&FLAG_PATCH_CHECKSUM != 0 {
+		if _, err := out.Write(hasher.Sum(nil)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
+// writePatchHeader writes the version, original and patched file info and item count that follow the magic identifier.
+func writePatchHeader(writer io.Writer, patch *PatchFile, itemCount uint32) error {
 	// Write version
-	if _, err := writer.Write([]byte{VERSION_MAJOR, VERSION_MINOR}); err != nil {
+	if err := writePatchVersion(writer, patch.Flags); err != nil {
 		return err
 	}
 
@@ -362,72 +913,109 @@ func writePatchFile(patch *PatchFile, writer io.Writer) error {
 	}
 
 	// Write patch items count
-	itemCount := uint32(len(patch.PatchItems))
-	if err := binary.Write(writer, binary.BigEndian, itemCount); err != nil {
+	return binary.Write(writer, binary.BigEndian, itemCount)
+}
+
+// writePatchVersion writes revision 1.0 for patches without flags and revision 1.1 followed by the flags otherwise.
+func writePatchVersion(writer io.Writer, flags uint32) error {
+	if flags == 0 {
+		_, err := writer.Write([]byte{VERSION_MAJOR, VERSION_MINOR})
 		return err
 	}
 
-	// Write patch items
-	for _, item := range patch.PatchItems {
-		//fmt.Printf("\rOn Writing patch file: %d/%d", i, len(patch.PatchItems)+1)
+	if _, err := writer.Write([]byte{VERSION_MAJOR, VERSION_MINOR_FLAGS}); err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.BigEndian, flags)
+}
 
-		if err := binary.Write(writer, binary.BigEndian, item.Offset); err != nil {
-			return err
-		}
-		if err := binary.Write(writer, binary.BigEndian, uint32(len(item.Content))); err != nil {
-			return err
+// writePatchItem writes an item with the context and CRC32 its patch flags call for.
+func writePatchItem(writer io.Writer, item PatchItem, flags uint32) error {
+	if err := binary.Write(writer, binary.BigEndian, item.Offset); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.BigEndian, uint32(len(item.Content))); err != nil {
+		return err
+	}
+	if _, err := writer.Write(item.Content); err != nil {
+		return err
+	}
+
+	if flags&FLAG_CONTEXT != 0 {
+		for _, context := range [][]byte{item.ContextBefore, item.ContextAfter} {
+			if err := binary.Write(writer, binary.BigEndian, uint32(len(context))); err != nil {
+				return err
+			}
+			if _, err := writer.Write(context); err != nil {
+				return err
+			}
 		}
-		if _, err := writer.Write(item.Content); err != nil {
+	}
+
+	if flags&FLAG_ITEM_CRC32 != 0 {
+		if err := binary.Write(writer, binary.BigEndian, itemCRC32(item, flags)); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
-func writePatchFilev2(patch *PatchFile, bufWriter *bufio.Writer) error {
-	// Write magic identifier
-	if _, err := bufWriter.Write([]byte(IDENTIFIER)); err != nil {
-		return err
+// encodedItemsSize is the number of bytes writePatchItem writes for items under flags.
+func encodedItemsSize(items []PatchItem, flags uint32) int {
+	var counter byteCounter
+	for _, item := range items {
+		writePatchItem(&counter, item, flags)
 	}
-	defer util.Un(util.Trace("write patch file v2"))
+	return int(counter)
+}
 
-	// Write version
-	if _, err := bufWriter.Write([]byte{VERSION_MAJOR, VERSION_MINOR}); err != nil {
-		return err
-	}
+// itemCRC32 is the checksum stored after a patch item, covering every field written before it.
+func itemCRC32(item PatchItem, flags uint32) uint32 {
+	crc := crc32.ChecksumIEEE(binary.BigEndian.AppendUint32(nil, item.Offset))
+	crc = crc32.Update(crc, crc32.IEEETable, binary.BigEndian.AppendUint32(nil, uint32(len(item.Content))))
+	crc = crc32.Update(crc, crc32.IEEETable, item.Content)
 
-	// Write original file info
-	if err := binary.Write(bufWriter, binary.BigEndian, patch.OriginalLength); err != nil {
-		return err
-	}
-	if _, err := bufWriter.Write(patch.OriginalChecksum[:]); err != nil {
-		return err
+	if flags&FLAG_CONTEXT != 0 {
+		for _, context := range [][]byte{item.ContextBefore, item.ContextAfter} {
+			crc = crc32.Update(crc, crc32.IEEETable, binary.BigEndian.AppendUint32(nil, uint32(len(context))))
+			crc = crc32.Update(crc, crc32.IEEETable, context)
+		}
 	}
+	return crc
+}
 
-	// Write patched file info
-	if err := binary.Write(bufWriter, binary.BigEndian, patch.PatchedLength); err != nil {
-		return err
-	}
-	if _, err := bufWriter.Write(patch.PatchedChecksum[:]); err != nil {
+func writePatchFilev2(patch *PatchFile, bufWriter *bufio.Writer) error {
+	hasher := sha256.New()
+	writer := io.MultiWriter(bufWriter, hasher)
+
+	// Write magic identifier
+	if _, err := writer.Write([]byte(IDENTIFIER)); err != nil {
 		return err
 	}
+	defer logging.Trace("write patch file v2")()
 
-	// Write patch items count
-	itemCount := uint32(len(patch.PatchItems))
-	if err := binary.Write(bufWriter, binary.BigEndian, itemCount); err != nil {
+	// Write version, file info and item count
+	if err := writePatchHeader(writer, patch, uint32(len(patch.PatchItems))); err != nil {
 		return err
 	}
 
 	// Write patch items
 	for _, item := range patch.PatchItems {
-		if err := binary.Write(bufWriter, binary.BigEndian, item.Offset); err != nil {
+		if err := writePatchItem(writer, item, patch.Flags); err != nil {
 			return err
 		}
-		if err := binary.Write(bufWriter, binary.BigEndian, uint32(len(item.Content))); err != nil {
+	}
+
+	// Write signatures
+	if patch.Flags&FLAG_SIGNATURES != 0 {
+		if err := writeSignatures(writer, patch.Signatures); err != nil {
 			return err
 		}
-		if _, err := bufWriter.Write(item.Content); err != nil {
+	}
+
+	// Write whole-patch checksum
+	if patch.Flags&FLAG_PATCH_CHECKSUM != 0 {
+		if _, err := bufWriter.Write(hasher.Sum(nil)); err != nil {
 			return err
 		}
 	}
@@ -451,142 +1039,149 @@ Validation steps:
 
 - 	3. Reads file metadata
 
-- 	4. Loads patch items
-*/
-func readPatchFile(reader io.Reader) (*PatchFile, error) {
-	defer util.Un(util.Trace("Read patch file"))
+- 	4. Loads patch items, verifying their CRC32 when FLAG_ITEM_CRC32 is set
 
-	// Read and verify magic identifier
-	magic := make([]byte, len(IDENTIFIER))
-	if _, err := reader.Read(magic); err != nil {
-		return nil, err
-	}
-	if string(magic) != IDENTIFIER {
-		return nil, errors.New("invalid patch file format")
-	}
-
-	// Read and verify version
-	version := make([]byte, 2)
-	if _, err := reader.Read(version); err != nil {
-		return nil, err
-	}
-	if version[0] != VERSION_MAJOR || version[1] != VERSION_MINOR {
-		return nil, errors.New("unsupported patch version")
-	}
+- 	5. Verifies the whole-patch checksum when FLAG_PATCH_CHECKSUM is set
 
-	patch := &PatchFile{}
+Damage covered by a parity trailer is repaired before parsing when the
+reader can seek, as files and in-memory patches can.
+*/
+func readPatchFile(reader io.Reader) (*PatchFile, error) {
+	defer logging.Trace("Read patch file")()
 
-	// Read original file info
-	if err := binary.Read(reader, binary.BigEndian, &patch.OriginalLength); err != nil {
-		return nil, err
-	}
-	if _, err := reader.Read(patch.OriginalChecksum[:]); err != nil {
+	reader, err := readRepairedPatch(reader)
+	if err != nil {
 		return nil, err
 	}
 
-	// Read patched file info
-	if err := binary.Read(reader, binary.BigEndian, &patch.PatchedLength); err != nil {
-		return nil, err
-	}
-	if _, err := reader.Read(patch.PatchedChecksum[:]); err != nil {
-		return nil, err
-	}
+	// Everything up to the trailer is hashed on the way in
+	hasher := sha256.New()
+	hashed := io.TeeReader(reader, hasher)
 
-	// Read patch items
-	var itemCount uint32
-	if err := binary.Read(reader, binary.BigEndian, &itemCount); err != nil {
+	patch, itemCount, err := readPatchHeader(hashed)
+	if err != nil {
 		return nil, err
 	}
 
-	patch.PatchItems = make([]PatchItem, itemCount)
+	// The count is untrusted, so the slice grows with the items actually read
+	patch.PatchItems = make([]PatchItem, 0, min(itemCount, MAX_PREALLOC_ITEMS))
 	for i := uint32(0); i < itemCount; i++ {
 		//fmt.Printf("\rOn Reading patch file: %d/%d", i, itemCount)
 
-		var offset, length uint32
-		if err := binary.Read(reader, binary.BigEndian, &offset); err != nil {
-			return nil, err
-		}
-		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		item, err := readPatchItem(hashed, patch.Flags, i)
+		if err != nil {
 			return nil, err
 		}
+		patch.PatchItems = append(patch.PatchItems, item)
+	}
 
-		content := make([]byte, length)
-		if _, err := reader.Read(content); err != nil {
+	if patch.Flags&FLAG_SIGNATURES != 0 {
+		if patch.Signatures, err = readSignatures(hashed); err != nil {
 			return nil, err
 		}
+	}
 
-		patch.PatchItems[i] = PatchItem{
-			Offset:  offset,
-			Content: content,
+	if patch.Flags&FLAG_PATCH_CHECKSUM != 0 {
+		if err := verifyPatchChecksum(reader, hasher.Sum(nil)); err != nil {
+			return nil, err
 		}
 	}
 
 	return patch, nil
 }
 
-func readPatchFilev2(bufReader *bufio.Reader) (*PatchFile, error) {
-	defer util.Un(util.Trace("Read patch file v2"))
+/*
+Reads and validates only the header of a patch file, stopping before the patch items.
 
+Returns the patch with its length and checksum fields filled in (PatchItems left nil)
+together with the number of items that follow the header in the reader.
+*/
+func readPatchHeader(reader io.Reader) (*PatchFile, uint32, error) {
 	// Read and verify magic identifier
 	magic := make([]byte, len(IDENTIFIER))
-	if _, err := io.ReadFull(bufReader, magic); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, 0, err
 	}
 	if string(magic) != IDENTIFIER {
-		return nil, errors.New("invalid patch file format")
+		return nil, 0, fmt.Errorf("%w: invalid patch file format", errCorruptPatch)
 	}
 
 	// Read and verify version
 	version := make([]byte, 2)
-	if _, err := io.ReadFull(bufReader, version); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(reader, version); err != nil {
+		return nil, 0, err
 	}
-	if version[0] != VERSION_MAJOR || version[1] != VERSION_MINOR {
-		return nil, errors.New("unsupported patch version")
+	if version[0] != VERSION_MAJOR || (version[1] != VERSION_MINOR && version[1] != VERSION_MINOR_FLAGS) {
+		return nil, 0, errVersionMismatch
 	}
 
 	patch := &PatchFile{}
 
+	// Read flags
+	if version[1] == VERSION_MINOR_FLAGS {
+		if err := binary.Read(reader, binary.BigEndian, &patch.Flags); err != nil {
+			return nil, 0, err
+		}
+		if patch.Flags&^KNOWN_PATCH_FLAGS != 0 {
+			return nil, 0, fmt.Errorf("%w: unknown flags %#x", errVersionMismatch, patch.Flags)
+		}
+	}
+
 	// Read original file info
-	if err := binary.Read(bufReader, binary.BigEndian, &patch.OriginalLength); err != nil {
-		return nil, err
+	if err := binary.Read(reader, binary.BigEndian, &patch.OriginalLength); err != nil {
+		return nil, 0, err
 	}
-	if _, err := io.ReadFull(bufReader, patch.OriginalChecksum[:]); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(reader, patch.OriginalChecksum[:]); err != nil {
+		return nil, 0, err
 	}
 
 	// Read patched file info
-	if err := binary.Read(bufReader, binary.BigEndian, &patch.PatchedLength); err != nil {
-		return nil, err
+	if err := binary.Read(reader, binary.BigEndian, &patch.PatchedLength); err != nil {
+		return nil, 0, err
 	}
-	if _, err := io.ReadFull(bufReader, patch.PatchedChecksum[:]); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(reader, patch.PatchedChecksum[:]); err != nil {
+		return nil, 0, err
 	}
 
-	// Read patch items
+	// Read patch items count
 	var itemCount uint32
-	if err := binary.Read(bufReader, binary.BigEndian, &itemCount); err != nil {
+	if err := binary.Read(reader, binary.BigEndian, &itemCount); err != nil {
+		return nil, 0, err
+	}
+
+	return patch, itemCount, nil
+}
+
+func readPatchFilev2(bufReader *bufio.Reader) (*PatchFile, error) {
+	defer logging.Trace("Read patch file v2")()
+
+	// A buffered reader cannot seek to look for a parity trailer, use readPatchFile to repair damage
+	hasher := sha256.New()
+	hashed := io.TeeReader(bufReader, hasher)
+
+	patch, itemCount, err := readPatchHeader(hashed)
+	if err != nil {
 		return nil, err
 	}
 
-	patch.PatchItems = make([]PatchItem, itemCount)
+	patch.PatchItems = make([]PatchItem, 0, min(itemCount, MAX_PREALLOC_ITEMS))
 	for i := uint32(0); i < itemCount; i++ {
-		var offset, length uint32
-		if err := binary.Read(bufReader, binary.BigEndian, &offset); err != nil {
-			return nil, err
-		}
-		if err := binary.Read(bufReader, binary.BigEndian, &length); err != nil {
+		item, err := readPatchItem(hashed, patch.Flags, i)
+		if err != nil {
 			return nil, err
 		}
+		patch.PatchItems = append(patch.PatchItems, item)
+	}
 
-		content := make([]byte, length)
-		if _, err := io.ReadFull(bufReader, content); err != nil {
+	if patch.Flags&FLAG_SIGNATURES != 0 {
+		if patch.Signatures, err = readSignatures(hashed); err != nil {
 			return nil, err
 		}
+	}
 
-		patch.PatchItems[i] = PatchItem{
-			Offset:  offset,
-			Content: content,
+	if patch.Flags&FLAG_PATCH_CHECKSUM != 0 {
+		if err := verifyPatchChecksum(bufReader, hasher.Sum(nil)); err != nil {
+			return nil, err
 		}
 	}
 
@@ -594,196 +1189,254 @@ func readPatchFilev2(bufReader *bufio.Reader) (*PatchFile, error) {
 }
 
 /*
-# Applies a patch to an original file to create the modified version.
+Repairs a patch that carries a parity trailer.
 
-Safety features:
-  - Validates original file length
-  - Verifies original file checksum
-  - Ensures correct patched file length
-  - Validates final checksum
-  - Handles dynamic buffer resizing
+Only seekable input is checked for the trailer magic at its end, and only a
+patch that has one is read whole; anything else is passed through unchanged
+so it can be parsed as it streams in.
 */
-func applyPatch(original []byte, patch *PatchFile) ([]byte, error) {
-	defer util.Un(util.Trace("apply patch"))
-
-	// Verify original file
-	if uint32(len(original)) != patch.OriginalLength {
-		return nil, errors.New("original file length mismatch")
+func readRepairedPatch(reader io.Reader) (io.Reader, error) {
+	seeker, ok := reader.(io.ReadSeeker)
+	if !ok {
+		return reader, nil
 	}
-	if actualChecksum := sha256.Sum256(original); actualChecksum != patch.OriginalChecksum {
-		return nil, errors.New("original file checksum mismatch")
+	// Files that cannot seek, like pipes, fail here
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return reader, nil
 	}
-
-	// Create modified file buffer
-	modified := make([]byte, patch.PatchedLength)
-	if len(original) < len(modified) {
-		copy(modified, original)
-	} else {
-		copy(modified, original[:len(modified)])
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
 	}
 
-	// Apply patches
-	for _, item := range patch.PatchItems {
-		//fmt.Printf("\rOn Patching File: %d/%d", i, len(patch.PatchItems)+1)
-
-		num := int(item.Offset + uint32(len(item.Content)))
-		if num > len(modified) {
-			modified = append(modified, make([]byte, num-len(modified))...)
+	magic := make([]byte, len(PARITY_MAGIC))
+	if end-start >= int64(PARITY_FOOTER_SIZE) {
+		if _, err := seeker.Seek(end-int64(len(magic)), io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(seeker, magic); err != nil {
+			return nil, err
 		}
-		copy(modified[item.Offset:], item.Content)
 	}
-
-	// Verify result
-	if uint32(len(modified)) != patch.PatchedLength {
-		flog.Info(uint32(len(modified)), patch.PatchedLength)
-		return nil, errors.New("patched file length mismatch")
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return nil, err
 	}
-	if actualChecksum := sha256.Sum256(modified); actualChecksum != patch.PatchedChecksum {
-		return nil, errors.New("patched file checksum mismatch")
+	if string(magic) != PARITY_MAGIC {
+		return reader, nil
 	}
 
-	return modified, nil
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if data, _, _, err = repairPatchData(data); err != nil {
+		return nil, fmt.Errorf("patch file is damaged beyond repair: %w", err)
+	}
+	return bytes.NewReader(data), nil
 }
 
-func runv2() error {
-	defer util.Un(util.Trace("run v2"))
+// readPatchItem reads the item at index, checking its CRC32 when the patch carries them.
+func readPatchItem(reader io.Reader, flags uint32, index uint32) (PatchItem, error) {
+	var offset, length uint32
+	if err := binary.Read(reader, binary.BigEndian, &offset); err != nil {
+		return PatchItem{}, err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return PatchItem{}, err
+	}
 
-	original, modified, err := readv2()
+	content, err := readItemContent(reader, length)
 	if err != nil {
-		return fmt.Errorf("readv2: %v", err)
+		return PatchItem{}, err
 	}
+	item := PatchItem{Offset: offset, Content: content}
 
-	patch, err := generatePatch(original, modified)
-	if err != nil {
-		return fmt.Errorf("error generating patch: %w", err)
+	if flags&FLAG_CONTEXT != 0 {
+		for _, context := range []*[]byte{&item.ContextBefore, &item.ContextAfter} {
+			var contextLength uint32
+			if err := binary.Read(reader, binary.BigEndian, &contextLength); err != nil {
+				return PatchItem{}, err
+			}
+			if *context, err = readItemContent(reader, contextLength); err != nil {
+				return PatchItem{}, err
+			}
+		}
 	}
 
-	// Write patch to file
-	patchFile, err := os.Create("patchv2.mtgadiff")
-	if err != nil {
-		return fmt.Errorf("error creating patch file: %v", err)
+	if flags&FLAG_ITEM_CRC32 != 0 {
+		var crc uint32
+		if err := binary.Read(reader, binary.BigEndian, &crc); err != nil {
+			return PatchItem{}, err
+		}
+		if crc != itemCRC32(item, flags) {
+			return PatchItem{}, fmt.Errorf("%w: patch item %d (offset %d, %d bytes) fails its CRC32 check", errCorruptPatch, index, offset, length)
+		}
 	}
-	defer patchFile.Close()
 
-	// Wrap the file with bufio.Writer
-	bufWriter := bufio.NewWriter(patchFile)
+	return item, nil
+}
 
-	if err := writePatchFilev2(patch, bufWriter); err != nil {
-		return fmt.Errorf("error writing patch file: %v", err)
+// verifyPatchChecksum reads the whole-patch checksum trailer and compares it with the hash of what preceded it.
+func verifyPatchChecksum(reader io.Reader, computed []byte) error {
+	stored := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(reader, stored); err != nil {
+		return fmt.Errorf("error reading patch checksum: %w", err)
 	}
-
-	// Read patch from file
-	var bufReader *bufio.Reader
-	if patchFile, err := os.Open("patchv2.mtgadiff"); err != nil {
-		return fmt.Errorf("error opening patch file: %v", err)
-	} else {
-		bufReader = bufio.NewReader(patchFile)
+	if !bytes.Equal(stored, computed) {
+		return fmt.Errorf("%w: patch file checksum mismatch", errCorruptPatch)
 	}
+	return nil
+}
 
-	readPatch, err := readPatchFilev2(bufReader)
-	if err != nil {
-		return fmt.Errorf("error reading patch", err)
-	}
+/*
+Checks the whole-patch checksum of a serialized patch without decoding its items.
 
-	// Apply patch
-	result, err := applyPatch(original, readPatch)
-	if err != nil {
-		return fmt.Errorf("error applying patch: %v", err)
+Used to reject a corrupt patch before the file it applies to is even read.
+Patches in other formats, or without FLAG_PATCH_CHECKSUM, pass unchecked.
+*/
+func verifyPatchData(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(IDENTIFIER)) {
+		return nil
 	}
 
-	flog.Info("Patch successful:", bytes.Equal(modified, result))
-	if err := os.WriteFile("outputv2.dll", result, 0644); err != nil {
+	patch, _, err := readPatchHeader(bytes.NewReader(data))
+	if err != nil {
 		return err
 	}
+	if patch.Flags&FLAG_PATCH_CHECKSUM == 0 {
+		return nil
+	}
+	if len(data) < sha256.Size {
+		return io.ErrUnexpectedEOF
+	}
 
-	return nil
+	body := data[:len(data)-sha256.Size]
+	computed := sha256.Sum256(body)
+	return verifyPatchChecksum(bytes.NewReader(data[len(body):]), computed[:])
 }
 
-func run() error {
-	defer util.Un(util.Trace("run"))
+/*
+Reads the content of a patch item.
 
-	original, modified, err := readv1()
-	if err != nil {
-		return fmt.Errorf("readv1: %v", err)
+Lengths come straight from the patch file, so large contents are read in
+growing chunks instead of being allocated up front: a corrupt length then
+ends in io.ErrUnexpectedEOF rather than a multi-gigabyte allocation.
+*/
+func readItemContent(reader io.Reader, length uint32) ([]byte, error) {
+	if length <= MAX_PREALLOC_CONTENT {
+		content := make([]byte, length)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return nil, err
+		}
+		return content, nil
 	}
 
-	// Generate patch
-	patch, err := generatePatch(original, modified)
-	if err != nil {
-		return fmt.Errorf("error generating patch: %w", err)
+	var content bytes.Buffer
+	content.Grow(MAX_PREALLOC_CONTENT)
+	if _, err := io.CopyN(&content, reader, int64(length)); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
 	}
+	return content.Bytes(), nil
+}
 
-	// Write patch to file
-	patchFile, err := os.Create("patch.mtgadiff")
-	if err != nil {
-		return fmt.Errorf("error creating patch file: %v", err)
-	}
-	defer patchFile.Close()
+/*
+# Applies a patch to an original file to create the modified version.
 
-	if err := writePatchFile(patch, patchFile); err != nil {
-		return fmt.Errorf("error writing patch file: %v", err)
-	}
+Safety features:
+  - Validates original file length
+  - Verifies original file checksum
+  - Ensures correct patched file length
+  - Validates final checksum
+  - Rejects patch items reaching past the patched file length
+  - Applies signature rules after the items, before the final checksum
 
-	//Read patch from file
-	patchFile, err = os.Open("patch.mtgadiff")
-	if err != nil {
-		return fmt.Errorf("error opening patch file: %v", err)
+Signature-only patches carry no checksums and apply to any original their rules match.
+*/
+func applyPatch(original []byte, patch *PatchFile) ([]byte, error) {
+	defer logging.Trace("apply patch")()
+
+	// Signature-only patches carry no checksums, so neither file can be verified
+	if isSignatureOnly(patch) {
+		modified := append([]byte{}, original...)
+		if err := applySignatures(modified, patch.Signatures); err != nil {
+			return nil, err
+		}
+		logging.Warn("Signature-only patch applied without length or checksum verification", "signatures", len(patch.Signatures))
+		recordDetails(map[string]any{"verified": false})
+		return modified, nil
 	}
 
-	//patchFile.Seek(0, 0)
-	readPatch, err := readPatchFile(patchFile)
-	if err != nil {
-		return fmt.Errorf("error reading patch file: %v", err)
+	// Verify original file
+	if uint32(len(original)) != patch.OriginalLength {
+		return nil, fmt.Errorf("original file %w", errLengthMismatch)
+	}
+	if actualChecksum := sha256.Sum256(original); actualChecksum != patch.OriginalChecksum {
+		return nil, fmt.Errorf("original file %w", errChecksumMismatch)
 	}
 
-	// Apply patch
-	result, err := applyPatch(original, readPatch)
-	if err != nil {
-		return fmt.Errorf("Error applying patch: %v", err)
+	// A full-file patch carries the patched file as it is
+	if patch.Flags&FLAG_FULL_FILE != 0 {
+		if len(patch.PatchItems) != 1 || patch.PatchItems[0].Offset != 0 || uint32(len(patch.PatchItems[0].Content)) != patch.PatchedLength {
+			return nil, fmt.Errorf("%w: a full-file patch holds the whole patched file as its only item", errCorruptPatch)
+		}
 	}
 
-	flog.Info("Patch successful:", bytes.Equal(modified, result))
-	if err := os.WriteFile("output.dll", result, 0644); err != nil {
-		return err
+	// Create modified file buffer
+	modified := make([]byte, patch.PatchedLength)
+	if patch.Flags&FLAG_FULL_FILE == 0 {
+		if len(original) < len(modified) {
+			copy(modified, original)
+		} else {
+			copy(modified, original[:len(modified)])
+		}
 	}
-	return nil
-}
 
-func readv1() ([]byte, []byte, error) {
-	defer util.Un(util.Trace("ready1"))
+	// Apply patches
+	for _, item := range patch.PatchItems {
+		//fmt.Printf("\rOn Patching File: %d/%d", i, len(patch.PatchItems)+1)
 
-	original, err := os.ReadFile("Assembly-CSharp.dll.spt")
-	if err != nil {
-		return nil, nil, err
-	}
-	modified, err := os.ReadFile("Assembly-CSharp.dll")
-	if err != nil {
-		return nil, nil, err
+		if uint64(item.Offset)+uint64(len(item.Content)) > uint64(len(modified)) {
+			return nil, errors.New("patch item exceeds patched file length")
+		}
+		copy(modified[item.Offset:], item.Content)
 	}
-	return original, modified, nil
-}
 
-func readv2() ([]byte, []byte, error) {
-	defer util.Un(util.Trace("ready2"))
+	// Apply signatures
+	if patch.Flags&FLAG_SIGNATURES != 0 {
+		if err := applySignatures(modified, patch.Signatures); err != nil {
+			return nil, err
+		}
+	}
 
-	original, err := readFileWithFileRead("Assembly-CSharp.dll.spt")
-	if err != nil {
-		return nil, nil, err
+	// Verify result
+	if uint32(len(modified)) != patch.PatchedLength {
+		logging.Debug("Patched length mismatch", "length", len(modified), "expected", patch.PatchedLength)
+		return nil, fmt.Errorf("patched file %w", errLengthMismatch)
 	}
-	modified, err := readFileWithFileRead("Assembly-CSharp.dll")
-	if err != nil {
-		return nil, nil, err
+	if actualChecksum := sha256.Sum256(modified); actualChecksum != patch.PatchedChecksum {
+		return nil, fmt.Errorf("patched file %w", errChecksumMismatch)
 	}
 
-	return original, modified, nil
+	return modified, nil
 }
 
 func main() {
-	defer util.Un(util.Trace("main"))
+	started := time.Now()
 
 	opts, err := parseFlags()
+	if err == nil {
+		err = logging.Setup(os.Stderr, opts.quiet, opts.verbose, opts.logFormat)
+	}
 	if err != nil {
-		flog.Error("Error parsing arguments:", err)
+		logging.Error("Error parsing arguments", "error", err)
+		if opts != nil && opts.json {
+			commandResult.Error = &ResultError{Code: ERR_INVALID_ARGUMENTS}
+			stdout.Write(finishResult(opts, started, err))
+		}
 		os.Exit(1)
 	}
 
@@ -793,10 +1446,41 @@ func main() {
 		opErr = createPatch(opts)
 	case MODE_PATCH:
 		opErr = applyPatchFile(opts)
+	case MODE_AUTO:
+		opErr = autoPatch(opts)
+	case MODE_UPGRADE:
+		opErr = upgradePatch(opts)
+	case MODE_SERVE:
+		opErr = servePatches(opts)
+	case MODE_FETCH:
+		opErr = fetchPatchFile(opts)
+	case MODE_CONVERT:
+		opErr = convertPatchFile(opts)
+	case MODE_APPLY:
+		opErr = applyTransaction(opts)
+	case MODE_SELFTEST:
+		opErr = selfTest(opts)
+	case MODE_BENCH:
+		opErr = benchPatch(opts)
+	case MODE_REBASE:
+		opErr = rebasePatchFile(opts)
+	case MODE_REPAIR:
+		opErr = repairPatchFile(opts)
+	case MODE_BUILD:
+		opErr = buildPatches(opts)
+	case MODE_DIFF:
+		opErr = diffFiles(opts)
+	case MODE_REPORT:
+		opErr = reportPatchFile(opts)
+	case MODE_STATS:
+		opErr = patchStats(opts)
+	}
+
+	if opts.json {
+		stdout.Write(finishResult(opts, started, opErr))
 	}
-
 	if opErr != nil {
-		flog.Error("Operation failed:", opErr)
+		logging.Error("Operation failed", "error", opErr)
 		os.Exit(1)
 	}
 }
@@ -804,7 +1488,12 @@ func main() {
 //const BUFFERSIZE int = 256 * 1024
 
 func readFileWithFileRead(filePath string) ([]byte, error) {
-	defer util.Un(util.Trace("readFileWithFileRead"))
+	defer logging.Trace("readFileWithFileRead")()
+
+	// Standard input has no size, read it to the end
+	if filePath == STDIO_PATH {
+		return io.ReadAll(os.Stdin)
+	}
 
 	// Open the file
 	file, err := os.Open(filePath)
@@ -819,6 +1508,11 @@ func readFileWithFileRead(filePath string) ([]byte, error) {
 		return nil, err
 	}
 
+	// Pipes, sockets and devices report no useful size
+	if !stat.Mode().IsRegular() {
+		return io.ReadAll(file)
+	}
+
 	// Create a byte array the size of the file
 	content := make([]byte, stat.Size())
 
@@ -829,3 +1523,11 @@ func readFileWithFileRead(filePath string) ([]byte, error) {
 
 	return content, nil
 }
+
+// openInput opens filePath for reading, or returns stdin for STDIO_PATH.
+func openInput(filePath string) (io.ReadCloser, error) {
+	if filePath == STDIO_PATH {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(filePath)
+}
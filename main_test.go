@@ -0,0 +1,2099 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// patchCase is an original/modified pair the patch engine must round-trip.
+type patchCase struct {
+	name     string
+	original []byte
+	modified []byte
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	r.Read(data)
+	return data
+}
+
+// mutate returns a copy of data with a few random bytes changed.
+func mutate(r *rand.Rand, data []byte, changes int) []byte {
+	modified := append([]byte{}, data...)
+	for i := 0; i < changes; i++ {
+		modified[r.Intn(len(modified))] = byte(r.Intn(256))
+	}
+	return modified
+}
+
+// patchCases builds round-trip inputs covering growth, shrinkage, identical and single-byte files.
+func patchCases(r *rand.Rand) []patchCase {
+	base := randomBytes(r, 4096)
+
+	cases := []patchCase{
+		{"identical", base, append([]byte{}, base...)},
+		{"single byte", []byte{0x01}, []byte{0x02}},
+		{"single byte identical", []byte{0x7F}, []byte{0x7F}},
+		{"single byte to many", []byte{0x01}, randomBytes(r, 100)},
+		{"many to single byte", randomBytes(r, 100), []byte{0x01}},
+		{"scattered changes", base, mutate(r, base, 50)},
+		{"growth", base, append(mutate(r, base, 10), randomBytes(r, 1000)...)},
+		{"shrinkage", base, mutate(r, base, 10)[:2000]},
+		{"completely different", base, randomBytes(r, len(base))},
+		{"first and last byte", base, func() []byte {
+			modified := append([]byte{}, base...)
+			modified[0] ^= 0xFF
+			modified[len(modified)-1] ^= 0xFF
+			return modified
+		}()},
+	}
+
+	for i := 0; i < 50; i++ {
+		original := randomBytes(r, 1+r.Intn(2048))
+		modified := mutate(r, original, r.Intn(20))
+		switch r.Intn(3) {
+		case 0:
+			modified = append(modified, randomBytes(r, r.Intn(512))...)
+		case 1:
+			modified = modified[:1+r.Intn(len(modified))]
+		}
+		cases = append(cases, patchCase{"random", original, modified})
+	}
+
+	return cases
+}
+
+func TestApplyGeneratedPatch(t *testing.T) {
+	for _, c := range patchCases(rand.New(rand.NewSource(1))) {
+		patch, err := generatePatch(c.original, c.modified)
+		if err != nil {
+			t.Fatalf("%s: generatePatch: %v", c.name, err)
+		}
+
+		result, err := applyPatch(c.original, patch)
+		if err != nil {
+			t.Fatalf("%s: applyPatch: %v", c.name, err)
+		}
+		if !bytes.Equal(result, c.modified) {
+			t.Fatalf("%s: patched file differs from modified file", c.name)
+		}
+	}
+}
+
+func TestPatchFileRoundTrip(t *testing.T) {
+	for _, c := range patchCases(rand.New(rand.NewSource(2))) {
+		patch, err := generatePatch(c.original, c.modified)
+		if err != nil {
+			t.Fatalf("%s: generatePatch: %v", c.name, err)
+		}
+
+		// v1 writer, v1 reader
+		var buf bytes.Buffer
+		if err := writePatchFile(patch, &buf); err != nil {
+			t.Fatalf("%s: writePatchFile: %v", c.name, err)
+		}
+		serialized := buf.Bytes()
+
+		readPatch, err := readPatchFile(bytes.NewReader(serialized))
+		if err != nil {
+			t.Fatalf("%s: readPatchFile: %v", c.name, err)
+		}
+		if result, err := applyPatch(c.original, readPatch); err != nil || !bytes.Equal(result, c.modified) {
+			t.Fatalf("%s: v1 round trip failed: %v", c.name, err)
+		}
+
+		// v2 writer must produce the same bytes, v2 reader the same patch
+		var bufv2 bytes.Buffer
+		if err := writePatchFilev2(patch, bufio.NewWriter(&bufv2)); err != nil {
+			t.Fatalf("%s: writePatchFilev2: %v", c.name, err)
+		}
+		if !bytes.Equal(bufv2.Bytes(), serialized) {
+			t.Fatalf("%s: v1 and v2 writers disagree", c.name)
+		}
+
+		readPatchv2, err := readPatchFilev2(bufio.NewReader(bytes.NewReader(serialized)))
+		if err != nil {
+			t.Fatalf("%s: readPatchFilev2: %v", c.name, err)
+		}
+		if result, err := applyPatch(c.original, readPatchv2); err != nil || !bytes.Equal(result, c.modified) {
+			t.Fatalf("%s: v2 round trip failed: %v", c.name, err)
+		}
+	}
+}
+
+func TestGeneratePatchRejectsEmptyInput(t *testing.T) {
+	if _, err := generatePatch(nil, []byte{1}); err == nil {
+		t.Fatal("expected error for empty original")
+	}
+	if _, err := generatePatch([]byte{1}, nil); err == nil {
+		t.Fatal("expected error for empty modified file")
+	}
+}
+
+func TestApplyPatchRejectsWrongOriginal(t *testing.T) {
+	original := []byte("original file")
+	patch, err := generatePatch(original, []byte("modified file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := applyPatch([]byte("original filf"), patch); err == nil {
+		t.Fatal("expected checksum mismatch")
+	}
+	if _, err := applyPatch([]byte("original"), patch); err == nil {
+		t.Fatal("expected length mismatch")
+	}
+}
+
+func TestApplyPatchRejectsItemPastEnd(t *testing.T) {
+	original := []byte("original file")
+	patch, err := generatePatch(original, []byte("modified file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch.PatchItems = append(patch.PatchItems, PatchItem{Offset: 0xFFFFFFFF, Content: []byte{1, 2}})
+	if _, err := applyPatch(original, patch); err == nil {
+		t.Fatal("expected error for item past the end of the file")
+	}
+}
+
+// serializedSeeds returns valid and damaged patch files to start the fuzzers from.
+func serializedSeeds(t testing.TB) [][]byte {
+	var seeds [][]byte
+	for _, c := range patchCases(rand.New(rand.NewSource(3)))[:10] {
+		patch, err := generatePatch(c.original, c.modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := writePatchFile(patch, &buf); err != nil {
+			t.Fatal(err)
+		}
+		seeds = append(seeds, buf.Bytes(), buf.Bytes()[:buf.Len()/2])
+	}
+
+	// Header claiming 2^32-1 items of 2^32-1 bytes each
+	header := []byte(IDENTIFIER)
+	header = append(header, VERSION_MAJOR, VERSION_MINOR)
+	header = append(header, make([]byte, 4+32+4+32)...)
+	header = append(header, 0xFF, 0xFF, 0xFF, 0xFF)
+	seeds = append(seeds, header, append(append([]byte{}, header...), 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 1, 2, 3))
+
+	return seeds
+}
+
+// checkAllocation fails when reading data allocated far more than the input could justify.
+func checkAllocation(t *testing.T, data []byte, read func()) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	read()
+	runtime.ReadMemStats(&after)
+
+	limit := uint64(64*len(data)) + 4<<20
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > limit {
+		t.Fatalf("reading %d bytes allocated %d bytes", len(data), allocated)
+	}
+}
+
+func FuzzReadPatchFile(f *testing.F) {
+	for _, seed := range serializedSeeds(f) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkAllocation(t, data, func() {
+			patch, err := readPatchFile(bytes.NewReader(data))
+			if err != nil {
+				return
+			}
+
+			// Revision 1.1 without flags is written back as 1.0, and parity is not written at all
+			if (patch.Flags == 0 && data[len(IDENTIFIER)+1] == VERSION_MINOR_FLAGS) || hasParity(data) {
+				return
+			}
+
+			// Whatever parses must serialize back to the bytes it came from
+			var buf bytes.Buffer
+			if err := writePatchFile(patch, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(data, buf.Bytes()) {
+				t.Fatal("re-serialized patch differs from input")
+			}
+		})
+	})
+}
+
+func FuzzReadPatchFilev2(f *testing.F) {
+	for _, seed := range serializedSeeds(f) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkAllocation(t, data, func() {
+			readPatchFilev2(bufio.NewReader(bytes.NewReader(data)))
+		})
+	})
+}
+
+func FuzzPatchRoundTrip(f *testing.F) {
+	for _, c := range patchCases(rand.New(rand.NewSource(4)))[:10] {
+		f.Add(c.original, c.modified)
+	}
+
+	f.Fuzz(func(t *testing.T, original, modified []byte) {
+		if len(original) == 0 || len(modified) == 0 {
+			return
+		}
+
+		patch, err := generatePatch(original, modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := writePatchFile(patch, &buf); err != nil {
+			t.Fatal(err)
+		}
+		readPatch, err := readPatchFile(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := applyPatch(original, readPatch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, modified) {
+			t.Fatal("patched file differs from modified file")
+		}
+	})
+}
+
+func TestPatchRevisions(t *testing.T) {
+	c := patchCases(rand.New(rand.NewSource(5)))[5]
+
+	for _, flags := range []uint32{0, FLAG_ITEM_CRC32, FLAG_PATCH_CHECKSUM, DEFAULT_PATCH_FLAGS} {
+		patch, err := generatePatch(c.original, c.modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch.Flags = flags
+
+		var buf bytes.Buffer
+		if err := writePatchFile(patch, &buf); err != nil {
+			t.Fatal(err)
+		}
+		serialized := buf.Bytes()
+
+		wantMinor := byte(VERSION_MINOR_FLAGS)
+		if flags == 0 {
+			wantMinor = VERSION_MINOR
+		}
+		if serialized[len(IDENTIFIER)+1] != wantMinor {
+			t.Fatalf("flags %#x: wrote minor version %d, want %d", flags, serialized[len(IDENTIFIER)+1], wantMinor)
+		}
+
+		readPatch, err := readPatchFile(bytes.NewReader(serialized))
+		if err != nil {
+			t.Fatalf("flags %#x: %v", flags, err)
+		}
+		if readPatch.Flags != flags {
+			t.Fatalf("flags %#x: read back %#x", flags, readPatch.Flags)
+		}
+		if result, err := applyPatch(c.original, readPatch); err != nil || !bytes.Equal(result, c.modified) {
+			t.Fatalf("flags %#x: round trip failed: %v", flags, err)
+		}
+		if err := verifyPatchData(serialized); err != nil {
+			t.Fatalf("flags %#x: verifyPatchData: %v", flags, err)
+		}
+	}
+}
+
+func TestReadPatchFileDetectsCorruption(t *testing.T) {
+	original := bytes.Repeat([]byte("original"), 100)
+	modified := append([]byte{}, original...)
+	copy(modified[100:], bytes.Repeat([]byte{0xAA}, 10))
+	copy(modified[500:], bytes.Repeat([]byte{0xBB}, 10))
+
+	corrupt := func(flags uint32) []byte {
+		patch, err := generatePatch(original, modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch.Flags = flags
+
+		var buf bytes.Buffer
+		if err := writePatchFile(patch, &buf); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		// Flip a byte in the content of the second item
+		data[bytes.Index(data, bytes.Repeat([]byte{0xBB}, 10))] ^= 0xFF
+		return data
+	}
+
+	data := corrupt(FLAG_ITEM_CRC32)
+	if _, err := readPatchFile(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "patch item 1") {
+		t.Fatalf("expected item 1 to be reported corrupt, got %v", err)
+	}
+
+	data = corrupt(FLAG_PATCH_CHECKSUM)
+	if _, err := readPatchFile(bytes.NewReader(data)); err == nil {
+		t.Fatal("expected whole-patch checksum mismatch")
+	}
+	if err := verifyPatchData(data); err == nil {
+		t.Fatal("expected verifyPatchData to reject the corrupt patch")
+	}
+}
+
+func TestReadPatchFileRejectsUnknownFlags(t *testing.T) {
+	patch, err := generatePatch([]byte("original"), []byte("modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch.Flags = 1 << 31
+
+	var buf bytes.Buffer
+	if err := writePatchFile(patch, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPatchFile(&buf); err == nil {
+		t.Fatal("expected unknown flags to be rejected")
+	}
+}
+
+func TestParityRepair(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+
+	for _, size := range []int{1, 100, 255, 10000, 100000} {
+		for _, percent := range []int{1, 10, 50, 100} {
+			data := randomBytes(r, size)
+			nsym := paritySymbols(percent)
+			protected := appendParity(data, nsym)
+
+			// A burst of nsym/2 bytes per codeword is spread evenly by the interleaving
+			burst := min(nsym/2*parityCodewords(size, nsym), size)
+			damaged := append([]byte{}, protected...)
+			start := r.Intn(size - burst + 1)
+			for i := start; i < start+burst; i++ {
+				damaged[i] ^= byte(1 + r.Intn(255))
+			}
+
+			repaired, corrected, gotNsym, err := repairPatchData(damaged)
+			if err != nil {
+				t.Fatalf("size %d, %d%%: %v", size, percent, err)
+			}
+			if !bytes.Equal(repaired, data) || corrected != burst || gotNsym != nsym {
+				t.Fatalf("size %d, %d%%: repaired %d of %d bytes incorrectly", size, percent, corrected, burst)
+			}
+		}
+	}
+}
+
+func TestParityRepairLimits(t *testing.T) {
+	data := randomBytes(rand.New(rand.NewSource(7)), 200)
+
+	if repaired, corrected, _, err := repairPatchData(data); err != nil || corrected != 0 || !bytes.Equal(repaired, data) {
+		t.Fatal("data without a trailer must pass unchanged")
+	}
+
+	// Damage beyond nsym/2 bytes in a single codeword cannot be repaired
+	protected := appendParity(data, paritySymbols(10))
+	for i := 0; i < 20; i++ {
+		protected[i] ^= 0xFF
+	}
+	if _, _, _, err := repairPatchData(protected); err == nil {
+		t.Fatal("expected too much damage to be reported")
+	}
+}
+
+func TestReadPatchFileRepairsDamage(t *testing.T) {
+	c := patchCases(rand.New(rand.NewSource(8)))[5]
+	patch, err := generatePatch(c.original, c.modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writePatchFile(patch, &buf); err != nil {
+		t.Fatal(err)
+	}
+	damaged := appendParity(buf.Bytes(), paritySymbols(10))
+	damaged[len(IDENTIFIER)+3] ^= 0xFF
+	damaged[buf.Len()/2] ^= 0xFF
+
+	readPatch, err := readPatchFile(bytes.NewReader(damaged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := applyPatch(c.original, readPatch); err != nil || !bytes.Equal(result, c.modified) {
+		t.Fatalf("repaired patch round trip failed: %v", err)
+	}
+}
+
+func TestReadRepairedPatchPassesThrough(t *testing.T) {
+	data := randomBytes(rand.New(rand.NewSource(10)), 200)
+
+	// Without a trailer, or without a way to look for one, nothing is buffered
+	plain := bytes.NewReader(data)
+	if reader, err := readRepairedPatch(plain); err != nil || reader != io.Reader(plain) {
+		t.Fatal("a patch without a trailer must pass through")
+	}
+	if plain.Len() != len(data) {
+		t.Fatal("looking for a trailer must not consume the patch")
+	}
+	stream := bytes.NewBuffer(appendParity(data, paritySymbols(10)))
+	if reader, err := readRepairedPatch(stream); err != nil || reader != io.Reader(stream) {
+		t.Fatal("a reader that cannot seek must pass through")
+	}
+
+	// A seekable patch with a trailer is repaired from where the reader stands
+	protected := append([]byte("skipped"), appendParity(data, paritySymbols(10))...)
+	protected[len("skipped")+5] ^= 0xFF
+	seekable := bytes.NewReader(protected)
+	seekable.Seek(int64(len("skipped")), io.SeekStart)
+	reader, err := readRepairedPatch(seekable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired, _ := io.ReadAll(reader); !bytes.Equal(repaired, data) {
+		t.Fatal("patch with a trailer was not repaired")
+	}
+}
+
+func TestApplyPatchFuzzy(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	original := randomBytes(r, 50000)
+	modified := append([]byte{}, original...)
+	copy(modified[1000:], "first hunk")
+	copy(modified[30000:], "second hunk")
+	modified = append(modified, "tail"...)
+
+	patch, err := generatePatch(original, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addPatchContext(patch, original, 16)
+
+	var buf bytes.Buffer
+	if err := writePatchFile(patch, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if patch, err = readPatchFile(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The original the patch was made for applies exactly
+	result, hunks, err := applyPatchFuzzy(original, patch)
+	if err != nil || !bytes.Equal(result, modified) {
+		t.Fatalf("exact apply failed: %v", err)
+	}
+	for _, hunk := range hunks {
+		if hunk.Status != HUNK_EXACT {
+			t.Fatalf("hunk %d: %s, want exact", hunk.Index, hunk.Status)
+		}
+	}
+
+	// A hotfix inserting bytes before the second hunk shifts it and everything after
+	inserted := randomBytes(r, 37)
+	hotfix := append(append(append([]byte{}, original[:20000]...), inserted...), original[20000:]...)
+	want := append(append(append([]byte{}, modified[:20000]...), inserted...), modified[20000:]...)
+
+	result, hunks, err = applyPatchFuzzy(hotfix, patch)
+	if err != nil || !bytes.Equal(result, want) {
+		t.Fatalf("fuzzy apply failed: %v", err)
+	}
+	if hunks[0].Status != HUNK_EXACT || hunks[1].Status != HUNK_SHIFTED || hunks[1].AppliedAt != int64(hunks[1].Offset)+37 {
+		t.Fatalf("unexpected hunk results: %+v", hunks)
+	}
+
+	// A hotfix touching the context of a hunk makes it fail
+	hotfix[1000-1] ^= 0xFF
+	hotfix[1000+len("first hunk")] ^= 0xFF
+	if _, hunks, err = applyPatchFuzzy(hotfix, patch); err == nil || hunks[0].Status != HUNK_FAILED {
+		t.Fatalf("expected the first hunk to fail, got %v", err)
+	}
+}
+
+func TestRebasePatch(t *testing.T) {
+	r := rand.New(rand.NewSource(10))
+	oldOriginal := randomBytes(r, 20000)
+	modified := append([]byte{}, oldOriginal...)
+	copy(modified[2000:], "kept hunk")
+	copy(modified[15000:], "lost hunk")
+
+	patch, err := generatePatch(oldOriginal, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The update inserts bytes before both hunks and rewrites the area around the second
+	newOriginal := append(append(append([]byte{}, oldOriginal[:1000]...), randomBytes(r, 50)...), oldOriginal[1000:]...)
+	copy(newOriginal[15050-8:], randomBytes(r, 30))
+
+	rebased, hunks, err := rebasePatch(oldOriginal, newOriginal, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hunks[0].Status != HUNK_SHIFTED || hunks[1].Status != HUNK_FAILED {
+		t.Fatalf("unexpected hunk results: %+v", hunks)
+	}
+	if rebased.OriginalChecksum != sha256.Sum256(newOriginal) || rebased.Flags != patch.Flags {
+		t.Fatal("rebased patch does not target the new original")
+	}
+
+	result, err := applyPatch(newOriginal, rebased)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result[2050:2050+len("kept hunk")], []byte("kept hunk")) {
+		t.Fatal("kept hunk was not carried over")
+	}
+	if _, _, err := rebasePatch(newOriginal, newOriginal, patch); err == nil {
+		t.Fatal("expected a mismatching old original to be rejected")
+	}
+}
+
+func TestParseSignatureRules(t *testing.T) {
+	rules, err := parseSignatureRules(strings.NewReader(`
+# comment
+find    48 8b ?? 74
+replace ?? ?? ?? EB
+count   2
+
+find 01
+replace 02
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Count != 2 || rules[1].Count != 1 {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	if !bytes.Equal(rules[0].PatternMask, []byte{0, 0, 1, 0}) || !bytes.Equal(rules[0].ReplacementMask, []byte{1, 1, 1, 0}) {
+		t.Fatalf("unexpected wildcard masks: %+v", rules[0])
+	}
+
+	for _, input := range []string{
+		"",
+		"find 01 02\nreplace 03",
+		"find ?? ??\nreplace 01 02",
+		"find 01\n",
+		"replace 01",
+		"find 0g\nreplace 01",
+		"find 01\nreplace 02\ncount 0",
+		"search 01",
+	} {
+		if _, err := parseSignatureRules(strings.NewReader(input)); err == nil {
+			t.Errorf("expected %q to be rejected", input)
+		}
+	}
+}
+
+func TestSignaturePatch(t *testing.T) {
+	rules, err := parseSignatureRules(strings.NewReader("find AA ?? CC\nreplace ?? 00 ??\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := &PatchFile{Flags: DEFAULT_PATCH_FLAGS | FLAG_SIGNATURES, PatchItems: []PatchItem{}, Signatures: rules}
+
+	var buf bytes.Buffer
+	if err := writePatchFile(patch, &buf); err != nil {
+		t.Fatal(err)
+	}
+	readPatch, err := readPatchFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := commandResult
+	defer func() { commandResult = saved }()
+	commandResult = &CommandResult{}
+
+	// Two builds with the signature at different offsets both take the patch
+	for _, original := range [][]byte{
+		{0x01, 0xAA, 0x55, 0xCC, 0x02},
+		{0x09, 0x09, 0x09, 0xAA, 0x66, 0xCC},
+	} {
+		result, err := applyPatch(original, readPatch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := append([]byte{}, original...)
+		expected[bytes.IndexByte(original, 0xAA)+1] = 0x00
+		if !bytes.Equal(result, expected) {
+			t.Fatalf("got %x, want %x", result, expected)
+		}
+	}
+	// Without checksums the result says it was not verified
+	if details, ok := commandResult.Details.(map[string]any); !ok || details["verified"] != false {
+		t.Fatalf("expected unverified details, got %v", commandResult.Details)
+	}
+
+	if _, err := applyPatch([]byte{0xAA, 0x00, 0xCC, 0xAA, 0x01, 0xCC}, readPatch); err == nil {
+		t.Fatal("expected a signature matching twice to be rejected")
+	}
+	if _, err := applyPatch([]byte{0x01, 0x02}, readPatch); err == nil {
+		t.Fatal("expected a missing signature to be rejected")
+	}
+
+	// Signatures after ordinary items run on the patched data
+	original := []byte("version 1, check AA")
+	modified := []byte("version 2, check AA")
+	mixed, err := generatePatch(original, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, _ = parseSignatureRules(strings.NewReader("find 32 2C\nreplace 33 ??\n"))
+	mixed.Flags |= FLAG_SIGNATURES
+	mixed.Signatures = rules
+	mixed.PatchedChecksum = sha256.Sum256([]byte("version 3, check AA"))
+
+	buf.Reset()
+	if err := writePatchFile(mixed, &buf); err != nil {
+		t.Fatal(err)
+	}
+	readPatch, err = readPatchFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := applyPatch(original, readPatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "version 3, check AA" {
+		t.Fatalf("unexpected mixed result %q", result)
+	}
+}
+
+func TestStdioPaths(t *testing.T) {
+	data := randomBytes(rand.New(rand.NewSource(11)), 200000)
+
+	// Larger than a pipe buffer, so the writer has to run alongside the read
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		writer.Write(data)
+		writer.Close()
+	}()
+
+	stdin := os.Stdin
+	os.Stdin = reader
+	defer func() { os.Stdin = stdin }()
+
+	read, err := readFileWithFileRead(STDIO_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("stdin read differs from the data written")
+	}
+
+	var buf bytes.Buffer
+	saved := stdout
+	stdout = &buf
+	defer func() { stdout = saved }()
+
+	if err := writeBytesAtomic(STDIO_PATH, data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("stdout write differs from the data given")
+	}
+
+	if err := checkStdinInputs(&CLIOptions{originalPath: STDIO_PATH, patchPath: STDIO_PATH}); err == nil {
+		t.Fatal("expected two stdin inputs to be rejected")
+	}
+}
+
+func TestBuildPatches(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(12))
+	for _, name := range []string{"a.dll", "b.dll"} {
+		original := randomBytes(r, 5000)
+		os.MkdirAll(filepath.Join(dir, "old"), 0755)
+		os.MkdirAll(filepath.Join(dir, "new"), 0755)
+		os.WriteFile(filepath.Join(dir, "old", name), original, 0644)
+		os.WriteFile(filepath.Join(dir, "new", name), mutate(r, original, 10), 0644)
+	}
+
+	writeManifest := func(manifest string) string {
+		path := filepath.Join(dir, "manifest.json")
+		if err := os.WriteFile(path, []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	path := writeManifest(`{"version": "1.2", "out_dir": "out", "patches": [
+		{"original": "old/*.dll", "new": "new", "out": "{name}.mtgadiff", "metadata": {"kind": "code"}}]}`)
+	if err := buildPatches(&CLIOptions{manifestPath: path, workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "out", DEFAULT_INDEX_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := BuildIndex{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatal(err)
+	}
+	if index.Version != "1.2" || len(index.Patches) != 2 || index.Patches[0].Name != "a.dll.mtgadiff" || index.Patches[1].Metadata["kind"] != "code" {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+
+	for _, entry := range index.Patches {
+		patch, err := readPatchPath(filepath.Join(dir, "out", entry.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		original, _ := os.ReadFile(filepath.Join(dir, entry.Original))
+		modified, _ := os.ReadFile(filepath.Join(dir, entry.New))
+		result, err := applyPatch(original, patch)
+		if err != nil || !bytes.Equal(result, modified) {
+			t.Fatalf("%s does not reproduce %s: %v", entry.Name, entry.New, err)
+		}
+		if entry.Size == 0 || entry.PatchChecksum == "" {
+			t.Fatalf("%s is missing its size or checksum", entry.Name)
+		}
+	}
+
+	for _, manifest := range []string{
+		`{"patches": []}`,
+		`{"patches": [{"original": "old/*.dll", "new": "new", "out": "same.mtgadiff"}]}`,
+		`{"patches": [{"original": "old/a.dll", "new": "new/a.dll", "out": "x"}, {"original": "old/b.dll", "new": "new/b.dll", "out": "x"}]}`,
+		`{"patches": [{"original": "old/a.dll", "new": "new/a.dll", "out": "../escape.mtgadiff"}]}`,
+	} {
+		if err := buildPatches(&CLIOptions{manifestPath: writeManifest(manifest), workers: 1}); err == nil {
+			t.Errorf("expected manifest %s to be rejected", manifest)
+		}
+	}
+
+	// A patch can set a default context back to none
+	manifest := &BuildManifest{}
+	if err := json.Unmarshal([]byte(`{"defaults": {"context": 16}, "patches": [
+		{"original": "old/a.dll", "new": "new/a.dll", "context": 0},
+		{"original": "old/b.dll", "new": "new/b.dll"}]}`), manifest); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := resolveBuildJobs(manifest, dir, filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs[0].opts.contextSize != 0 || jobs[1].opts.contextSize != 16 {
+		t.Fatalf("unexpected context sizes %d and %d", jobs[0].opts.contextSize, jobs[1].opts.contextSize)
+	}
+}
+
+func TestCommandResult(t *testing.T) {
+	// Codes come from the sentinels the errors wrap, however deep
+	_, missing := os.ReadFile(filepath.Join(t.TempDir(), "missing"))
+	for _, test := range []struct {
+		err  error
+		code string
+	}{
+		{fmt.Errorf("error applying patch: %w", fmt.Errorf("original file %w", errChecksumMismatch)), ERR_CHECKSUM_MISMATCH},
+		{fmt.Errorf("error applying patch: %w", fmt.Errorf("patched file %w", errLengthMismatch)), ERR_CHECKSUM_MISMATCH},
+		{fmt.Errorf("error verifying patch file: %w", fmt.Errorf("%w: patch file checksum mismatch", errCorruptPatch)), ERR_CORRUPT_PATCH},
+		{fmt.Errorf("error reading patch file: %w", io.ErrUnexpectedEOF), ERR_CORRUPT_PATCH},
+		{fmt.Errorf("error reading patch file: %w", errVersionMismatch), ERR_VERSION_MISMATCH},
+		{fmt.Errorf("error generating patch: %w", errEmptyInput), ERR_EMPTY_INPUT},
+		{fmt.Errorf("%w: runs must be at least 1", errInvalidArguments), ERR_INVALID_ARGUMENTS},
+		{fmt.Errorf("error reading original file: %w", missing), ERR_IO_OPERATION},
+		{errors.New("no matching patch found in catalog"), ERR_OPERATION_FAILED},
+		// Wording alone no longer decides the code
+		{errors.New("original file checksum mismatch"), ERR_OPERATION_FAILED},
+	} {
+		if got := errorCode(test.err); got != test.code {
+			t.Errorf("%q: got %s, want %s", test.err, got, test.code)
+		}
+	}
+
+	// Errors from the code itself carry their sentinels
+	var buf bytes.Buffer
+	if err := writePatchFile(knownPatch(t), &buf); err != nil {
+		t.Fatal(err)
+	}
+	serialized := buf.Bytes()
+	unknownFlags := append([]byte{}, serialized...)
+	unknownFlags[len(IDENTIFIER)+2] = 0x80
+	_, applyErr := applyPatch([]byte("hello there"), knownPatch(t))
+	_, truncatedErr := readPatchFile(bytes.NewReader(serialized[:len(serialized)-40]))
+	_, flagsErr := readPatchFile(bytes.NewReader(unknownFlags))
+	_, emptyErr := generatePatch(nil, knownModified)
+	for err, code := range map[error]string{applyErr: ERR_CHECKSUM_MISMATCH, truncatedErr: ERR_CORRUPT_PATCH, flagsErr: ERR_VERSION_MISMATCH, emptyErr: ERR_EMPTY_INPUT} {
+		if got := errorCode(err); got != code {
+			t.Errorf("%v: got %s, want %s", err, got, code)
+		}
+	}
+
+	saved := commandResult
+	defer func() { commandResult = saved }()
+	commandResult = &CommandResult{}
+
+	patch, err := generatePatch([]byte("abc"), []byte("abd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordPatch(patch)
+	opts := &CLIOptions{mode: MODE_CREATE, originalPath: "a", newPath: "b", outputPath: filepath.Join(t.TempDir(), "missing"), format: FORMAT_MTGADIFF}
+
+	result := CommandResult{}
+	if err := json.Unmarshal(finishResult(opts, time.Now(), nil), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != RESULT_OK || result.Command != MODE_CREATE || result.ItemCount == nil || *result.ItemCount != 1 || result.PatchedLength != 3 || result.Error != nil {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	result = CommandResult{}
+	if err := json.Unmarshal(finishResult(opts, time.Now(), fmt.Errorf("patched file %w", errChecksumMismatch)), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != RESULT_ERROR || result.Error == nil || result.Error.Code != ERR_CHECKSUM_MISMATCH {
+		t.Fatalf("unexpected error result: %+v", result)
+	}
+}
+
+func TestReadInputFileMapped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.bin")
+	data := randomBytes(rand.New(rand.NewSource(13)), 100000)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mapped, release, err := readInputFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mapped, data) {
+		t.Fatal("mapped data differs from the file")
+	}
+
+	// Writes land in private pages, never in the file
+	mapped[0] ^= 0xFF
+	release()
+	if onDisk, _ := os.ReadFile(path); !bytes.Equal(onDisk, data) {
+		t.Fatal("writing to the mapping changed the file")
+	}
+
+	// Empty files cannot be mapped and fall back to a plain read
+	empty := filepath.Join(t.TempDir(), "empty.bin")
+	os.WriteFile(empty, nil, 0644)
+	if content, release, err := readInputFile(empty, true); err != nil || len(content) != 0 {
+		t.Fatalf("unexpected empty read: %d bytes, %v", len(content), err)
+	} else {
+		release()
+	}
+}
+
+func TestStreamPatch(t *testing.T) {
+	stream := func(c patchCase, flags uint32, window int) []byte {
+		out, err := os.CreateTemp(t.TempDir(), "stream-*.mtgapatch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		if _, _, err := streamPatch(bytes.NewReader(c.original), bytes.NewReader(c.modified), out, flags, window); err != nil {
+			t.Fatalf("%s: streamPatch: %v", c.name, err)
+		}
+		data, err := os.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	for _, c := range patchCases(rand.New(rand.NewSource(14))) {
+		// A window larger than every run gives the same bytes as the in-memory writer, for delta patches
+		for _, flags := range []uint32{DEFAULT_PATCH_FLAGS, 0} {
+			patch, err := generatePatch(c.original, c.modified)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patch.Flags&FLAG_FULL_FILE != 0 {
+				continue // Streaming never falls back to a full-file patch
+			}
+			patch.Flags = flags
+			var expected bytes.Buffer
+			if err := writePatchFile(patch, &expected); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stream(c, flags, 8192), expected.Bytes()) {
+				t.Fatalf("%s: streamed patch differs from writePatchFile (flags %d)", c.name, flags)
+			}
+		}
+
+		// A small window splits runs and extra data across items, which must still apply
+		readPatch, err := readPatchFile(bytes.NewReader(stream(c, DEFAULT_PATCH_FLAGS, 64)))
+		if err != nil {
+			t.Fatalf("%s: readPatchFile: %v", c.name, err)
+		}
+		if result, err := applyPatch(c.original, readPatch); err != nil || !bytes.Equal(result, c.modified) {
+			t.Fatalf("%s: windowed patch failed to apply: %v", c.name, err)
+		}
+	}
+
+	out, _ := os.CreateTemp(t.TempDir(), "empty-*.mtgapatch")
+	defer out.Close()
+	if _, _, err := streamPatch(bytes.NewReader(nil), bytes.NewReader([]byte{1}), out, DEFAULT_PATCH_FLAGS, 64); err == nil {
+		t.Fatal("expected an error for an empty original")
+	}
+
+	// The read-back check catches a header or a body that changed on disk
+	r := rand.New(rand.NewSource(37))
+	original := randomBytes(r, 5000)
+	written, err := os.CreateTemp(t.TempDir(), "verify-*.mtgapatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer written.Close()
+	patch, items, err := streamPatch(bytes.NewReader(original), bytes.NewReader(mutate(r, original, 20)), written, DEFAULT_PATCH_FLAGS, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyStreamedPatch(written.Name(), patch, items); err != nil {
+		t.Fatalf("intact patch failed verification: %v", err)
+	}
+	if err := verifyStreamedPatch(written.Name(), patch, items+1); !errors.Is(err, errCorruptPatch) {
+		t.Fatalf("expected a header mismatch, got %v", err)
+	}
+	stat, _ := written.Stat()
+	flipped := make([]byte, 1)
+	written.ReadAt(flipped, stat.Size()/2)
+	if _, err := written.WriteAt([]byte{flipped[0] ^ 0xFF}, stat.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyStreamedPatch(written.Name(), patch, items); err == nil || !strings.Contains(err.Error(), "patch file checksum mismatch") {
+		t.Fatalf("expected a trailer mismatch, got %v", err)
+	}
+
+	// createStreamingPatch verifies before replacing the output
+	dir := t.TempDir()
+	originalPath, newPath, outputPath := filepath.Join(dir, "original"), filepath.Join(dir, "new"), filepath.Join(dir, "out.mtgadiff")
+	modified := mutate(r, original, 20)
+	os.WriteFile(originalPath, original, 0644)
+	os.WriteFile(newPath, modified, 0644)
+	if err := createStreamingPatch(&CLIOptions{originalPath: originalPath, newPath: newPath, outputPath: outputPath, format: FORMAT_MTGADIFF}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(outputPath)
+	readPatch, err := readPatchFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := applyPatch(original, readPatch); err != nil || !bytes.Equal(result, modified) {
+		t.Fatalf("streamed patch file failed to apply: %v", err)
+	}
+}
+
+func TestDiffRegions(t *testing.T) {
+	original := []byte("Hello, world! The original text.")
+	modified := []byte("Hello, World! The modified text....")
+
+	expected := []DiffRegion{{7, 1}, {18, 8}, {32, 3}}
+	regions := diffRegions(original, modified)
+	if len(regions) != len(expected) {
+		t.Fatalf("got %d regions, expected %d: %v", len(regions), len(expected), regions)
+	}
+	for i := range expected {
+		if regions[i] != expected[i] {
+			t.Fatalf("region %d is %v, expected %v", i, regions[i], expected[i])
+		}
+	}
+	if regions := diffRegions(original, original); len(regions) != 0 {
+		t.Fatalf("identical files have regions: %v", regions)
+	}
+
+	// Regions far apart get blocks of their own, each with its context lines only
+	far := bytes.Repeat([]byte{0xAA}, 64*DIFF_LINE_WIDTH)
+	changed := append([]byte{}, far...)
+	changed[DIFF_LINE_WIDTH] = 0
+	changed[60*DIFF_LINE_WIDTH] = 0
+	var out bytes.Buffer
+	writeDiffBlocks(&out, far, changed, diffRegions(far, changed), 1, false)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 8 || !strings.HasPrefix(lines[0], "@@ 0x00000010-0x00000011 @@") || !strings.HasPrefix(lines[4], "@@ 0x000003c0-0x000003c1 @@") {
+		t.Fatalf("unexpected blocks:\n%s", out.String())
+	}
+	if !strings.HasPrefix(lines[5], "000003b0  ") {
+		t.Fatalf("context line missing:\n%s", out.String())
+	}
+
+	for value, valid := range map[string]bool{"": true, "0x10-0x20": true, "16-": true, "-32": true, "32-16": false, "16": false, "x-1": false} {
+		if _, _, err := parseOffsetRange(value); (err == nil) != valid {
+			t.Fatalf("parseOffsetRange(%q) returned %v", value, err)
+		}
+	}
+}
+
+func TestPatchReport(t *testing.T) {
+	r := rand.New(rand.NewSource(15))
+	original := randomBytes(r, 10000)
+	copy(original[100:], make([]byte, 100))
+	modified := append([]byte{}, original...)
+	copy(modified[100:], bytes.Repeat([]byte{0x41}, 100))
+	modified[9000] ^= 0xFF
+
+	patch, err := generatePatch(original, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := buildPatchReport(patch, original)
+	if len(report.Items) != 2 || report.ChangedBytes != 101 || !report.Items[0].Truncated || report.Revision != "1.1" {
+		t.Fatalf("unexpected report: %d items, %d bytes", len(report.Items), report.ChangedBytes)
+	}
+
+	// Every changed byte lands in exactly one heatmap cell
+	changed := 0
+	for _, cell := range report.Heatmap {
+		changed += cell.Changed
+	}
+	if changed != 101 || len(report.Heatmap) > REPORT_HEATMAP_CELLS || report.Heatmap[len(report.Heatmap)-1].End != len(original) {
+		t.Fatalf("heatmap covers %d changed bytes in %d cells", changed, len(report.Heatmap))
+	}
+
+	report.Title = "<script>"
+	var page bytes.Buffer
+	if err := reportTemplate.Execute(&page, report); err != nil {
+		t.Fatal(err)
+	}
+	html := page.String()
+	if strings.Contains(html, "<script>") || !strings.Contains(html, "0x00002328") || !strings.Contains(html, hexBytes(original[100:100+REPORT_HEX_BYTES])) {
+		t.Fatal("report page is missing items or is not escaped")
+	}
+}
+
+func TestPatchStats(t *testing.T) {
+	original := bytes.Repeat([]byte{0x00}, 4096)
+	modified := append([]byte{}, original...)
+	for _, item := range []struct{ offset, length int }{{10, 1}, {100, 3}, {200, 3}, {1000, 40}} {
+		copy(modified[item.offset:], bytes.Repeat([]byte{0xFF}, item.length))
+	}
+
+	patch, err := generatePatch(original, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := itemStats(patch, original)
+	if stats.Regions != 4 || stats.ChangedBytes != 47 || stats.WrittenBytes != 47 || stats.Smallest != 1 || stats.Median != 3 || stats.Largest != 40 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	// Offset, length and CRC32 per item
+	if stats.OverheadBytes != 4*12 {
+		t.Fatalf("overhead is %d bytes, expected %d", stats.OverheadBytes, 4*12)
+	}
+	expected := []SizeBucket{{1, 1, 1}, {2, 3, 2}, {32, 63, 1}}
+	if len(stats.ItemSizes) != len(expected) {
+		t.Fatalf("unexpected buckets: %v", stats.ItemSizes)
+	}
+	for i := range expected {
+		if stats.ItemSizes[i] != expected[i] {
+			t.Fatalf("bucket %d is %v, expected %v", i, stats.ItemSizes[i], expected[i])
+		}
+	}
+
+	// Estimates are the sizes the writers produce
+	opts := &CLIOptions{contextSize: DEFAULT_STATS_CONTEXT, parity: DEFAULT_STATS_PARITY}
+	for _, estimate := range estimatePatchSizes(patch, original, opts) {
+		if estimate.Option != FORMAT_BPS && estimate.Option != FORMAT_MTGADIFF {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := writePatchFormat(estimate.Option, patch, original, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if estimate.Size != buf.Len() {
+			t.Fatalf("%s estimate is %d bytes, writer produced %d", estimate.Option, estimate.Size, buf.Len())
+		}
+	}
+	for _, estimate := range estimatePatchSizes(patch, nil, opts) {
+		if estimate.Option == FORMAT_VCDIFF && estimate.Error == "" {
+			t.Fatal("vcdiff was estimated without an original")
+		}
+	}
+}
+
+func TestFullFilePatch(t *testing.T) {
+	r := rand.New(rand.NewSource(16))
+	original := randomBytes(r, 4096)
+	rewritten := randomBytes(r, 5000)
+
+	patch, err := generatePatch(original, rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patch.Flags&FLAG_FULL_FILE == 0 || len(patch.PatchItems) != 1 || patchMode(patch) != PATCH_MODE_FULL_FILE {
+		t.Fatalf("rewritten file gave a %s patch with %d items", patchMode(patch), len(patch.PatchItems))
+	}
+
+	// Round trip, in revision 1.1 and as a plain 1.0 item
+	for _, flags := range []uint32{patch.Flags, 0} {
+		variant := *patch
+		variant.Flags = flags
+		var buf bytes.Buffer
+		if err := writePatchFile(&variant, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() > len(rewritten)+200 {
+			t.Fatalf("full-file patch is %d bytes for a %d byte file", buf.Len(), len(rewritten))
+		}
+		readPatch, err := readPatchFile(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, err := applyPatch(original, readPatch); err != nil || !bytes.Equal(result, rewritten) {
+			t.Fatalf("full-file patch failed to apply (flags %d): %v", flags, err)
+		}
+	}
+
+	// The whole file must be the only item
+	broken := *patch
+	broken.PatchItems = append(broken.PatchItems, PatchItem{Offset: 0, Content: []byte{0}})
+	if _, err := applyPatch(original, &broken); !errors.Is(err, errCorruptPatch) {
+		t.Fatalf("expected an invalid patch error, got %v", err)
+	}
+	if _, err := applyPatch(rewritten, patch); err == nil {
+		t.Fatal("full-file patch applied to the wrong original")
+	}
+
+	// Report and stats count the bytes that differ, not the whole file written
+	changed := 0
+	for _, region := range diffRegions(original, rewritten) {
+		changed += region.Length
+	}
+	report := buildPatchReport(patch, original)
+	heatmapChanged := 0
+	for _, cell := range report.Heatmap {
+		heatmapChanged += cell.Changed
+	}
+	if report.WrittenBytes != len(rewritten) || report.ChangedBytes != changed || heatmapChanged != changed || changed >= len(rewritten) {
+		t.Fatalf("report counts %d written and %d changed bytes, %d in the heatmap, expected %d changed", report.WrittenBytes, report.ChangedBytes, heatmapChanged, changed)
+	}
+	if stats := itemStats(patch, original); stats.WrittenBytes != len(rewritten) || stats.ChangedBytes != changed {
+		t.Fatalf("stats count %d written and %d changed bytes, expected %d changed", stats.WrittenBytes, stats.ChangedBytes, changed)
+	}
+	if stats := itemStats(patch, nil); stats.ChangedBytes != len(rewritten) {
+		t.Fatalf("without the original every written byte counts as changed, got %d", stats.ChangedBytes)
+	}
+
+	// A few changed bytes stay a delta
+	if patch, _ := generatePatch(original, mutate(r, original, 10)); patchMode(patch) != PATCH_MODE_DELTA {
+		t.Fatal("small change gave a full-file patch")
+	}
+}
+
+// writeTestPatch writes the MTGADIFF patch from original to modified at path, with context bytes around each item.
+func writeTestPatch(t *testing.T, path string, original, modified []byte, context int) {
+	t.Helper()
+	patch, err := generatePatch(original, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context > 0 {
+		addPatchContext(patch, original, context)
+	}
+	var buf bytes.Buffer
+	if err := writePatchFile(patch, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCatalogAutoPatch(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(17))
+	v1 := randomBytes(r, 3000)
+	v2 := mutate(r, v1, 10)
+	other := randomBytes(r, 5000)
+	writeTestPatch(t, filepath.Join(dir, "v1-v2.mtgadiff"), v1, v2, 0)
+	writeTestPatch(t, filepath.Join(dir, "other.mtgadiff"), other, mutate(r, other, 10), 0)
+	os.WriteFile(filepath.Join(dir, "broken.mtgadiff"), []byte("not a patch"), 0644)
+	os.WriteFile(filepath.Join(dir, "readme.txt"), []byte("ignored"), 0644)
+
+	catalog, err := loadCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Entries) != 2 {
+		t.Fatalf("catalog has %d entries, expected the 2 valid patches", len(catalog.Entries))
+	}
+	if matches := catalog.lookup(sha256.Sum256(v1)); len(matches) != 1 || filepath.Base(matches[0].Path) != "v1-v2.mtgadiff" {
+		t.Fatalf("unexpected lookup result: %v", matches)
+	}
+	if matches := catalog.lookup(sha256.Sum256(v2)); len(matches) != 0 {
+		t.Fatalf("patched file matched %d patches", len(matches))
+	}
+
+	// Nearest known versions are ordered by how close their original length is
+	nearest := catalog.nearest(4800, NEAREST_COUNT)
+	if len(nearest) != 2 || nearest[0].OriginalLength != 5000 || nearest[1].OriginalLength != 3000 {
+		t.Fatalf("unexpected nearest entries: %v", nearest)
+	}
+	if nearest := catalog.nearest(0, 1); len(nearest) != 1 || nearest[0].OriginalLength != 3000 {
+		t.Fatalf("nearest did not stop at n: %v", nearest)
+	}
+
+	// autoPatch applies the single match and fails without one
+	originalPath, outputPath := filepath.Join(t.TempDir(), "v1"), filepath.Join(t.TempDir(), "out")
+	os.WriteFile(originalPath, v1, 0644)
+	if err := autoPatch(&CLIOptions{originalPath: originalPath, catalogPath: dir, outputPath: outputPath}); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := os.ReadFile(outputPath); !bytes.Equal(result, v2) {
+		t.Fatal("autoPatch output differs from the new version")
+	}
+	os.WriteFile(originalPath, v2, 0644)
+	if err := autoPatch(&CLIOptions{originalPath: originalPath, catalogPath: dir, outputPath: outputPath}); err == nil || !strings.Contains(err.Error(), "no matching patch") {
+		t.Fatalf("expected no match, got %v", err)
+	}
+}
+
+func TestFindUpgradePath(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(18))
+	v1 := randomBytes(r, 4000)
+	v2 := mutate(r, v1, 5)
+	v3 := mutate(r, v2, 5)
+	unrelated := randomBytes(r, 100)
+
+	// The direct patch stores large context, so the two step chain downloads less
+	writeTestPatch(t, filepath.Join(dir, "v1-v2.mtgadiff"), v1, v2, 0)
+	writeTestPatch(t, filepath.Join(dir, "v2-v3.mtgadiff"), v2, v3, 0)
+	writeTestPatch(t, filepath.Join(dir, "v1-v3.mtgadiff"), v1, v3, 1024)
+
+	catalog, err := loadCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := catalog.findUpgradePath(sha256.Sum256(v1), sha256.Sum256(v3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || filepath.Base(chain[0].Path) != "v1-v2.mtgadiff" || filepath.Base(chain[1].Path) != "v2-v3.mtgadiff" {
+		t.Fatalf("unexpected chain: %v", chain)
+	}
+	result, err := applyPatchChain(v1, chain)
+	if err != nil || !bytes.Equal(result, v3) {
+		t.Fatalf("chain did not produce the target: %v", err)
+	}
+
+	if chain, err := catalog.findUpgradePath(sha256.Sum256(v2), sha256.Sum256(v2)); err != nil || len(chain) != 0 {
+		t.Fatalf("expected an empty chain to the same version, got %v, %v", chain, err)
+	}
+	if _, err := catalog.findUpgradePath(sha256.Sum256(v3), sha256.Sum256(v1)); err == nil {
+		t.Fatal("expected no path backwards")
+	}
+	if _, err := catalog.findUpgradePath(sha256.Sum256(unrelated), sha256.Sum256(v3)); err == nil {
+		t.Fatal("expected no path from an unknown version")
+	}
+}
+
+func TestPatchServer(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(19))
+	v1 := randomBytes(r, 3000)
+	v2, v3 := mutate(r, v1, 10), mutate(r, v1, 20)
+	other := randomBytes(r, 2000)
+	writeTestPatch(t, filepath.Join(dir, "v1-v2.mtgadiff"), v1, v2, 0)
+	writeTestPatch(t, filepath.Join(dir, "v1-v3.mtgadiff"), v1, v3, 0)
+	writeTestPatch(t, filepath.Join(dir, "other.mtgadiff"), other, mutate(r, other, 10), 0)
+
+	catalog, err := loadCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newPatchServer(catalog))
+	defer server.Close()
+
+	get := func(path string) (int, []byte) {
+		t.Helper()
+		resp, err := server.Client().Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+	checksumOf := func(data []byte) string {
+		checksum := sha256.Sum256(data)
+		return hex.EncodeToString(checksum[:])
+	}
+
+	// The list holds every patch of the catalog
+	status, body := get("/patches")
+	var infos []PatchInfo
+	if status != http.StatusOK || json.Unmarshal(body, &infos) != nil || len(infos) != 3 {
+		t.Fatalf("unexpected patch list: %d %s", status, body)
+	}
+
+	// A single match is served as is, and its metadata carries the checksum of the file
+	otherPatch, _ := os.ReadFile(filepath.Join(dir, "other.mtgadiff"))
+	if status, body := get("/patches/" + checksumOf(other)); status != http.StatusOK || !bytes.Equal(body, otherPatch) {
+		t.Fatalf("unexpected patch download: %d", status)
+	}
+	status, body = get("/patches/" + checksumOf(other) + "/meta")
+	var info PatchInfo
+	if status != http.StatusOK || json.Unmarshal(body, &info) != nil {
+		t.Fatalf("unexpected patch metadata: %d %s", status, body)
+	}
+	if info.Name != "other.mtgadiff" || info.Size != int64(len(otherPatch)) || info.PatchChecksum != checksumOf(otherPatch) {
+		t.Fatalf("unexpected patch metadata: %+v", info)
+	}
+
+	// Two patches share v1, so ?target= has to pick one
+	if status, _ := get("/patches/" + checksumOf(v1)); status != http.StatusConflict {
+		t.Fatalf("ambiguous checksum returned %d", status)
+	}
+	status, body = get("/patches/" + checksumOf(v1) + "/meta?target=" + checksumOf(v3))
+	if status != http.StatusOK || json.Unmarshal(body, &info) != nil || info.Name != "v1-v3.mtgadiff" {
+		t.Fatalf("target did not select v1-v3: %d %s", status, body)
+	}
+	if status, _ := get("/patches/" + checksumOf(v1) + "?target=" + checksumOf(other)); status != http.StatusNotFound {
+		t.Fatalf("unknown target returned %d", status)
+	}
+	if status, _ := get("/patches/" + checksumOf(v2)); status != http.StatusNotFound {
+		t.Fatalf("unknown checksum returned %d", status)
+	}
+	if status, _ := get("/patches/zz"); status != http.StatusBadRequest {
+		t.Fatalf("invalid checksum returned %d", status)
+	}
+
+	// fetchPatch verifies the download and applies it
+	data, fetched, err := fetchPatch(server.Client(), server.URL, sha256.Sum256(v1), checksumOf(v2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.Name != "v1-v2.mtgadiff" {
+		t.Fatalf("fetched %s instead of v1-v2.mtgadiff", fetched.Name)
+	}
+	patch, err := readPatchFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := applyPatch(v1, patch); err != nil || !bytes.Equal(result, v2) {
+		t.Fatalf("fetched patch did not produce v2: %v", err)
+	}
+	if _, _, err := fetchPatch(server.Client(), server.URL, sha256.Sum256(v1), ""); err == nil || !strings.Contains(err.Error(), "several patches match") {
+		t.Fatalf("expected an ambiguity error, got %v", err)
+	}
+}
+
+func TestFetchPatchVerification(t *testing.T) {
+	r := rand.New(rand.NewSource(23))
+	original := randomBytes(r, 2000)
+	patch, err := generatePatch(original, mutate(r, original, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writePatchFile(patch, &buf); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	invalid := append([]byte("NOTAPATCH"), valid[9:]...)
+
+	checksumOf := func(data []byte) string {
+		checksum := sha256.Sum256(data)
+		return hex.EncodeToString(checksum[:])
+	}
+
+	// Each server publishes metadata that does not match what it serves
+	tests := []struct {
+		name     string
+		data     []byte
+		size     int64
+		checksum string
+		expected string
+	}{
+		{"short download", valid[:len(valid)-10], int64(len(valid)), checksumOf(valid), "expected"},
+		{"wrong checksum", valid, int64(len(valid)), checksumOf(invalid), "checksum mismatch"},
+		{"bad header", invalid, int64(len(invalid)), checksumOf(invalid), "downloaded patch is invalid"},
+		{"other original", valid, int64(len(valid)), checksumOf(valid), "does not apply to the original file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/meta") {
+					json.NewEncoder(w).Encode(PatchInfo{Size: test.size, PatchChecksum: test.checksum})
+					return
+				}
+				w.Write(test.data)
+			}))
+			defer server.Close()
+
+			requested := sha256.Sum256(original)
+			if test.name == "other original" {
+				requested = sha256.Sum256(valid)
+			}
+			if _, _, err := fetchPatch(server.Client(), server.URL, requested, ""); err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Fatalf("expected %q, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+// testFormatRoundTrip writes every patch case in format, as create does with and without -compat, and applies it back through applyPatchFormat.
+func testFormatRoundTrip(t *testing.T, format string, seed int64) {
+	t.Helper()
+	for _, c := range patchCases(rand.New(rand.NewSource(seed))) {
+		patch, err := generatePatch(c.original, c.modified)
+		if err != nil {
+			t.Fatalf("%s: generatePatch: %v", c.name, err)
+		}
+
+		for _, compat := range []bool{false, true} {
+			variant := *patch
+			if compat {
+				variant.Flags = 0
+			}
+			var buf bytes.Buffer
+			if err := writePatchFormat(format, &variant, c.original, &buf); err != nil {
+				t.Fatalf("%s (compat %v): write %s: %v", c.name, compat, format, err)
+			}
+
+			// Formats without checksums of their own are verified against the patch
+			var checksums *PatchInfo
+			if format == FORMAT_BSDIFF {
+				checksums = &PatchInfo{
+					OriginalLength:   patch.OriginalLength,
+					OriginalChecksum: hex.EncodeToString(patch.OriginalChecksum[:]),
+					PatchedLength:    patch.PatchedLength,
+					PatchedChecksum:  hex.EncodeToString(patch.PatchedChecksum[:]),
+				}
+			}
+			result, detected, err := applyPatchFormat(c.original, &buf, checksums)
+			if err != nil {
+				t.Fatalf("%s (compat %v): apply %s: %v", c.name, compat, format, err)
+			}
+			if detected != format {
+				t.Fatalf("%s (compat %v): detected %s instead of %s", c.name, compat, detected, format)
+			}
+			if !bytes.Equal(result, c.modified) {
+				t.Fatalf("%s (compat %v): %s round trip differs from modified file", c.name, compat, format)
+			}
+		}
+	}
+}
+
+// testFormatRejects applies every malformed patch with apply and expects an error containing the given text.
+func testFormatRejects(t *testing.T, apply func([]byte, io.Reader) ([]byte, error), original []byte, tests []malformedPatch) {
+	t.Helper()
+	for _, test := range tests {
+		if _, err := apply(original, bytes.NewReader(test.data)); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+// malformedPatch is a damaged patch and the error applying it must report.
+type malformedPatch struct {
+	name     string
+	data     []byte
+	expected string
+}
+
+// Known answer inputs: "hello world" patched to "hello WORLD"
+var (
+	knownOriginal = []byte("hello world")
+	knownModified = []byte("hello WORLD")
+)
+
+// knownPatch is the patch of knownOriginal to knownModified.
+func knownPatch(t *testing.T) *PatchFile {
+	t.Helper()
+	patch, err := generatePatch(knownOriginal, knownModified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patch
+}
+
+// mustDecodeHex decodes a hex test vector.
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVCDIFF(t *testing.T) {
+	testFormatRoundTrip(t, FORMAT_VCDIFF, 29)
+
+	// Header, VCD_SOURCE window over the 11 original bytes, COPY 6 from offset 0 then ADD "WORLD"
+	known := mustDecodeHex(t, "D6C3C400 00 01 0B 00 0D 0B 00 05 02 01 574F524C44 16 06 00")
+	var buf bytes.Buffer
+	if err := writeVCDIFF(knownPatch(t), knownOriginal, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), known) {
+		t.Fatalf("unexpected vcdiff encoding: %X", buf.Bytes())
+	}
+	if result, err := applyVCDIFF(knownOriginal, bytes.NewReader(known)); err != nil || !bytes.Equal(result, knownModified) {
+		t.Fatalf("known vcdiff did not apply: %v", err)
+	}
+
+	// The same window with the xdelta3 Adler-32 checksum
+	withAdler := mustDecodeHex(t, "D6C3C400 00 05 0B 00 11 0B 00 05 02 01 182B03BD 574F524C44 16 06 00")
+	if result, err := applyVCDIFF(knownOriginal, bytes.NewReader(withAdler)); err != nil || !bytes.Equal(result, knownModified) {
+		t.Fatalf("vcdiff with checksum did not apply: %v", err)
+	}
+
+	damaged := func(data []byte, offset int, value byte) []byte {
+		damaged := append([]byte{}, data...)
+		damaged[offset] = value
+		return damaged
+	}
+	tests := []malformedPatch{
+		{"bad magic", damaged(known, 0, 0xD7), "invalid vcdiff file format"},
+		{"secondary compression", damaged(known, 4, VCD_DECOMPRESS), "secondary compression"},
+		{"varint too long", append(append([]byte{}, known[:6]...), bytes.Repeat([]byte{0x80}, 10)...), "integer too long"},
+		{"source segment past end", damaged(known, 6, 0x0C), "source segment out of range"},
+		{"copy address past end", damaged(known, 21, 0x0B), "copy address out of range"},
+		{"instructions past window", damaged(known, 9, 0x0A), "instructions exceed target window"},
+		{"short window", damaged(known, 9, 0x0C), "target window length mismatch"},
+		{"add past data", damaged(known, 11, 0x04), "unexpected EOF"},
+		{"bad checksum", damaged(withAdler, 17, 0xBE), "window checksum mismatch"},
+	}
+	// Cutting a delta anywhere past its magic and Hdr_Indicator leaves a window incomplete
+	for n := len(VCDIFF_MAGIC) + 2; n < len(known); n++ {
+		tests = append(tests, malformedPatch{fmt.Sprintf("truncated to %d bytes", n), known[:n], ""})
+	}
+	testFormatRejects(t, applyVCDIFF, knownOriginal, tests)
+}
+
+func TestBPS(t *testing.T) {
+	testFormatRoundTrip(t, FORMAT_BPS, 30)
+
+	// Sizes 11, 11 and 0, SourceRead 6, TargetRead "WORLD", then the three CRC32s
+	known := mustDecodeHex(t, "42505331 8B 8B 80 94 91 574F524C44 85114A0D 35D31EFA B38E87CF")
+	var buf bytes.Buffer
+	if err := writeBPS(knownPatch(t), knownOriginal, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), known) {
+		t.Fatalf("unexpected bps encoding: %X", buf.Bytes())
+	}
+	if result, err := applyBPS(knownOriginal, bytes.NewReader(known)); err != nil || !bytes.Equal(result, knownModified) {
+		t.Fatalf("known bps did not apply: %v", err)
+	}
+
+	// Bodies with valid CRC32s, so the actions themselves are checked
+	withCRCs := func(body string) []byte {
+		return appendPatchCRCs(mustDecodeHex(t, body), knownOriginal, knownModified)
+	}
+	damaged := append([]byte{}, known...)
+	damaged[10] ^= 0xFF
+
+	tests := []malformedPatch{
+		{"bad magic", append([]byte("BPS2"), known[4:]...), "invalid bps file format"},
+		{"bad patch checksum", damaged, "patch file is corrupt: patch checksum mismatch"},
+		{"bad varint", withCRCs("42505331 8B 8B 80 00000000000000000000"), "integer too long"},
+		{"source size", withCRCs("42505331 8C 8B 80 94 91 574F524C44"), "original file length mismatch"},
+		{"source read past end", withCRCs("42505331 8B 8C 80 AC"), "bps source read out of range"},
+		{"target copy before output", withCRCs("42505331 8B 8B 80 83 80"), "bps target copy out of range"},
+		{"source copy past end", withCRCs("42505331 8B 8B 80 82 96"), "bps source copy out of range"},
+		{"actions past target", withCRCs("42505331 8B 8B 80 AC"), "bps actions exceed target size"},
+		{"target read past data", withCRCs("42505331 8B 8B 80 94 91 574F52"), "unexpected EOF"},
+		{"short output", withCRCs("42505331 8B 8B 80 94"), "patched file length mismatch"},
+		{"bad target checksum", withCRCs("42505331 8B 8B 80 94 91 574F524C45"), "patched file checksum mismatch"},
+	}
+	for n := 0; n < len(known); n++ {
+		tests = append(tests, malformedPatch{fmt.Sprintf("truncated to %d bytes", n), known[:n], ""})
+	}
+	testFormatRejects(t, applyBPS, knownOriginal, tests)
+	if _, err := applyBPS([]byte("hello there"), bytes.NewReader(known)); err == nil || !strings.Contains(err.Error(), "original file checksum mismatch") {
+		t.Fatalf("expected an original checksum error, got %v", err)
+	}
+}
+
+func TestUPS(t *testing.T) {
+	testFormatRoundTrip(t, FORMAT_UPS, 31)
+
+	// Sizes 11 and 11, skip 6, XOR 0x20 over "world" and a terminator, then the three CRC32s
+	known := mustDecodeHex(t, "55505331 8B 8B 86 2020202020 00 85114A0D 35D31EFA BA1A3240")
+	var buf bytes.Buffer
+	if err := writeUPS(knownPatch(t), knownOriginal, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), known) {
+		t.Fatalf("unexpected ups encoding: %X", buf.Bytes())
+	}
+	if result, err := applyUPS(knownOriginal, bytes.NewReader(known)); err != nil || !bytes.Equal(result, knownModified) {
+		t.Fatalf("known ups did not apply: %v", err)
+	}
+
+	withCRCs := func(body string) []byte {
+		return appendPatchCRCs(mustDecodeHex(t, body), knownOriginal, knownModified)
+	}
+	damaged := append([]byte{}, known...)
+	damaged[8] ^= 0xFF
+
+	tests := []malformedPatch{
+		{"bad magic", append([]byte("UPS2"), known[4:]...), "invalid ups file format"},
+		{"bad patch checksum", damaged, "patch file is corrupt: patch checksum mismatch"},
+		{"bad varint", withCRCs("55505331 8B 8B 00000000000000000000"), "integer too long"},
+		{"input size", withCRCs("55505331 8C 8B 86 2020202020 00"), "original file length mismatch"},
+		{"unterminated hunk", withCRCs("55505331 8B 8B 86 2020202020"), "unexpected EOF"},
+		{"bad output checksum", withCRCs("55505331 8B 8B 86 2020202021 00"), "patched file checksum mismatch"},
+	}
+	for n := 0; n < len(known); n++ {
+		tests = append(tests, malformedPatch{fmt.Sprintf("truncated to %d bytes", n), known[:n], ""})
+	}
+	testFormatRejects(t, applyUPS, knownOriginal, tests)
+	if _, err := applyUPS([]byte("hello there"), bytes.NewReader(known)); err == nil || !strings.Contains(err.Error(), "original file checksum mismatch") {
+		t.Fatalf("expected an original checksum error, got %v", err)
+	}
+}
+
+func TestIPS(t *testing.T) {
+	testFormatRoundTrip(t, FORMAT_IPS, 32)
+
+	// One record writing "WORLD" at offset 6
+	known := mustDecodeHex(t, "5041544348 000006 0005 574F524C44 454F46")
+	var buf bytes.Buffer
+	if err := writeIPS(knownPatch(t), knownOriginal, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), known) {
+		t.Fatalf("unexpected ips encoding: %X", buf.Bytes())
+	}
+
+	// Run length records and the truncation extension are only read
+	applies := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"record", known, "hello WORLD"},
+		{"run length record", mustDecodeHex(t, "5041544348 000000 0000 0003 41 454F46"), "AAAlo world"},
+		{"growth", mustDecodeHex(t, "5041544348 00000B 0001 21 454F46"), "hello world!"},
+		{"truncation", mustDecodeHex(t, "5041544348 454F46 000005"), "hello"},
+	}
+	for _, test := range applies {
+		if result, err := applyIPS(knownOriginal, bytes.NewReader(test.data)); err != nil || string(result) != test.expected {
+			t.Fatalf("%s: got %q, %v", test.name, result, err)
+		}
+	}
+
+	tests := []malformedPatch{
+		{"bad magic", append([]byte("PATCK"), known[5:]...), "invalid ips file format"},
+		{"record past data", mustDecodeHex(t, "5041544348 000006 0006 574F524C44 454F46"), "unexpected EOF"},
+		{"short run length record", mustDecodeHex(t, "5041544348 000000 0000 0003"), "unexpected EOF"},
+	}
+	// Every cut loses the footer
+	for n := 0; n < len(known); n++ {
+		tests = append(tests, malformedPatch{fmt.Sprintf("truncated to %d bytes", n), known[:n], ""})
+	}
+	testFormatRejects(t, applyIPS, knownOriginal, tests)
+
+	// Offsets are 24-bit, so changes past 16 MiB cannot be written
+	large := make([]byte, IPS_MAX_OFFSET+2)
+	modified := append([]byte{}, large...)
+	modified[len(modified)-1] = 1
+	patch, err := generatePatch(large, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeIPS(patch, large, io.Discard); err == nil || !strings.Contains(err.Error(), "24-bit") {
+		t.Fatalf("expected a 24-bit offset error, got %v", err)
+	}
+}
+
+func TestCompressBzip2(t *testing.T) {
+	// An empty stream is only the header, the end of stream magic and a zero CRC, as bzip2 itself writes it
+	if empty := compressBzip2(nil); !bytes.Equal(empty, mustDecodeHex(t, "425A6839 177245385090 00000000")) {
+		t.Fatalf("unexpected empty stream: %X", empty)
+	}
+
+	r := rand.New(rand.NewSource(33))
+	inputs := map[string][]byte{
+		"single byte":   {0x42},
+		"text":          []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 100)),
+		"long runs":     append(bytes.Repeat([]byte{0}, 1000), bytes.Repeat([]byte{0xFF}, 300)...),
+		"random":        randomBytes(r, 50000),
+		"several block": append(randomBytes(r, BZIP2_LEVEL*100000), bytes.Repeat([]byte{7}, 5000)...),
+	}
+	for name, data := range inputs {
+		decoded, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(compressBzip2(data))))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("%s: bzip2 round trip differs", name)
+		}
+	}
+}
+
+func TestBSDIFF(t *testing.T) {
+	testFormatRoundTrip(t, FORMAT_BSDIFF, 34)
+
+	// Written by an independent bzip2 encoder: one control triple (11, 0, 0), the byte differences and no extra bytes
+	known := mustDecodeHex(t, "4253444946463430 2900000000000000 2B00000000000000 0B00000000000000"+
+		"425A6839314159265359435DF3ED000002600040080800200030CC0CF505CE2EE48A70A12086BBE7DA"+
+		"425A6839314159265359250258090000004001700040002000219A68334D02A15E2EE48A70A1204A04B012"+
+		"425A683917724538509000000000")
+	if result, err := applyBSDIFF(knownOriginal, bytes.NewReader(known)); err != nil || !bytes.Equal(result, knownModified) {
+		t.Fatalf("known bsdiff did not apply: %v", err)
+	}
+
+	// Without checksums the patch is refused, since the format cannot tell a wrong original
+	if _, _, err := applyPatchFormat(knownOriginal, bytes.NewReader(known), nil); err == nil || !strings.Contains(err.Error(), "carry no checksums") {
+		t.Fatalf("expected bsdiff to need checksums, got %v", err)
+	}
+
+	// bsdiff builds a patch from a header and three blocks
+	build := func(newSize int64, control []byte, diff, extra []byte) []byte {
+		controlBlock, diffBlock, extraBlock := compressBzip2(control), compressBzip2(diff), compressBzip2(extra)
+		data := []byte(BSDIFF_HEADER)
+		data = appendOfftin(data, int64(len(controlBlock)))
+		data = appendOfftin(data, int64(len(diffBlock)))
+		data = appendOfftin(data, newSize)
+		return append(append(append(data, controlBlock...), diffBlock...), extraBlock...)
+	}
+	triple := func(diffSize, extraSize, seek int64) []byte {
+		return appendOfftin(appendOfftin(appendOfftin(nil, diffSize), extraSize), seek)
+	}
+	withHeader := func(offset int, value int64) []byte {
+		data := append([]byte{}, known...)
+		copy(data[offset:], appendOfftin(nil, value))
+		return data
+	}
+
+	// A header claiming 4 GiB with nothing behind it must fail without allocating it
+	huge := build(1<<32-1, triple(1<<32-1, 0, 0), nil, nil)
+	tests := []malformedPatch{
+		{"bad magic", append([]byte("BSDIFF41"), known[8:]...), "invalid bsdiff file format"},
+		{"short header", known[:BSDIFF_HEADER_SIZE-1], "invalid bsdiff file format"},
+		{"control past end", withHeader(8, int64(len(known))), "bsdiff block lengths out of range"},
+		{"negative diff length", withHeader(16, -1), "bsdiff block lengths out of range"},
+		{"new size too large", withHeader(24, 1<<32), "bsdiff new size"},
+		{"control past new size", build(11, triple(12, 0, 0), make([]byte, 12), nil), "bsdiff control data out of range"},
+		{"negative extra", build(11, triple(11, -1, 0), make([]byte, 11), nil), "bsdiff control data out of range"},
+		{"short control", build(11, triple(11, 0, 0)[:20], make([]byte, 11), nil), "error reading bsdiff control block"},
+		{"short diff", build(11, triple(11, 0, 0), make([]byte, 10), nil), "error reading bsdiff diff block"},
+		{"short extra", build(11, triple(6, 5, 0), make([]byte, 6), []byte("WOR")), "error reading bsdiff extra block"},
+		{"huge new size", huge, "error reading bsdiff diff block"},
+	}
+	// The extra block of the vector is never read, so only cuts into the control and diff blocks show
+	for n := BSDIFF_HEADER_SIZE; n < len(known)-len(compressBzip2(nil)); n++ {
+		tests = append(tests, malformedPatch{fmt.Sprintf("truncated to %d bytes", n), known[:n], ""})
+	}
+	testFormatRejects(t, applyBSDIFF, knownOriginal, tests)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, []byte("old content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only path itself may remain in the directory after each write
+	expectOnly := func(content string) {
+		t.Helper()
+		if data, err := os.ReadFile(path); err != nil || string(data) != content {
+			t.Fatalf("file holds %q, expected %q (%v)", data, content, err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Fatalf("temporary files left behind: %v", entries)
+		}
+	}
+
+	// A failing write leaves the old file as it was
+	err := writeFileAtomic(path, func(writer io.Writer) error {
+		writer.Write([]byte("partial"))
+		return errors.New("write interrupted")
+	})
+	if err == nil || err.Error() != "write interrupted" {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	expectOnly("old content")
+
+	// Bytes that change on their way to disk fail the read-back check
+	err = writeFileAtomic(path, func(writer io.Writer) error {
+		writer.Write([]byte("new content"))
+		if err := writer.(*bufio.Writer).Flush(); err != nil {
+			return err
+		}
+		temps, _ := filepath.Glob(filepath.Join(dir, ".data.bin.tmp-*"))
+		if len(temps) != 1 {
+			return fmt.Errorf("found %d temporary files", len(temps))
+		}
+		file, err := os.OpenFile(temps[0], os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = file.WriteAt([]byte("N"), 0)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "written file checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	expectOnly("old content")
+
+	// A successful write replaces the content and keeps the mode
+	if err := writeBytesAtomic(path, []byte("new content")); err != nil {
+		t.Fatal(err)
+	}
+	expectOnly("new content")
+	if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Fatalf("mode changed to %v", info.Mode().Perm())
+	}
+
+	// Directories are never replaced
+	if err := writeBytesAtomic(dir, []byte("x")); err == nil || !strings.Contains(err.Error(), "not a regular file") {
+		t.Fatalf("expected a regular file error, got %v", err)
+	}
+}
+
+func TestTransactionRecovery(t *testing.T) {
+	r := rand.New(rand.NewSource(35))
+	beforeA, beforeB := randomBytes(r, 3000), randomBytes(r, 2000)
+	afterA, afterB := mutate(r, beforeA, 10), mutate(r, beforeB, 10)
+
+	// setup starts a transaction patching a.bin and b.bin and stops it after a.bin,
+	// as if the process died midway. It returns the game directory.
+	setup := func(t *testing.T) string {
+		t.Helper()
+		dir, patches := t.TempDir(), t.TempDir()
+		os.WriteFile(filepath.Join(dir, "a.bin"), beforeA, 0644)
+		os.WriteFile(filepath.Join(dir, "b.bin"), beforeB, 0644)
+		writeTestPatch(t, filepath.Join(patches, "a.mtgadiff"), beforeA, afterA, 0)
+		writeTestPatch(t, filepath.Join(patches, "b.mtgadiff"), beforeB, afterB, 0)
+
+		planPath := filepath.Join(patches, "plan.json")
+		os.WriteFile(planPath, []byte(`{"files": [{"path": "a.bin", "patch": "a.mtgadiff"}, {"path": "b.bin", "patch": "b.mtgadiff"}]}`), 0644)
+		journal, err := prepareTransaction(dir, planPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeJournal(dir, journal); err != nil {
+			t.Fatal(err)
+		}
+		first := &journal.Entries[0]
+		if err := writeBytesAtomic(filepath.Join(dir, first.Backup), beforeA); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyJournalEntry(dir, first, beforeA); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := applyTransaction(&CLIOptions{gameDir: dir, planPath: planPath}); err == nil || !strings.Contains(err.Error(), "interrupted transaction") {
+			t.Fatalf("expected the journal to block a new transaction, got %v", err)
+		}
+		return dir
+	}
+
+	// expectSettled checks the files and that no journal or backup is left
+	expectSettled := func(t *testing.T, dir string, a, b []byte) {
+		t.Helper()
+		if data, _ := os.ReadFile(filepath.Join(dir, "a.bin")); !bytes.Equal(data, a) {
+			t.Fatal("a.bin does not hold the expected content")
+		}
+		if data, _ := os.ReadFile(filepath.Join(dir, "b.bin")); !bytes.Equal(data, b) {
+			t.Fatal("b.bin does not hold the expected content")
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+			t.Fatalf("journal or backups left behind: %v", entries)
+		}
+	}
+
+	t.Run("rollback", func(t *testing.T) {
+		dir := setup(t)
+		if err := applyTransaction(&CLIOptions{gameDir: dir, recoverMode: RECOVER_ROLLBACK}); err != nil {
+			t.Fatal(err)
+		}
+		expectSettled(t, dir, beforeA, beforeB)
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		dir := setup(t)
+		if err := applyTransaction(&CLIOptions{gameDir: dir, recoverMode: RECOVER_FORWARD}); err != nil {
+			t.Fatal(err)
+		}
+		expectSettled(t, dir, afterA, afterB)
+	})
+
+	// A file matching neither checksum is restored from its backup before settling
+	for _, mode := range []string{RECOVER_ROLLBACK, RECOVER_FORWARD} {
+		t.Run("damaged "+mode, func(t *testing.T) {
+			dir := setup(t)
+			os.WriteFile(filepath.Join(dir, "a.bin"), []byte("half written"), 0644)
+			if err := applyTransaction(&CLIOptions{gameDir: dir, recoverMode: mode}); err != nil {
+				t.Fatal(err)
+			}
+			if mode == RECOVER_ROLLBACK {
+				expectSettled(t, dir, beforeA, beforeB)
+			} else {
+				expectSettled(t, dir, afterA, afterB)
+			}
+		})
+	}
+
+	t.Run("damaged without backup", func(t *testing.T) {
+		dir := setup(t)
+		os.WriteFile(filepath.Join(dir, "a.bin"), []byte("half written"), 0644)
+		os.Remove(filepath.Join(dir, "a.bin"+BACKUP_EXTENSION))
+		if err := applyTransaction(&CLIOptions{gameDir: dir, recoverMode: RECOVER_ROLLBACK}); err == nil || !strings.Contains(err.Error(), "no valid backup") {
+			t.Fatalf("expected recovery to stop, got %v", err)
+		}
+		if _, err := os.Stat(journalPath(dir)); err != nil {
+			t.Fatal("the journal was removed although recovery failed")
+		}
+	})
+}
+
+func TestTransactionRollsBackOnError(t *testing.T) {
+	r := rand.New(rand.NewSource(36))
+	beforeA, beforeB := randomBytes(r, 3000), randomBytes(r, 2000)
+	afterA, afterB := mutate(r, beforeA, 10), mutate(r, beforeB, 10)
+
+	dir, patches := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.bin"), beforeA, 0644)
+	os.WriteFile(filepath.Join(dir, "b.bin"), beforeB, 0644)
+	writeTestPatch(t, filepath.Join(patches, "a.mtgadiff"), beforeA, afterA, 0)
+
+	// Valid checksums, but an item past the end of the patched file
+	broken, err := generatePatch(beforeB, afterB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.PatchItems = append(broken.PatchItems, PatchItem{Offset: 0xFFFFFF00, Content: []byte{1}})
+	var buf bytes.Buffer
+	if err := writePatchFile(broken, &buf); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(patches, "b.mtgadiff"), buf.Bytes(), 0644)
+
+	planPath := filepath.Join(patches, "plan.json")
+	os.WriteFile(planPath, []byte(`{"files": [{"path": "a.bin", "patch": "a.mtgadiff"}, {"path": "b.bin", "patch": "b.mtgadiff"}]}`), 0644)
+	if err := applyTransaction(&CLIOptions{gameDir: dir, planPath: planPath}); err == nil || !strings.Contains(err.Error(), "error applying patch to b.bin") {
+		t.Fatalf("expected the second patch to fail, got %v", err)
+	}
+
+	// The first file is restored and neither the journal nor a backup is left
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.bin")); !bytes.Equal(data, beforeA) {
+		t.Fatal("a.bin was not rolled back")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "b.bin")); !bytes.Equal(data, beforeB) {
+		t.Fatal("b.bin changed although its patch failed")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("journal or backups left behind: %v", entries)
+	}
+}
+
+func TestPrepareTransactionRejectsDuplicatePaths(t *testing.T) {
+	dir, patches := t.TempDir(), t.TempDir()
+	original := []byte("original file")
+	os.WriteFile(filepath.Join(dir, "a.bin"), original, 0644)
+	writeTestPatch(t, filepath.Join(patches, "a.mtgadiff"), original, []byte("modified file"), 0)
+
+	planPath := filepath.Join(patches, "plan.json")
+	os.WriteFile(planPath, []byte(`{"files": [{"path": "a.bin", "patch": "a.mtgadiff"}, {"path": "./a.bin", "patch": "a.mtgadiff"}]}`), 0644)
+	if _, err := prepareTransaction(dir, planPath); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatalf("expected a duplicate path error, got %v", err)
+	}
+}
+
+func TestRebaseSignatures(t *testing.T) {
+	rules, err := parseSignatureRules(strings.NewReader("find AA ?? CC\nreplace ?? 00 ??\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signature-only patches carry over unchanged and still apply to the new build
+	signatureOnly := &PatchFile{Flags: DEFAULT_PATCH_FLAGS | FLAG_SIGNATURES, PatchItems: []PatchItem{}, Signatures: rules}
+	newBuild := []byte{0x09, 0x09, 0xAA, 0x66, 0xCC}
+	rebased, hunks, err := rebasePatch([]byte{0x01, 0xAA, 0x55, 0xCC}, newBuild, signatureOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebased != signatureOnly || len(hunks) != 0 {
+		t.Fatal("signature-only patch was not passed through")
+	}
+	if result, err := applyPatch(newBuild, rebased); err != nil || result[3] != 0x00 {
+		t.Fatalf("passed through patch did not apply: %v", err)
+	}
+
+	// A patch with items and rules keeps the rules, which run on the rebased items
+	r := rand.New(rand.NewSource(36))
+	oldOriginal := randomBytes(r, 5000)
+	copy(oldOriginal[4000:], []byte{0xAA, 0x55, 0xCC})
+	modified := append([]byte{}, oldOriginal...)
+	copy(modified[1000:], "item")
+
+	patch, err := generatePatch(oldOriginal, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final := append([]byte{}, modified...)
+	final[4001] = 0x00
+	patch.Flags |= FLAG_SIGNATURES
+	patch.Signatures = rules
+	patch.PatchedChecksum = sha256.Sum256(final)
+
+	// The update inserts bytes before the item and the signature
+	newOriginal := append(append(append([]byte{}, oldOriginal[:500]...), randomBytes(r, 40)...), oldOriginal[500:]...)
+	rebased, _, err = rebasePatch(oldOriginal, newOriginal, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebased.Flags&FLAG_SIGNATURES == 0 || len(rebased.Signatures) != 1 {
+		t.Fatal("rebased patch lost its signatures")
+	}
+
+	var buf bytes.Buffer
+	if err := writePatchFile(rebased, &buf); err != nil {
+		t.Fatal(err)
+	}
+	readPatch, err := readPatchFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := applyPatch(newOriginal, readPatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append(append([]byte{}, final[:500]...), newOriginal[500:540]...), final[500:]...)
+	if !bytes.Equal(result, expected) {
+		t.Fatal("rebased patch did not apply both the item and the signature")
+	}
+
+	// Rules that no longer match the new original fail the rebase
+	copy(newOriginal[4040:], []byte{0x00, 0x00, 0x00})
+	if _, _, err := rebasePatch(oldOriginal, newOriginal, patch); err == nil || !strings.Contains(err.Error(), "signatures do not apply") {
+		t.Fatalf("expected the signatures to fail, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+
+	"mtgapatcher/logging"
+)
+
+/*
+Reads an input file, memory-mapped when mmap is set.
+
+A mapped file stays out of the Go heap and is paged in by the kernel as it
+is read. Stdin, pipes, empty files and platforms without mmap fall back to
+readFileWithFileRead. The returned release function unmaps the file; the
+data must not be used after calling it.
+
+The file must not be truncated while mapped, or reading it faults.
+*/
+func readInputFile(filePath string, mmap bool) ([]byte, func(), error) {
+	defer logging.Trace("readInputFile")()
+
+	if mmap && filePath != STDIO_PATH {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer file.Close()
+
+		stat, err := file.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if stat.Mode().IsRegular() && stat.Size() > 0 {
+			data, unmap, err := mapFile(file, stat.Size())
+			if err == nil {
+				release := func() {
+					if err := unmap(); err != nil {
+						logging.Debug("Error unmapping file", "path", filePath, "error", err)
+					}
+				}
+				return data, release, nil
+			}
+			logging.Debug("Memory mapping failed, reading file instead", "path", filePath, "error", err)
+		}
+	}
+
+	data, err := readFileWithFileRead(filePath)
+	return data, func() {}, err
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+Maps size bytes of file into memory.
+
+The mapping is private and writable: callers that patch a buffer in place
+(signatures do) get copy-on-write pages and never touch the file itself.
+*/
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
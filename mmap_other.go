@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile is only implemented on Linux; readInputFile falls back to reading the file.
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errors.New("memory mapping is not supported on this platform")
+}
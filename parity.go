@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	PARITY_MAGIC       = "MTGAPRTY"
+	PARITY_CODEWORD    = 255                           // Reed-Solomon codeword length over GF(256)
+	PARITY_FOOTER_SIZE = 8 + 1 + 4 + len(PARITY_MAGIC) // Data length, parity symbols, CRC32, magic
+	MAX_PARITY_PERCENT = 100                           // Parity at most as large as the data it protects
+	GF_PRIMITIVE       = 0x11D                         // x^8 + x^4 + x^3 + x^2 + 1
+)
+
+var gfExp [2 * PARITY_CODEWORD]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < PARITY_CODEWORD; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= GF_PRIMITIVE
+		}
+	}
+	// Doubled so products of two logarithms need no modulo
+	for i := PARITY_CODEWORD; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-PARITY_CODEWORD]
+	}
+}
+
+func gfMul(x, y byte) byte {
+	if x == 0 || y == 0 {
+		return 0
+	}
+	return gfExp[gfLog[x]+gfLog[y]]
+}
+
+func gfDiv(x, y byte) byte {
+	if x == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[x]+PARITY_CODEWORD-gfLog[y])%PARITY_CODEWORD]
+}
+
+func gfPow(x byte, power int) byte {
+	exponent := (gfLog[x] * power) % PARITY_CODEWORD
+	if exponent < 0 {
+		exponent += PARITY_CODEWORD
+	}
+	return gfExp[exponent]
+}
+
+// Polynomials are stored highest degree first.
+
+func polyScale(p []byte, x byte) []byte {
+	result := make([]byte, len(p))
+	for i, coef := range p {
+		result[i] = gfMul(coef, x)
+	}
+	return result
+}
+
+func polyAdd(p, q []byte) []byte {
+	result := make([]byte, max(len(p), len(q)))
+	copy(result[len(result)-len(p):], p)
+	for i, coef := range q {
+		result[len(result)-len(q)+i] ^= coef
+	}
+	return result
+}
+
+func polyMul(p, q []byte) []byte {
+	result := make([]byte, len(p)+len(q)-1)
+	for i, a := range p {
+		for j, b := range q {
+			result[i+j] ^= gfMul(a, b)
+		}
+	}
+	return result
+}
+
+func polyEval(p []byte, x byte) byte {
+	y := p[0]
+	for _, coef := range p[1:] {
+		y = gfMul(y, x) ^ coef
+	}
+	return y
+}
+
+// rsGenerator returns the generator polynomial of a code with nsym parity symbols.
+func rsGenerator(nsym int) []byte {
+	generator := []byte{1}
+	for i := 0; i < nsym; i++ {
+		generator = polyMul(generator, []byte{1, gfPow(2, i)})
+	}
+	return generator
+}
+
+// rsEncode returns the parity symbols of message for the given generator polynomial.
+func rsEncode(message, generator []byte) []byte {
+	remainder := make([]byte, len(message)+len(generator)-1)
+	copy(remainder, message)
+	for i := range message {
+		coef := remainder[i]
+		if coef == 0 {
+			continue
+		}
+		for j := 1; j < len(generator); j++ {
+			remainder[i+j] ^= gfMul(generator[j], coef)
+		}
+	}
+	return remainder[len(message):]
+}
+
+/*
+Corrects a codeword (message followed by nsym parity symbols) in place.
+
+Finds the error locator with Berlekamp-Massey, the error positions with a
+Chien search and the error magnitudes with Forney's algorithm. Returns the
+positions corrected, or an error when more than nsym/2 symbols are damaged.
+*/
+func rsCorrect(codeword []byte, nsym int) ([]int, error) {
+	// Syndromes, with a leading zero so index i holds S(i-1)
+	syndromes := make([]byte, nsym+1)
+	damaged := false
+	for i := 0; i < nsym; i++ {
+		syndromes[i+1] = polyEval(codeword, gfPow(2, i))
+		damaged = damaged || syndromes[i+1] != 0
+	}
+	if !damaged {
+		return nil, nil
+	}
+
+	// Berlekamp-Massey
+	locator, previous := []byte{1}, []byte{1}
+	for i := 0; i < nsym; i++ {
+		k := i + 1
+		delta := syndromes[k]
+		for j := 1; j < len(locator); j++ {
+			delta ^= gfMul(locator[len(locator)-1-j], syndromes[k-j])
+		}
+		previous = append(previous, 0)
+		if delta != 0 {
+			if len(previous) > len(locator) {
+				scaled := polyScale(previous, delta)
+				previous = polyScale(locator, gfDiv(1, delta))
+				locator = scaled
+			}
+			locator = polyAdd(locator, polyScale(previous, delta))
+		}
+	}
+	for len(locator) > 0 && locator[0] == 0 {
+		locator = locator[1:]
+	}
+	errorCount := len(locator) - 1
+	if errorCount*2 > nsym {
+		return nil, errors.New("too many errors to correct")
+	}
+
+	// Chien search over the reversed locator
+	reversed := make([]byte, len(locator))
+	for i, coef := range locator {
+		reversed[len(locator)-1-i] = coef
+	}
+	var positions []int
+	for i := 0; i < len(codeword); i++ {
+		if polyEval(reversed, gfPow(2, i)) == 0 {
+			positions = append(positions, len(codeword)-1-i)
+		}
+	}
+	if len(positions) != errorCount {
+		return nil, errors.New("could not locate errors")
+	}
+
+	// Forney: errata locator and evaluator from the coefficient degrees of the errors
+	degrees := make([]int, len(positions))
+	errata := []byte{1}
+	for i, position := range positions {
+		degrees[i] = len(codeword) - 1 - position
+		errata = polyMul(errata, polyAdd([]byte{1}, []byte{gfPow(2, degrees[i]), 0}))
+	}
+
+	reversedSyndromes := make([]byte, len(syndromes))
+	for i, s := range syndromes {
+		reversedSyndromes[len(syndromes)-1-i] = s
+	}
+	product := polyMul(reversedSyndromes, errata)
+	evaluator := product[max(0, len(product)-len(errata)):]
+
+	roots := make([]byte, len(degrees))
+	for i, degree := range degrees {
+		roots[i] = gfPow(2, degree)
+	}
+	for i, root := range roots {
+		inverse := gfDiv(1, root)
+
+		derivative := byte(1)
+		for j, other := range roots {
+			if j != i {
+				derivative = gfMul(derivative, 1^gfMul(inverse, other))
+			}
+		}
+		if derivative == 0 {
+			return nil, errors.New("could not compute error magnitude")
+		}
+
+		magnitude := gfDiv(gfMul(root, polyEval(evaluator, inverse)), derivative)
+		codeword[positions[i]] ^= magnitude
+	}
+
+	// The correction must leave a valid codeword
+	for i := 0; i < nsym; i++ {
+		if polyEval(codeword, gfPow(2, i)) != 0 {
+			return nil, errors.New("correction failed")
+		}
+	}
+
+	return positions, nil
+}
+
+// parseParityPercent accepts "10%" or "10" and returns the parity size as a percentage of the data.
+func parseParityPercent(s string) (int, error) {
+	percent, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid parity %q, expected a percentage such as 10%%", errInvalidArguments, s)
+	}
+	if percent < 1 || percent > MAX_PARITY_PERCENT {
+		return 0, fmt.Errorf("%w: parity must be between 1%% and %d%%", errInvalidArguments, MAX_PARITY_PERCENT)
+	}
+	return percent, nil
+}
+
+// paritySymbols returns the parity symbols per codeword giving roughly percent parity over the data symbols.
+func paritySymbols(percent int) int {
+	nsym := (PARITY_CODEWORD*percent + 100 + percent - 1) / (100 + percent)
+	return max(nsym, 2)
+}
+
+// parityCodewords returns how many codewords protect length bytes when each carries nsym parity symbols.
+func parityCodewords(length, nsym int) int {
+	dataSymbols := PARITY_CODEWORD - nsym
+	return max((length+dataSymbols-1)/dataSymbols, 1)
+}
+
+/*
+Appends a Reed-Solomon parity trailer to data.
+
+Data byte i belongs to codeword i % codewords, so a burst of damaged bytes
+is spread over many codewords, each of which can correct nsym/2 bytes.
+Trailer layout:
+
+ 1. Parity: symbol s of codeword j at s*codewords + j
+ 2. Data length: uint64 (8 bytes, big-endian)
+ 3. Parity symbols per codeword: uint8
+ 4. CRC32 of the two fields above: uint32 (4 bytes, big-endian)
+ 5. Magic: "MTGAPRTY" (8 bytes)
+*/
+func appendParity(data []byte, nsym int) []byte {
+	defer logging.Trace("append parity")()
+
+	codewords := parityCodewords(len(data), nsym)
+	dataSymbols := PARITY_CODEWORD - nsym
+	generator := rsGenerator(nsym)
+
+	parity := make([]byte, nsym*codewords)
+	message := make([]byte, dataSymbols)
+	for j := 0; j < codewords; j++ {
+		for i := range message {
+			message[i] = 0
+			if index := i*codewords + j; index < len(data) {
+				message[i] = data[index]
+			}
+		}
+		for s, symbol := range rsEncode(message, generator) {
+			parity[s*codewords+j] = symbol
+		}
+	}
+
+	result := make([]byte, 0, len(data)+len(parity)+PARITY_FOOTER_SIZE)
+	result = append(result, data...)
+	result = append(result, parity...)
+	return append(result, parityFooter(uint64(len(data)), nsym)...)
+}
+
+func parityFooter(length uint64, nsym int) []byte {
+	footer := binary.BigEndian.AppendUint64(nil, length)
+	footer = append(footer, byte(nsym))
+	footer = binary.BigEndian.AppendUint32(footer, crc32.ChecksumIEEE(footer))
+	return append(footer, PARITY_MAGIC...)
+}
+
+// hasParity reports whether data ends with a parity trailer.
+func hasParity(data []byte) bool {
+	return len(data) >= PARITY_FOOTER_SIZE && bytes.HasSuffix(data, []byte(PARITY_MAGIC))
+}
+
+/*
+Repairs data protected by a parity trailer and returns it without the trailer.
+
+Data without a trailer is returned unchanged. Otherwise every codeword is
+checked and corrected; the number of bytes fixed, in the data or the parity
+itself, is returned alongside the data and the parity symbols per codeword.
+*/
+func repairPatchData(data []byte) ([]byte, int, int, error) {
+	if !hasParity(data) {
+		return data, 0, 0, nil
+	}
+	defer logging.Trace("repair patch data")()
+
+	// Read and check the footer
+	footer := data[len(data)-PARITY_FOOTER_SIZE:]
+	fields := footer[:9]
+	if binary.BigEndian.Uint32(footer[9:13]) != crc32.ChecksumIEEE(fields) {
+		return nil, 0, 0, fmt.Errorf("%w: parity trailer is damaged", errCorruptPatch)
+	}
+	length := binary.BigEndian.Uint64(fields[:8])
+	nsym := int(fields[8])
+	if nsym < 2 || nsym >= PARITY_CODEWORD {
+		return nil, 0, 0, fmt.Errorf("%w: invalid parity symbols per codeword: %d", errCorruptPatch, nsym)
+	}
+
+	available := uint64(len(data) - PARITY_FOOTER_SIZE)
+	if length > available {
+		return nil, 0, 0, fmt.Errorf("%w: parity trailer does not match the file size", errCorruptPatch)
+	}
+	codewords := parityCodewords(int(length), nsym)
+	if uint64(nsym*codewords) != available-length {
+		return nil, 0, 0, fmt.Errorf("%w: parity trailer does not match the file size", errCorruptPatch)
+	}
+
+	repaired := append([]byte{}, data[:length]...)
+	parity := append([]byte{}, data[length:available]...)
+	dataSymbols := PARITY_CODEWORD - nsym
+
+	corrected := 0
+	codeword := make([]byte, PARITY_CODEWORD)
+	for j := 0; j < codewords; j++ {
+		for i := 0; i < dataSymbols; i++ {
+			codeword[i] = 0
+			if index := i*codewords + j; index < len(repaired) {
+				codeword[i] = repaired[index]
+			}
+		}
+		for s := 0; s < nsym; s++ {
+			codeword[dataSymbols+s] = parity[s*codewords+j]
+		}
+
+		positions, err := rsCorrect(codeword, nsym)
+		if err != nil {
+			return nil, corrected, nsym, fmt.Errorf("%w: codeword %d cannot be repaired: %w", errCorruptPatch, j, err)
+		}
+
+		for _, position := range positions {
+			if position >= dataSymbols {
+				parity[(position-dataSymbols)*codewords+j] = codeword[position]
+				continue
+			}
+			index := position*codewords + j
+			if index >= len(repaired) {
+				return nil, corrected, nsym, fmt.Errorf("codeword %d cannot be repaired: error in padding", j)
+			}
+			repaired[index] = codeword[position]
+		}
+		corrected += len(positions)
+	}
+
+	if corrected > 0 {
+		logging.Warn("Repaired damaged bytes using the parity trailer", "bytes", corrected)
+	}
+	return repaired, corrected, nsym, nil
+}
+
+// repairPatchFile fixes a damaged patch using its parity trailer and writes the repaired patch, trailer included.
+func repairPatchFile(opts *CLIOptions) error {
+	data, release, err := readInputFile(opts.patchPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading patch file: %w", err)
+	}
+	defer release()
+	if !hasParity(data) {
+		return errors.New("patch file has no parity trailer, create it with -parity")
+	}
+
+	repaired, corrected, nsym, err := repairPatchData(data)
+	if err != nil {
+		return err
+	}
+	if err := verifyPatchData(repaired); err != nil {
+		return fmt.Errorf("repaired patch is still corrupt: %w", err)
+	}
+
+	if err := writeBytesAtomic(opts.outputPath, appendParity(repaired, nsym)); err != nil {
+		return fmt.Errorf("error writing patch file: %w", err)
+	}
+
+	recordDetails(map[string]int{"corrected_bytes": corrected, "parity_symbols": nsym})
+	if corrected == 0 {
+		logging.Info("No damage found, patch copied", "output", opts.outputPath)
+		return nil
+	}
+	logging.Info("Successfully repaired patch", "bytes", corrected, "output", opts.outputPath)
+	return nil
+}
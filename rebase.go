@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"mtgapatcher/logging"
+)
+
+const REBASE_CONTEXT_SIZE = 16 // Context taken from the old original for patches that store none
+
+/*
+Re-targets a patch made for oldOriginal so it applies to newOriginal.
+
+Steps:
+
+ 1. Checks the patch was made for oldOriginal
+ 2. Takes the context of every hunk from oldOriginal, unless the patch already stores it
+ 3. Places every hunk in newOriginal by its context, as a fuzzy apply would
+ 4. Diffs newOriginal against the result to build the new patch, keeping the flags of the old one
+ 5. Carries the signature rules over and applies them to the result for the patched checksum
+
+Hunks that cannot be placed are left out of the new patch and reported as failed.
+Signature-only patches find their bytes by pattern in any build, so they are
+returned as they are.
+*/
+func rebasePatch(oldOriginal, newOriginal []byte, patch *PatchFile) (*PatchFile, []HunkResult, error) {
+	defer logging.Trace("rebase patch")()
+
+	if isSignatureOnly(patch) {
+		return patch, nil, nil
+	}
+	if uint32(len(oldOriginal)) != patch.OriginalLength || sha256.Sum256(oldOriginal) != patch.OriginalChecksum {
+		return nil, nil, fmt.Errorf("old original file does not match the patch: %w", errChecksumMismatch)
+	}
+
+	flags := patch.Flags
+	contextSize := REBASE_CONTEXT_SIZE
+	if flags&FLAG_CONTEXT != 0 {
+		contextSize = 0
+		for _, item := range patch.PatchItems {
+			contextSize = max(contextSize, len(item.ContextBefore), len(item.ContextAfter))
+		}
+	} else {
+		anchored := *patch
+		anchored.PatchItems = append([]PatchItem{}, patch.PatchItems...)
+		addPatchContext(&anchored, oldOriginal, contextSize)
+		patch = &anchored
+	}
+
+	modified, results, _, err := placeHunks(newOriginal, patch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rebased, err := generatePatch(newOriginal, modified)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating patch: %w", err)
+	}
+	rebased.Flags = flags&^(FLAG_CONTEXT|FLAG_FULL_FILE) | rebased.Flags&FLAG_FULL_FILE
+	if flags&FLAG_CONTEXT != 0 && contextSize > 0 {
+		addPatchContext(rebased, newOriginal, contextSize)
+	}
+
+	// Rules run after the items, so the patched checksum is taken once they have
+	if flags&FLAG_SIGNATURES != 0 {
+		// Items may share their bytes with modified, so the rules run on a copy
+		patched := append([]byte{}, modified...)
+		if err := applySignatures(patched, patch.Signatures); err != nil {
+			return nil, nil, fmt.Errorf("signatures do not apply to the new original: %w", err)
+		}
+		rebased.Signatures = patch.Signatures
+		rebased.PatchedChecksum = sha256.Sum256(patched)
+	}
+
+	return rebased, results, nil
+}
+
+// rebasePatchFile rebases the patch at opts.patchPath from opts.originalPath onto opts.newPath.
+func rebasePatchFile(opts *CLIOptions) error {
+	// The patch is read first so a corrupt one fails before the originals are loaded
+	patch, err := readPatchPath(opts.patchPath)
+	if err != nil {
+		return err
+	}
+
+	oldOriginal, releaseOld, err := readInputFile(opts.originalPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading old original file: %w", err)
+	}
+	defer releaseOld()
+	newOriginal, releaseNew, err := readInputFile(opts.newPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading new original file: %w", err)
+	}
+	defer releaseNew()
+
+	rebased, results, err := rebasePatch(oldOriginal, newOriginal, patch)
+	if err != nil {
+		return err
+	}
+	reportHunks(results)
+	recordPatch(rebased)
+	recordDetails(map[string]any{"hunks": results})
+
+	err = writeFileAtomic(opts.outputPath, func(writer io.Writer) error {
+		return writePatchFile(rebased, writer)
+	})
+	if err != nil {
+		return fmt.Errorf("error writing patch file: %w", err)
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Status == HUNK_FAILED {
+			failed++
+		}
+	}
+	if failed > 0 {
+		logging.Warn("Some hunks could not be carried over, review the new patch before use", "failed", failed, "hunks", len(results))
+	}
+
+	logging.Info("Successfully rebased patch", "output", opts.outputPath)
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	REPORT_HEATMAP_CELLS = 512 // Cells of the file-wide heatmap, each covering an equal share of the file
+	REPORT_HEX_BYTES     = 32  // Bytes shown per item in the before/after columns
+)
+
+// PatchReport is what the HTML report shows of a patch and the original it applies to.
+type PatchReport struct {
+	Title            string
+	Generated        string
+	PatchPath        string
+	PatchSize        int
+	Format           string
+	Revision         string
+	Flags            []string
+	Derived          bool // Items were recovered by applying a patch in another format and diffing the result
+	OriginalLength   uint32
+	OriginalChecksum string
+	PatchedLength    uint32
+	PatchedChecksum  string
+	WrittenBytes     int // Bytes the items write
+	ChangedBytes     int // Bytes that differ from the original, fewer than written for a full-file patch
+	CellSize         int // Bytes covered by each heatmap cell
+	Heatmap          []ReportCell
+	Items            []ReportItem
+	Signatures       []ReportSignature
+}
+
+// ReportCell is one cell of the heatmap; Level is the share of its bytes changed, from 0 to 1.
+type ReportCell struct {
+	Start   int
+	End     int
+	Changed int
+	Level   float64
+}
+
+// ReportItem is one row of the item table.
+type ReportItem struct {
+	Index     int
+	Offset    uint32
+	Length    int
+	Before    string // Original bytes at the offset, in hex
+	After     string // Bytes written, in hex
+	Truncated bool   // Only the first REPORT_HEX_BYTES are shown
+}
+
+// ReportSignature is one row of the signature table, with ?? for wildcards.
+type ReportSignature struct {
+	Index   int
+	Find    string
+	Replace string
+	Count   uint32
+}
+
+/*
+Renders a self-contained HTML page describing a patch and its original.
+
+Steps:
+
+ 1. Reads the patch; patches in other formats are applied and the result diffed again, as convert does
+ 2. Checks the original against the checksum of the patch
+ 3. Builds the header summary, a heatmap of the changed bytes across the file and the item table
+ 4. Writes the page, with its styles inline, to the -html path
+*/
+func reportPatchFile(opts *CLIOptions) error {
+	defer logging.Trace("report patch")()
+
+	original, releaseOriginal, err := readInputFile(opts.originalPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading original file: %w", err)
+	}
+	defer releaseOriginal()
+	patchData, releasePatch, err := readInputFile(opts.patchPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading patch file: %w", err)
+	}
+	defer releasePatch()
+
+	patch, format, err := readPatchAnyFormat(opts, original, patchData)
+	if err != nil {
+		return err
+	}
+	if !isSignatureOnly(patch) {
+		if uint32(len(original)) != patch.OriginalLength {
+			return fmt.Errorf("original file %w", errLengthMismatch)
+		}
+		if sha256.Sum256(original) != patch.OriginalChecksum {
+			return fmt.Errorf("original file %w", errChecksumMismatch)
+		}
+	}
+
+	report := buildPatchReport(patch, original)
+	report.Title = filepath.Base(opts.patchPath)
+	report.PatchPath = opts.patchPath
+	report.PatchSize = len(patchData)
+	report.Format = format
+	report.Derived = format != FORMAT_MTGADIFF
+	report.Generated = time.Now().UTC().Format(time.RFC3339)
+
+	recordPatch(patch)
+	err = writeFileAtomic(opts.outputPath, func(writer io.Writer) error {
+		return reportTemplate.Execute(writer, report)
+	})
+	if err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+
+	logging.Info("Successfully wrote patch report", "output", opts.outputPath, "items", len(report.Items))
+	return nil
+}
+
+// buildPatchReport fills in everything the report derives from the patch itself.
+func buildPatchReport(patch *PatchFile, original []byte) *PatchReport {
+	report := &PatchReport{
+		Revision:         "1.0",
+		OriginalLength:   patch.OriginalLength,
+		OriginalChecksum: hex.EncodeToString(patch.OriginalChecksum[:]),
+		PatchedLength:    patch.PatchedLength,
+		PatchedChecksum:  hex.EncodeToString(patch.PatchedChecksum[:]),
+	}
+	if patch.Flags != 0 {
+		report.Revision = "1.1"
+	}
+	for _, flag := range []struct {
+		bit  uint32
+		name string
+	}{{FLAG_ITEM_CRC32, "item CRC32"}, {FLAG_PATCH_CHECKSUM, "patch checksum"}, {FLAG_CONTEXT, "context"}, {FLAG_SIGNATURES, "signatures"}, {FLAG_FULL_FILE, "full file"}} {
+		if patch.Flags&flag.bit != 0 {
+			report.Flags = append(report.Flags, flag.name)
+		}
+	}
+
+	for i, item := range patch.PatchItems {
+		shown := min(len(item.Content), REPORT_HEX_BYTES)
+		before := []byte{}
+		if int(item.Offset) < len(original) {
+			before = original[item.Offset:min(int(item.Offset)+shown, len(original))]
+		}
+		report.Items = append(report.Items, ReportItem{
+			Index:     i + 1,
+			Offset:    item.Offset,
+			Length:    len(item.Content),
+			Before:    hexBytes(before),
+			After:     hexBytes(item.Content[:shown]),
+			Truncated: shown < len(item.Content),
+		})
+		report.WrittenBytes += len(item.Content)
+	}
+
+	for i, rule := range patch.Signatures {
+		report.Signatures = append(report.Signatures, ReportSignature{
+			Index:   i + 1,
+			Find:    hexPattern(rule.Pattern, rule.PatternMask),
+			Replace: hexPattern(rule.Replacement, rule.ReplacementMask),
+			Count:   rule.Count,
+		})
+	}
+
+	regions := patchRegions(patch, original)
+	for _, region := range regions {
+		report.ChangedBytes += region.Length
+	}
+	report.CellSize, report.Heatmap = reportHeatmap(regions, max(int(patch.OriginalLength), int(patch.PatchedLength)))
+	return report
+}
+
+// reportHeatmap splits a file of length bytes into cells and counts the changed bytes of regions in each, returning the cell size and the cells.
+func reportHeatmap(regions []DiffRegion, length int) (int, []ReportCell) {
+	if length == 0 {
+		return 0, nil
+	}
+
+	cellSize := max((length+REPORT_HEATMAP_CELLS-1)/REPORT_HEATMAP_CELLS, 1)
+	cells := make([]ReportCell, (length+cellSize-1)/cellSize)
+	for i := range cells {
+		cells[i].Start = i * cellSize
+		cells[i].End = min((i+1)*cellSize, length)
+	}
+
+	for _, region := range regions {
+		start, end := region.Offset, min(region.Offset+region.Length, length)
+		for offset := start; offset < end; {
+			cell := &cells[offset/cellSize]
+			next := min(cell.End, end)
+			cell.Changed += next - offset
+			offset = next
+		}
+	}
+
+	for i := range cells {
+		cells[i].Level = float64(cells[i].Changed) / float64(cells[i].End-cells[i].Start)
+	}
+	return cellSize, cells
+}
+
+// hexBytes formats data as space separated hex pairs.
+func hexBytes(data []byte) string {
+	var text strings.Builder
+	for i, b := range data {
+		if i > 0 {
+			text.WriteByte(' ')
+		}
+		fmt.Fprintf(&text, "%02X", b)
+	}
+	return text.String()
+}
+
+// hexPattern formats a signature pattern the way rules files write it, with ?? where mask is set.
+func hexPattern(data, mask []byte) string {
+	parts := strings.Split(hexBytes(data), " ")
+	for i := range parts {
+		if i < len(mask) && mask[i] != 0 {
+			parts[i] = "??"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// reportTemplate is the report page. It loads nothing from outside, so it can be archived with a release.
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(level float64) string { return fmt.Sprintf("%.1f", level*100) },
+	"opacity": func(level float64) string {
+		if level == 0 {
+			return "0"
+		}
+		return fmt.Sprintf("%.2f", 0.25+0.75*level)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Patch report: {{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f3f3f3; }
+.summary th { width: 12em; }
+.mono { font-family: ui-monospace, monospace; font-size: 0.9em; word-break: break-all; }
+.before { background: #fdecec; }
+.after { background: #e9f7ec; }
+.note { color: #666; }
+.heatmap { display: grid; grid-template-columns: repeat(64, 1fr); gap: 1px; background: #ddd; border: 1px solid #ccc; max-width: 64em; }
+.heatmap div { height: 1em; background: #fff; position: relative; }
+.heatmap div span { position: absolute; inset: 0; background: #d62728; }
+</style>
+</head>
+<body>
+<h1>Patch report: {{.Title}}</h1>
+<p class="note">Generated {{.Generated}} by mtgapatcher.</p>
+
+<h2>Summary</h2>
+<table class="summary">
+<tr><th>Patch</th><td class="mono">{{.PatchPath}} ({{.PatchSize}} bytes)</td></tr>
+<tr><th>Format</th><td>{{.Format}}{{if eq .Format "mtgadiff"}} {{.Revision}}{{end}}{{if .Derived}} <span class="note">(items recovered by applying the patch)</span>{{end}}</td></tr>
+{{if not .Derived}}<tr><th>Flags</th><td>{{range $i, $flag := .Flags}}{{if $i}}, {{end}}{{$flag}}{{else}}none{{end}}</td></tr>{{end}}
+<tr><th>Original</th><td class="mono">{{.OriginalLength}} bytes, SHA-256 {{.OriginalChecksum}}</td></tr>
+<tr><th>Patched</th><td class="mono">{{.PatchedLength}} bytes, SHA-256 {{.PatchedChecksum}}</td></tr>
+<tr><th>Items</th><td>{{len .Items}}, writing {{.WrittenBytes}} bytes and changing {{.ChangedBytes}}</td></tr>
+{{if .Signatures}}<tr><th>Signatures</th><td>{{len .Signatures}}</td></tr>{{end}}
+</table>
+
+{{if .Heatmap}}
+<h2>Changed regions</h2>
+<p class="note">Each cell covers {{.CellSize}} bytes of the file, from left to right and top to bottom; the darker, the more of it the patch changes.</p>
+<div class="heatmap">
+{{range .Heatmap}}<div title="0x{{printf "%08X" .Start}}-0x{{printf "%08X" .End}}: {{.Changed}} bytes changed ({{percent .Level}}%)"><span style="opacity: {{opacity .Level}}"></span></div>
+{{end}}</div>
+{{end}}
+
+<h2>Items</h2>
+{{if .Items}}
+<table>
+<tr><th>#</th><th>Offset</th><th>Length</th><th>Before</th><th>After</th></tr>
+{{range .Items}}<tr><td>{{.Index}}</td><td class="mono">0x{{printf "%08X" .Offset}}</td><td>{{.Length}}</td><td class="mono before">{{.Before}}{{if .Truncated}} …{{end}}</td><td class="mono after">{{.After}}{{if .Truncated}} …{{end}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>The patch has no items.</p>
+{{end}}
+
+{{if .Signatures}}
+<h2>Signatures</h2>
+<table>
+<tr><th>#</th><th>Find</th><th>Replace</th><th>Count</th></tr>
+{{range .Signatures}}<tr><td>{{.Index}}</td><td class="mono">{{.Find}}</td><td class="mono">{{.Replace}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+const (
+	RESULT_OK    = "ok"
+	RESULT_ERROR = "error"
+
+	// Error codes of -json results, matching the error table in godoc.md
+	ERR_INVALID_ARGUMENTS = "ERR_INVALID_ARGUMENTS"
+	ERR_EMPTY_INPUT       = "ERR_EMPTY_INPUT"
+	ERR_CHECKSUM_MISMATCH = "ERR_CHECKSUM_MISMATCH"
+	ERR_VERSION_MISMATCH  = "ERR_VERSION_MISMATCH"
+	ERR_CORRUPT_PATCH     = "ERR_CORRUPT_PATCH"
+	ERR_IO_OPERATION      = "ERR_IO_OPERATION"
+	ERR_OPERATION_FAILED  = "ERR_OPERATION_FAILED"
+)
+
+// CommandResult is the single JSON object a command prints on stdout with -json.
+type CommandResult struct {
+	Command          string       `json:"command"`
+	Status           string       `json:"status"` // RESULT_OK or RESULT_ERROR
+	Original         string       `json:"original,omitempty"`
+	New              string       `json:"new,omitempty"`
+	Patch            string       `json:"patch,omitempty"` // Patch path or URL read
+	Output           string       `json:"output,omitempty"`
+	Format           string       `json:"format,omitempty"`
+	OriginalLength   uint32       `json:"original_length,omitempty"`
+	OriginalChecksum string       `json:"original_checksum,omitempty"` // SHA-256 (hex)
+	PatchedLength    uint32       `json:"patched_length,omitempty"`
+	PatchedChecksum  string       `json:"patched_checksum,omitempty"` // SHA-256 (hex)
+	ItemCount        *int         `json:"item_count,omitempty"`
+	PatchSize        int64        `json:"patch_size,omitempty"` // Size of the patch written
+	DurationMs       float64      `json:"duration_ms"`
+	Error            *ResultError `json:"error,omitempty"`
+	Details          any          `json:"details,omitempty"` // Command specific: hunks, build index, checks...
+}
+
+/*
+Sentinel errors behind the -json error codes.
+
+They are wrapped with %w where a failure is detected, and every error on the
+way up wraps with %w too, so errorCode finds them with errors.Is.
+*/
+var (
+	errInvalidArguments = errors.New("invalid arguments")
+	errEmptyInput       = errors.New("empty input files")
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errLengthMismatch   = errors.New("length mismatch")
+	errVersionMismatch  = errors.New("unsupported patch version")
+	errCorruptPatch     = errors.New("patch file is corrupt")
+)
+
+// ResultError describes why a command failed.
+type ResultError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// commandResult collects the outcome of the command being run, printed by main with -json
+var commandResult = &CommandResult{}
+
+// recordPatch stores the checksums, lengths and item count of the patch a command produced or used.
+func recordPatch(patch *PatchFile) {
+	recordPatchHeader(patch, len(patch.PatchItems))
+}
+
+// recordPatchHeader stores the checksums and lengths of a patch whose items were streamed out rather than kept.
+func recordPatchHeader(patch *PatchFile, items int) {
+	commandResult.OriginalLength = patch.OriginalLength
+	commandResult.OriginalChecksum = hex.EncodeToString(patch.OriginalChecksum[:])
+	commandResult.PatchedLength = patch.PatchedLength
+	commandResult.PatchedChecksum = hex.EncodeToString(patch.PatchedChecksum[:])
+	commandResult.ItemCount = &items
+}
+
+// recordFiles stores the lengths and checksums of the original and patched file of an apply.
+func recordFiles(original, patched []byte) {
+	originalChecksum, patchedChecksum := sha256.Sum256(original), sha256.Sum256(patched)
+	commandResult.OriginalLength = uint32(len(original))
+	commandResult.OriginalChecksum = hex.EncodeToString(originalChecksum[:])
+	commandResult.PatchedLength = uint32(len(patched))
+	commandResult.PatchedChecksum = hex.EncodeToString(patchedChecksum[:])
+}
+
+// recordDetails stores the command specific part of the result.
+func recordDetails(details any) {
+	commandResult.Details = details
+}
+
+/*
+Completes the result of a command and encodes it.
+
+The paths come from the options; a written patch adds its size. A failed
+command gets the error code of the sentinel its error wraps (see errorCode).
+*/
+func finishResult(opts *CLIOptions, started time.Time, err error) []byte {
+	result := commandResult
+	result.Command = opts.mode
+	result.Original = opts.originalPath
+	result.New = opts.newPath
+	result.Patch = opts.patchPath
+	if opts.patchURL != "" {
+		result.Patch = opts.patchURL
+	}
+	result.Output = opts.outputPath
+	if opts.mode == MODE_CREATE || opts.mode == MODE_CONVERT {
+		result.Format = opts.format
+	}
+	result.DurationMs = float64(time.Since(started).Microseconds()) / 1000
+
+	result.Status = RESULT_OK
+	if err != nil {
+		result.Status = RESULT_ERROR
+		code := errorCode(err)
+		if result.Error != nil && result.Error.Code != "" {
+			code = result.Error.Code
+		}
+		result.Error = &ResultError{Code: code, Message: err.Error()}
+	} else if writesPatch(opts.mode) && opts.outputPath != STDIO_PATH {
+		if stat, statErr := os.Stat(opts.outputPath); statErr == nil {
+			result.PatchSize = stat.Size()
+		}
+	}
+
+	data, _ := json.Marshal(result)
+	return append(data, '\n')
+}
+
+func writesPatch(mode string) bool {
+	return mode == MODE_CREATE || mode == MODE_CONVERT || mode == MODE_REBASE || mode == MODE_REPAIR
+}
+
+// errorCodes maps the sentinel errors to codes, checked in order since an error may wrap several
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{errInvalidArguments, ERR_INVALID_ARGUMENTS},
+	{errVersionMismatch, ERR_VERSION_MISMATCH},
+	{errCorruptPatch, ERR_CORRUPT_PATCH},
+	{io.ErrUnexpectedEOF, ERR_CORRUPT_PATCH}, // Inputs are read whole, so only parsing a patch runs out of data
+	{errEmptyInput, ERR_EMPTY_INPUT},
+	{errChecksumMismatch, ERR_CHECKSUM_MISMATCH},
+	{errLengthMismatch, ERR_CHECKSUM_MISMATCH},
+}
+
+// errorCode classifies err for a -json result.
+func errorCode(err error) string {
+	for _, rule := range errorCodes {
+		if errors.Is(err, rule.err) {
+			return rule.code
+		}
+	}
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return ERR_IO_OPERATION
+	}
+	return ERR_OPERATION_FAILED
+}
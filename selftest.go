@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	SELFTEST_SEED       = 1
+	SELFTEST_FILE_SIZE  = 64 * 1024
+	DEFAULT_BENCH_RUNS  = 3
+	MEMORY_SAMPLE_EVERY = 2 * time.Millisecond
+)
+
+// selfTestCase is a synthesized original/modified pair every codec must round-trip.
+type selfTestCase struct {
+	name     string
+	original []byte
+	modified []byte
+}
+
+func selfTestCases() []selfTestCase {
+	r := rand.New(rand.NewSource(SELFTEST_SEED))
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		r.Read(data)
+		return data
+	}
+
+	base := random(SELFTEST_FILE_SIZE)
+	changed := append([]byte{}, base...)
+	for i := 0; i < 100; i++ {
+		changed[r.Intn(len(changed))] ^= byte(1 + r.Intn(255))
+	}
+
+	return []selfTestCase{
+		{"identical", base, append([]byte{}, base...)},
+		{"single byte", []byte{0x01}, []byte{0x02}},
+		{"scattered changes", base, changed},
+		{"growth", base, append(append([]byte{}, changed...), random(SELFTEST_FILE_SIZE/4)...)},
+		{"shrinkage", base, changed[:SELFTEST_FILE_SIZE/2]},
+		{"zero padded growth", base, append(append([]byte{}, base...), make([]byte, 1024)...)},
+		{"completely different", base, random(SELFTEST_FILE_SIZE)},
+	}
+}
+
+/*
+Round-trips synthesized files through every codec path to validate a build.
+
+Steps:
+
+ 1. Synthesizes original/modified pairs: identical, single byte, scattered changes, growth, shrinkage
+ 2. Checks the patch engine, both MTGADIFF readers and writers and every supported patch format
+ 3. Checks atomic writes and file reads against a temporary directory
+ 4. Logs every failure and fails if any path did not reproduce the modified file
+*/
+func selfTest(opts *CLIOptions) error {
+	defer logging.Trace("self test")()
+
+	dir, err := os.MkdirTemp("", "mtgapatcher-selftest-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	checks, failures := 0, 0
+	for _, c := range selfTestCases() {
+		for _, path := range selfTestPaths(dir) {
+			checks++
+			if err := path.check(c.original, c.modified); err != nil {
+				failures++
+				logging.Error("Self test check failed", "case", c.name, "path", path.name, "error", err)
+			}
+		}
+	}
+
+	recordDetails(map[string]int{"checks": checks, "failures": failures})
+	if failures > 0 {
+		return fmt.Errorf("%d of %d self test checks failed", failures, checks)
+	}
+
+	logging.Info("Self test passed", "checks", checks)
+	return nil
+}
+
+// selfTestPath is one way of turning an original and modified file into a patch and back.
+type selfTestPath struct {
+	name  string
+	check func(original, modified []byte) error
+}
+
+func selfTestPaths(dir string) []selfTestPath {
+	paths := []selfTestPath{
+		{"engine", func(original, modified []byte) error {
+			patch, err := generatePatch(original, modified)
+			if err != nil {
+				return err
+			}
+			return expectPatched(applyPatch(original, patch))(modified)
+		}},
+		{"mtgadiff v1", func(original, modified []byte) error {
+			patch, err := generatePatch(original, modified)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := writePatchFile(patch, &buf); err != nil {
+				return err
+			}
+			readPatch, err := readPatchFile(&buf)
+			if err != nil {
+				return err
+			}
+			return expectPatched(applyPatch(original, readPatch))(modified)
+		}},
+		{"mtgadiff v2", func(original, modified []byte) error {
+			patch, err := generatePatch(original, modified)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := writePatchFilev2(patch, bufio.NewWriter(&buf)); err != nil {
+				return err
+			}
+			readPatch, err := readPatchFilev2(bufio.NewReader(&buf))
+			if err != nil {
+				return err
+			}
+			return expectPatched(applyPatch(original, readPatch))(modified)
+		}},
+		{"mtgadiff 1.0", func(original, modified []byte) error {
+			patch, err := generatePatch(original, modified)
+			if err != nil {
+				return err
+			}
+			patch.Flags = 0
+			var buf bytes.Buffer
+			if err := writePatchFile(patch, &buf); err != nil {
+				return err
+			}
+			readPatch, err := readPatchFile(&buf)
+			if err != nil {
+				return err
+			}
+			return expectPatched(applyPatch(original, readPatch))(modified)
+		}},
+		{"parity repair", func(original, modified []byte) error {
+			patch, err := generatePatch(original, modified)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := writePatchFile(patch, &buf); err != nil {
+				return err
+			}
+			damaged := appendParity(buf.Bytes(), paritySymbols(10))
+			damaged[len(IDENTIFIER)] ^= 0xFF
+			readPatch, err := readPatchFile(bytes.NewReader(damaged))
+			if err != nil {
+				return err
+			}
+			return expectPatched(applyPatch(original, readPatch))(modified)
+		}},
+		{"context", func(original, modified []byte) error {
+			patch, err := generatePatch(original, modified)
+			if err != nil {
+				return err
+			}
+			addPatchContext(patch, original, 16)
+			var buf bytes.Buffer
+			if err := writePatchFile(patch, &buf); err != nil {
+				return err
+			}
+			readPatch, err := readPatchFile(&buf)
+			if err != nil {
+				return err
+			}
+			result, _, err := applyPatchFuzzy(original, readPatch)
+			return expectPatched(result, err)(modified)
+		}},
+		{"atomic write", func(original, modified []byte) error {
+			path := filepath.Join(dir, "patched.bin")
+			if err := writeBytesAtomic(path, modified); err != nil {
+				return err
+			}
+			return expectPatched(readFileWithFileRead(path))(modified)
+		}},
+	}
+
+	for _, format := range PATCH_FORMATS {
+		paths = append(paths, selfTestPath{format, func(original, modified []byte) error {
+			patch, err := generatePatch(original, modified)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := writePatchFormat(format, patch, original, &buf); err != nil {
+				return err
+			}
+			checksums := &PatchInfo{
+				OriginalLength:   patch.OriginalLength,
+				OriginalChecksum: hex.EncodeToString(patch.OriginalChecksum[:]),
+				PatchedLength:    patch.PatchedLength,
+				PatchedChecksum:  hex.EncodeToString(patch.PatchedChecksum[:]),
+			}
+			result, detected, err := applyPatchFormat(original, &buf, checksums)
+			if err == nil && detected != format {
+				return fmt.Errorf("patch detected as %s", detected)
+			}
+			return expectPatched(result, err)(modified)
+		}})
+	}
+
+	return paths
+}
+
+// expectPatched turns the result of a patch path into a check against the modified file.
+func expectPatched(result []byte, err error) func(modified []byte) error {
+	return func(modified []byte) error {
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(result, modified) {
+			return errors.New("result differs from the modified file")
+		}
+		return nil
+	}
+}
+
+// benchStage is the fastest of several timed runs of one step of the patch pipeline.
+type benchStage struct {
+	name     string
+	bytes    int // Bytes processed by the step, for throughput
+	duration time.Duration
+	peakHeap uint64
+}
+
+/*
+Measures the MTGADIFF pipeline on a pair of real files.
+
+Generate, write, read and apply are each run -runs times; the fastest run
+is reported with its throughput and the peak heap sampled while it ran.
+Patches are written to and read from memory so the disk does not skew the numbers.
+*/
+func benchPatch(opts *CLIOptions) error {
+	defer logging.Trace("bench")()
+
+	if opts.benchRuns < 1 {
+		return fmt.Errorf("%w: runs must be at least 1", errInvalidArguments)
+	}
+
+	original, releaseOriginal, err := readInputFile(opts.originalPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading original file: %w", err)
+	}
+	defer releaseOriginal()
+	modified, releaseModified, err := readInputFile(opts.newPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading new file: %w", err)
+	}
+	defer releaseModified()
+
+	var patch *PatchFile
+	var serialized []byte
+	var result []byte
+
+	stages := []struct {
+		name  string
+		bytes func() int
+		run   func() error
+	}{
+		{"generate", func() int { return len(original) + len(modified) }, func() (err error) {
+			patch, err = generatePatch(original, modified)
+			return err
+		}},
+		{"write", func() int { return len(serialized) }, func() error {
+			var buf bytes.Buffer
+			if err := writePatchFile(patch, &buf); err != nil {
+				return err
+			}
+			serialized = buf.Bytes()
+			return nil
+		}},
+		{"read", func() int { return len(serialized) }, func() (err error) {
+			patch, err = readPatchFile(bytes.NewReader(serialized))
+			return err
+		}},
+		{"apply", func() int { return len(modified) }, func() (err error) {
+			result, err = applyPatch(original, patch)
+			return err
+		}},
+	}
+
+	var results []benchStage
+	for _, stage := range stages {
+		best := benchStage{name: stage.name}
+		for i := 0; i < opts.benchRuns; i++ {
+			duration, peak, err := measure(stage.run)
+			if err != nil {
+				return fmt.Errorf("%s failed: %w", stage.name, err)
+			}
+			if i == 0 || duration < best.duration {
+				best.duration = duration
+			}
+			best.peakHeap = max(best.peakHeap, peak)
+		}
+		best.bytes = stage.bytes()
+		results = append(results, best)
+	}
+
+	if !bytes.Equal(result, modified) {
+		return errors.New("patched file differs from the new file")
+	}
+
+	logging.Info("Benchmarked patch", "items", len(patch.PatchItems), "bytes", len(serialized), "runs", opts.benchRuns)
+	recordPatch(patch)
+	var details []map[string]any
+	for _, stage := range results {
+		throughput := float64(stage.bytes) / (1 << 20) / max(stage.duration.Seconds(), 1e-9)
+		details = append(details, map[string]any{
+			"stage":           stage.name,
+			"duration_ms":     float64(stage.duration.Microseconds()) / 1000,
+			"mib_per_second":  throughput,
+			"peak_heap_bytes": stage.peakHeap,
+		})
+		logging.Info("Stage", "stage", stage.name, "duration", stage.duration, "mib_per_second", fmt.Sprintf("%.1f", throughput), "peak_heap_mib", fmt.Sprintf("%.1f", float64(stage.peakHeap)/(1<<20)))
+	}
+	recordDetails(map[string]any{"runs": opts.benchRuns, "stages": details})
+	return nil
+}
+
+// measure times run while sampling the heap, returning its duration and the peak heap in use.
+func measure(run func() error) (time.Duration, uint64, error) {
+	runtime.GC()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	peak := stats.HeapInuse
+
+	stop := make(chan struct{})
+	sampled := make(chan uint64)
+	go func() {
+		ticker := time.NewTicker(MEMORY_SAMPLE_EVERY)
+		defer ticker.Stop()
+
+		var stats runtime.MemStats
+		samplePeak := uint64(0)
+		for {
+			select {
+			case <-ticker.C:
+				runtime.ReadMemStats(&stats)
+				samplePeak = max(samplePeak, stats.HeapInuse)
+			case <-stop:
+				sampled <- samplePeak
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	err := run()
+	duration := time.Since(start)
+
+	runtime.ReadMemStats(&stats)
+	close(stop)
+	peak = max(peak, stats.HeapInuse, <-sampled)
+
+	return duration, peak, err
+}
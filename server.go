@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	DEFAULT_LISTEN_ADDR = ":8080"
+	FETCH_TIMEOUT       = 10 * time.Minute
+)
+
+// PatchInfo is the JSON description of a catalog patch served by the patch server.
+type PatchInfo struct {
+	Name             string `json:"name"`                     // Path of the patch relative to the catalog directory
+	Size             int64  `json:"size"`                     // Size of the patch file in bytes
+	OriginalLength   uint32 `json:"original_length"`          // Length of the file the patch applies to
+	OriginalChecksum string `json:"original_checksum"`        // SHA-256 (hex) of the file the patch applies to
+	PatchedLength    uint32 `json:"patched_length"`           // Length of the file the patch produces
+	PatchedChecksum  string `json:"patched_checksum"`         // SHA-256 (hex) of the file the patch produces
+	ItemCount        uint32 `json:"item_count"`               // Number of patch items
+	PatchChecksum    string `json:"patch_checksum,omitempty"` // SHA-256 (hex) of the patch file itself
+}
+
+func newPatchInfo(catalog *Catalog, entry CatalogEntry) PatchInfo {
+	name, err := filepath.Rel(catalog.Dir, entry.Path)
+	if err != nil {
+		name = filepath.Base(entry.Path)
+	}
+
+	return PatchInfo{
+		Name:             filepath.ToSlash(name),
+		Size:             entry.Size,
+		OriginalLength:   entry.OriginalLength,
+		OriginalChecksum: hex.EncodeToString(entry.OriginalChecksum[:]),
+		PatchedLength:    entry.PatchedLength,
+		PatchedChecksum:  hex.EncodeToString(entry.PatchedChecksum[:]),
+		ItemCount:        entry.ItemCount,
+	}
+}
+
+/*
+Returns the HTTP handler exposing a catalog.
+
+Routes:
+
+  - GET /patches                       list every patch in the catalog
+  - GET /patches/{checksum}            download the patch for an original checksum
+  - GET /patches/{checksum}/meta       describe that patch, including the checksum of the patch file
+
+When several patches share an original checksum, the ?target= query
+parameter selects one by its patched checksum.
+*/
+func newPatchServer(catalog *Catalog) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /patches", func(w http.ResponseWriter, r *http.Request) {
+		infos := make([]PatchInfo, 0, len(catalog.Entries))
+		for _, entry := range catalog.Entries {
+			infos = append(infos, newPatchInfo(catalog, entry))
+		}
+		writeJSON(w, infos)
+	})
+
+	mux.HandleFunc("GET /patches/{checksum}", func(w http.ResponseWriter, r *http.Request) {
+		entry, status, err := selectServedPatch(catalog, r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		file, err := os.Open(entry.Path)
+		if err != nil {
+			http.Error(w, "patch file unavailable", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		stat, err := file.Stat()
+		if err != nil {
+			http.Error(w, "patch file unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, filepath.Base(entry.Path), stat.ModTime(), file)
+	})
+
+	mux.HandleFunc("GET /patches/{checksum}/meta", func(w http.ResponseWriter, r *http.Request) {
+		entry, status, err := selectServedPatch(catalog, r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		data, err := os.ReadFile(entry.Path)
+		if err != nil {
+			http.Error(w, "patch file unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		info := newPatchInfo(catalog, *entry)
+		info.Size = int64(len(data))
+		checksum := sha256.Sum256(data)
+		info.PatchChecksum = hex.EncodeToString(checksum[:])
+		writeJSON(w, info)
+	})
+
+	return mux
+}
+
+// selectServedPatch finds the catalog entry a request asks for, returning the HTTP status to use on failure.
+func selectServedPatch(catalog *Catalog, r *http.Request) (*CatalogEntry, int, error) {
+	original, err := parseChecksum(r.PathValue("checksum"))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid checksum: %w", err)
+	}
+
+	matches := catalog.lookup(original)
+	if target := r.URL.Query().Get("target"); target != "" {
+		patched, err := parseChecksum(target)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid target checksum: %w", err)
+		}
+
+		var filtered []CatalogEntry
+		for _, entry := range matches {
+			if entry.PatchedChecksum == patched {
+				filtered = append(filtered, entry)
+			}
+		}
+		matches = filtered
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, http.StatusNotFound, errors.New("no patch for this checksum")
+	case 1:
+		return &matches[0], http.StatusOK, nil
+	default:
+		return nil, http.StatusConflict, errors.New("several patches match, select one with ?target=")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Warn("Error writing response", "error", err)
+	}
+}
+
+// servePatches exposes the catalog directory over HTTP until the process is stopped.
+func servePatches(opts *CLIOptions) error {
+	catalog, err := loadCatalog(opts.catalogPath)
+	if err != nil {
+		return fmt.Errorf("error loading catalog: %w", err)
+	}
+
+	logging.Info("Serving patches", "count", len(catalog.Entries), "catalog", opts.catalogPath, "address", opts.listenAddr)
+	return http.ListenAndServe(opts.listenAddr, newPatchServer(catalog))
+}
+
+/*
+Downloads the patch for a file with the given checksum from a patch server.
+
+The patch is only returned once its size and SHA-256 match the metadata
+published by the server and its header targets the requested original,
+so a truncated or tampered download never reaches applyPatch.
+*/
+func fetchPatch(client *http.Client, baseURL string, original [32]byte, target string) ([]byte, *PatchInfo, error) {
+	defer logging.Trace("fetch patch")()
+
+	patchURL := strings.TrimRight(baseURL, "/") + "/patches/" + hex.EncodeToString(original[:])
+	query := ""
+	if target != "" {
+		query = "?target=" + url.QueryEscape(target)
+	}
+
+	// Fetch metadata first so the download can be verified
+	metaBody, err := httpGet(client, patchURL+"/meta"+query, 1<<20)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error fetching patch metadata: %w", err)
+	}
+
+	info := &PatchInfo{}
+	if err := json.Unmarshal(metaBody, info); err != nil {
+		return nil, nil, fmt.Errorf("error decoding patch metadata: %w", err)
+	}
+
+	data, err := httpGet(client, patchURL+query, info.Size)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error downloading patch: %w", err)
+	}
+
+	// Verify the download against the metadata
+	if int64(len(data)) != info.Size {
+		return nil, nil, fmt.Errorf("downloaded patch is %d bytes, expected %d", len(data), info.Size)
+	}
+	checksum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(checksum[:]), info.PatchChecksum) {
+		return nil, nil, fmt.Errorf("%w: downloaded patch checksum mismatch", errCorruptPatch)
+	}
+
+	header, _, err := readPatchHeader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("downloaded patch is invalid: %w", err)
+	}
+	if header.OriginalChecksum != original {
+		return nil, nil, errors.New("downloaded patch does not apply to the original file")
+	}
+
+	return data, info, nil
+}
+
+// httpGet fetches url and returns its body, refusing bodies larger than limit bytes.
+func httpGet(client *http.Client, url string, limit int64) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("response larger than %d bytes", limit)
+	}
+
+	return body, nil
+}
+
+// fetchPatchFile downloads the patch matching the original file and saves it to the output path.
+func fetchPatchFile(opts *CLIOptions) error {
+	original, release, err := readInputFile(opts.originalPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading original file: %w", err)
+	}
+	defer release()
+
+	client := &http.Client{Timeout: FETCH_TIMEOUT}
+	data, info, err := fetchPatch(client, opts.patchURL, sha256.Sum256(original), opts.targetChecksum)
+	if err != nil {
+		return err
+	}
+
+	if err := writeBytesAtomic(opts.outputPath, data); err != nil {
+		return fmt.Errorf("error writing patch file: %w", err)
+	}
+
+	recordDetails(info)
+	logging.Info("Successfully fetched patch", "patch", info.Name, "bytes", info.Size, "output", opts.outputPath)
+	return nil
+}
+
+// applyRemotePatch downloads the patch matching original from a patch server and applies it.
+func applyRemotePatch(original []byte, baseURL, target, outputPath string) error {
+	client := &http.Client{Timeout: FETCH_TIMEOUT}
+	data, info, err := fetchPatch(client, baseURL, sha256.Sum256(original), target)
+	if err != nil {
+		return err
+	}
+
+	logging.Info("Downloaded patch", "patch", info.Name)
+	return applyPatchReader(original, bytes.NewReader(data), nil, outputPath)
+}
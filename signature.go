@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	SIGNATURE_WILDCARD = "??"
+	MAX_SIGNATURES     = 1 << 16 // Rules accepted in a single patch
+	MAX_SIGNATURE_SIZE = 1 << 16 // Bytes in a single pattern
+)
+
+/*
+SignatureRule replaces every occurrence of a byte pattern, wherever it is.
+
+Wildcard bytes match anything in the pattern and keep the original byte in
+the replacement. The pattern must match exactly Count times, non-overlapping,
+or the patch is refused.
+*/
+type SignatureRule struct {
+	Pattern         []byte // Bytes to find
+	PatternMask     []byte // 1 where the pattern byte is a wildcard
+	Replacement     []byte // Bytes written over each match, as long as the pattern
+	ReplacementMask []byte // 1 where the original byte is kept
+	Count           uint32 // Number of matches expected
+}
+
+// isSignatureOnly reports whether a patch carries only signatures, and so applies to any original.
+func isSignatureOnly(patch *PatchFile) bool {
+	return patch.Flags&FLAG_SIGNATURES != 0 && len(patch.PatchItems) == 0 &&
+		patch.OriginalLength == 0 && patch.OriginalChecksum == [32]byte{}
+}
+
+/*
+Parses signature rules from their text form.
+
+Each rule starts with a find line and may be followed by replace and count
+lines; count defaults to 1. Bytes are hex pairs separated by spaces, ?? is a
+wildcard. Lines starting with # are comments:
+
+	# Skip the license check
+	find    48 8B 05 ?? ?? ?? ?? 84 C0 74 ??
+	replace ?? ?? ?? ?? ?? ?? ?? 84 C0 EB ??
+	count   1
+*/
+func parseSignatureRules(reader io.Reader) ([]SignatureRule, error) {
+	var rules []SignatureRule
+	var current *SignatureRule
+	hasReplacement := false
+
+	finish := func(line int) error {
+		if current == nil {
+			return nil
+		}
+		if !hasReplacement {
+			return fmt.Errorf("line %d: rule has no replace line", line)
+		}
+		rules = append(rules, *current)
+		current = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		key, value, _ := strings.Cut(text, " ")
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "find":
+			if err := finish(line); err != nil {
+				return nil, err
+			}
+			pattern, mask, err := parseSignatureBytes(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if bytes.IndexByte(mask, 0) < 0 {
+				return nil, fmt.Errorf("line %d: pattern needs at least one byte that is not a wildcard", line)
+			}
+			current = &SignatureRule{Pattern: pattern, PatternMask: mask, Count: 1}
+			hasReplacement = false
+
+		case "replace":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: replace before find", line)
+			}
+			replacement, mask, err := parseSignatureBytes(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if len(replacement) != len(current.Pattern) {
+				return nil, fmt.Errorf("line %d: replacement is %d bytes, pattern is %d", line, len(replacement), len(current.Pattern))
+			}
+			current.Replacement, current.ReplacementMask = replacement, mask
+			hasReplacement = true
+
+		case "count":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: count before find", line)
+			}
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || count == 0 {
+				return nil, fmt.Errorf("line %d: count must be a positive number", line)
+			}
+			current.Count = uint32(count)
+
+		default:
+			return nil, fmt.Errorf("line %d: unknown keyword %q, expected find, replace or count", line, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(line); err != nil {
+		return nil, err
+	}
+
+	if len(rules) == 0 {
+		return nil, errors.New("no rules found")
+	}
+	return rules, nil
+}
+
+// parseSignatureBytes decodes space separated hex bytes, returning the bytes and a mask marking ?? wildcards.
+func parseSignatureBytes(s string) ([]byte, []byte, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil, errors.New("no bytes given")
+	}
+	if len(fields) > MAX_SIGNATURE_SIZE {
+		return nil, nil, fmt.Errorf("more than %d bytes", MAX_SIGNATURE_SIZE)
+	}
+
+	data := make([]byte, len(fields))
+	mask := make([]byte, len(fields))
+	for i, field := range fields {
+		if field == SIGNATURE_WILDCARD {
+			mask[i] = 1
+			continue
+		}
+		decoded, err := hex.DecodeString(field)
+		if err != nil || len(decoded) != 1 {
+			return nil, nil, fmt.Errorf("invalid byte %q", field)
+		}
+		data[i] = decoded[0]
+	}
+	return data, mask, nil
+}
+
+/*
+Finds the non-overlapping matches of a rule's pattern in data.
+
+The longest run of literal bytes in the pattern is located with bytes.Index
+and the rest of the pattern checked around it, so wildcards cost nothing
+until a candidate is found.
+*/
+func findSignature(data []byte, rule SignatureRule) []int {
+	// Longest literal run, to anchor the search
+	anchorStart, anchorLength := 0, 0
+	for start := 0; start < len(rule.Pattern); {
+		if rule.PatternMask[start] != 0 {
+			start++
+			continue
+		}
+		end := start
+		for end < len(rule.Pattern) && rule.PatternMask[end] == 0 {
+			end++
+		}
+		if end-start > anchorLength {
+			anchorStart, anchorLength = start, end-start
+		}
+		start = end
+	}
+	anchor := rule.Pattern[anchorStart : anchorStart+anchorLength]
+
+	var matches []int
+	for position := anchorStart; position+len(rule.Pattern)-anchorStart <= len(data); {
+		index := bytes.Index(data[position:], anchor)
+		if index < 0 {
+			break
+		}
+		start := position + index - anchorStart
+		if start+len(rule.Pattern) > len(data) {
+			break
+		}
+
+		if signatureMatches(data[start:start+len(rule.Pattern)], rule) {
+			matches = append(matches, start)
+			position = start + len(rule.Pattern) + anchorStart
+		} else {
+			position += index + 1
+		}
+	}
+	return matches
+}
+
+func signatureMatches(window []byte, rule SignatureRule) bool {
+	for i, b := range rule.Pattern {
+		if rule.PatternMask[i] == 0 && window[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Applies signature rules to data in place, in order.
+
+Every rule must match exactly its expected number of times, otherwise
+nothing further is applied and an error names the rule and the count found.
+*/
+func applySignatures(data []byte, rules []SignatureRule) error {
+	defer logging.Trace("apply signatures")()
+
+	for i, rule := range rules {
+		matches := findSignature(data, rule)
+		if uint32(len(matches)) != rule.Count {
+			return fmt.Errorf("signature %d matched %d times, expected %d", i+1, len(matches), rule.Count)
+		}
+
+		for _, start := range matches {
+			for j, b := range rule.Replacement {
+				if rule.ReplacementMask[j] == 0 {
+					data[start+j] = b
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Writes the signature section of a patch.
+
+Section layout:
+
+ 1. Rule count: uint32 (4 bytes, big-endian)
+ 2. For each rule: pattern length uint32, pattern, pattern mask,
+    replacement, replacement mask (each as long as the pattern), expected count uint32
+*/
+func writeSignatures(writer io.Writer, rules []SignatureRule) error {
+	if err := binary.Write(writer, binary.BigEndian, uint32(len(rules))); err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if err := binary.Write(writer, binary.BigEndian, uint32(len(rule.Pattern))); err != nil {
+			return err
+		}
+		for _, field := range [][]byte{rule.Pattern, rule.PatternMask, rule.Replacement, rule.ReplacementMask} {
+			if _, err := writer.Write(field); err != nil {
+				return err
+			}
+		}
+		if err := binary.Write(writer, binary.BigEndian, rule.Count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSignatures reads the signature section written by writeSignatures.
+func readSignatures(reader io.Reader) ([]SignatureRule, error) {
+	var count uint32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if count > MAX_SIGNATURES {
+		return nil, fmt.Errorf("too many signatures: %d", count)
+	}
+
+	rules := make([]SignatureRule, 0, min(count, MAX_PREALLOC_ITEMS))
+	for i := uint32(0); i < count; i++ {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length == 0 || length > MAX_SIGNATURE_SIZE {
+			return nil, fmt.Errorf("signature %d has an invalid length: %d", i+1, length)
+		}
+
+		var rule SignatureRule
+		for _, field := range []*[]byte{&rule.Pattern, &rule.PatternMask, &rule.Replacement, &rule.ReplacementMask} {
+			*field = make([]byte, length)
+			if _, err := io.ReadFull(reader, *field); err != nil {
+				return nil, err
+			}
+		}
+		if err := binary.Read(reader, binary.BigEndian, &rule.Count); err != nil {
+			return nil, err
+		}
+		if bytes.IndexByte(rule.PatternMask, 0) < 0 {
+			return nil, fmt.Errorf("signature %d has no literal byte", i+1)
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+/*
+Creates a signature-only patch from a rules file.
+
+The patch records no original or patched checksums, so it applies to any
+build the rules match. When an original file is given, the rules are tried
+on it first and the patch is only written if every rule matches as expected.
+*/
+func createSignaturePatch(opts *CLIOptions) error {
+	if opts.format != FORMAT_MTGADIFF || opts.compat {
+		return errors.New("signatures are only stored in MTGADIFF 1.1 patches")
+	}
+	if opts.newPath != "" || opts.contextSize > 0 {
+		return errors.New("signature patches are made from rules alone, drop -new and -context")
+	}
+
+	rulesFile, err := os.Open(opts.signaturePath)
+	if err != nil {
+		return fmt.Errorf("error opening signature rules: %w", err)
+	}
+	defer rulesFile.Close()
+
+	rules, err := parseSignatureRules(rulesFile)
+	if err != nil {
+		return fmt.Errorf("error reading signature rules: %w", err)
+	}
+
+	if opts.originalPath != "" {
+		original, release, err := readInputFile(opts.originalPath, opts.mmap)
+		if err != nil {
+			return fmt.Errorf("error reading original file: %w", err)
+		}
+		defer release()
+		// Applying the rules writes to the data, which is read-only when mapped
+		if err := applySignatures(append([]byte{}, original...), rules); err != nil {
+			return fmt.Errorf("rules do not apply to %s: %w", opts.originalPath, err)
+		}
+		logging.Info("All rules match", "rules", len(rules), "original", opts.originalPath)
+	}
+
+	patch := &PatchFile{
+		Flags:      DEFAULT_PATCH_FLAGS | FLAG_SIGNATURES,
+		PatchItems: []PatchItem{},
+		Signatures: rules,
+	}
+	recordPatch(patch)
+	recordDetails(map[string]int{"signatures": len(rules)})
+	return writePatchOutput(opts, patch, nil)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	DEFAULT_STATS_CONTEXT = 16    // Context bytes of the -context estimate
+	DEFAULT_STATS_PARITY  = "10%" // Parity size of the -parity estimate
+)
+
+// PatchStats describes the items of a patch and what it would cost in each encoding.
+type PatchStats struct {
+	Regions       int            `json:"regions"`
+	WrittenBytes  int            `json:"written_bytes"`  // Bytes the items write
+	ChangedBytes  int            `json:"changed_bytes"`  // Bytes that differ from the original, fewer than written for a full-file patch
+	OverheadBytes int            `json:"overhead_bytes"` // Item headers, context and CRC32 under the flags of the patch
+	Smallest      int            `json:"smallest"`
+	Median        int            `json:"median"`
+	Largest       int            `json:"largest"`
+	ItemSizes     []SizeBucket   `json:"item_sizes"`
+	Estimates     []SizeEstimate `json:"estimates"`
+}
+
+// SizeBucket counts the items of Min to Max bytes, both included.
+type SizeBucket struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"`
+	Count int `json:"count"`
+}
+
+// SizeEstimate is the encoded size of the patch under one set of create options, or why it cannot be written so.
+type SizeEstimate struct {
+	Option string `json:"option"`
+	Size   int    `json:"size,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// byteCounter is a writer that only counts what is written to it.
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+/*
+Reports statistics on a patch, to choose create options before producing a release patch.
+
+Steps:
+
+ 1. Diffs -original against -new with generatePatch, or reads -patch in any supported format
+ 2. Counts the regions, the bytes they write and change and the bytes spent on item headers
+ 3. Sorts the item sizes into power of two buckets
+ 4. Encodes the patch under every format and MTGADIFF option, counting the bytes without keeping them
+
+Formats other than MTGADIFF are encoded against the original, so estimating
+them from -patch needs -original too.
+*/
+func patchStats(opts *CLIOptions) error {
+	defer logging.Trace("patch stats")()
+
+	var original []byte
+	if opts.originalPath != "" {
+		data, release, err := readInputFile(opts.originalPath, opts.mmap)
+		if err != nil {
+			return fmt.Errorf("error reading original file: %w", err)
+		}
+		defer release()
+		original = data
+	}
+
+	patch, err := loadStatsPatch(opts, original)
+	if err != nil {
+		return err
+	}
+
+	stats := itemStats(patch, original)
+	stats.Estimates = estimatePatchSizes(patch, original, opts)
+
+	recordPatch(patch)
+	recordDetails(stats)
+	logging.Info("Patch statistics", "regions", stats.Regions, "written_bytes", stats.WrittenBytes, "changed_bytes", stats.ChangedBytes, "overhead_bytes", stats.OverheadBytes,
+		"smallest", stats.Smallest, "median", stats.Median, "largest", stats.Largest)
+	for _, bucket := range stats.ItemSizes {
+		logging.Info("Item sizes", "min", bucket.Min, "max", bucket.Max, "count", bucket.Count)
+	}
+	for _, estimate := range stats.Estimates {
+		if estimate.Error != "" {
+			logging.Info("Estimated size", "option", estimate.Option, "error", estimate.Error)
+		} else {
+			logging.Info("Estimated size", "option", estimate.Option, "bytes", estimate.Size)
+		}
+	}
+	return nil
+}
+
+// loadStatsPatch generates the patch of -original and -new, or reads -patch, checking it applies to -original when given.
+func loadStatsPatch(opts *CLIOptions, original []byte) (*PatchFile, error) {
+	if opts.patchPath == "" {
+		modified, release, err := readInputFile(opts.newPath, opts.mmap)
+		if err != nil {
+			return nil, fmt.Errorf("error reading new file: %w", err)
+		}
+		defer release()
+
+		patch, err := generatePatch(original, modified)
+		if err != nil {
+			return nil, fmt.Errorf("error generating patch: %w", err)
+		}
+		return patch, nil
+	}
+
+	patchData, err := readFileWithFileRead(opts.patchPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading patch file: %w", err)
+	}
+	if original == nil {
+		format, err := detectPatchFormat(bufio.NewReader(bytes.NewReader(patchData)))
+		if err == nil && format != FORMAT_MTGADIFF {
+			return nil, fmt.Errorf("%w: original file path is required for %s patches", errInvalidArguments, format)
+		}
+	}
+
+	patch, _, err := readPatchAnyFormat(opts, original, patchData)
+	if err != nil {
+		return nil, err
+	}
+	if original != nil && !isSignatureOnly(patch) {
+		if uint32(len(original)) != patch.OriginalLength || sha256.Sum256(original) != patch.OriginalChecksum {
+			return nil, fmt.Errorf("original file %w", errChecksumMismatch)
+		}
+	}
+	return patch, nil
+}
+
+/*
+Counts the regions of patch, the bytes they write, change and cost, and the distribution of item sizes.
+
+Regions and changed bytes come from patchRegions, so a full-file patch given
+its original counts what differs rather than the whole file it writes.
+*/
+func itemStats(patch *PatchFile, original []byte) *PatchStats {
+	stats := &PatchStats{ItemSizes: []SizeBucket{}}
+	regions := patchRegions(patch, original)
+	stats.Regions = len(regions)
+	for _, region := range regions {
+		stats.ChangedBytes += region.Length
+	}
+	if len(patch.PatchItems) == 0 {
+		return stats
+	}
+
+	sizes := make([]int, 0, len(patch.PatchItems))
+	for _, item := range patch.PatchItems {
+		var encoded byteCounter
+		writePatchItem(&encoded, item, patch.Flags)
+		stats.WrittenBytes += len(item.Content)
+		stats.OverheadBytes += int(encoded) - len(item.Content)
+		sizes = append(sizes, len(item.Content))
+	}
+
+	sort.Ints(sizes)
+	stats.Smallest, stats.Median, stats.Largest = sizes[0], sizes[len(sizes)/2], sizes[len(sizes)-1]
+
+	// Buckets of 1, 2-3, 4-7, 8-15... bytes, leaving out the empty ones
+	for _, size := range sizes {
+		low := 1
+		for low*2 <= size {
+			low *= 2
+		}
+		if n := len(stats.ItemSizes); n > 0 && stats.ItemSizes[n-1].Min == low {
+			stats.ItemSizes[n-1].Count++
+		} else {
+			stats.ItemSizes = append(stats.ItemSizes, SizeBucket{Min: low, Max: low*2 - 1, Count: 1})
+		}
+	}
+	return stats
+}
+
+/*
+Encodes patch under each option create offers and returns the sizes.
+
+Estimates are the exact sizes the writers produce: MTGADIFF 1.1 as create
+writes it, with -compat, with -context and with -parity, then every other
+format. An option the patch cannot be written with, or that needs an
+original which was not given, carries the reason instead of a size.
+*/
+func estimatePatchSizes(patch *PatchFile, original []byte, opts *CLIOptions) []SizeEstimate {
+	estimate := func(option string, write func(counter *byteCounter) error) SizeEstimate {
+		var counter byteCounter
+		if err := write(&counter); err != nil {
+			return SizeEstimate{Option: option, Error: err.Error()}
+		}
+		return SizeEstimate{Option: option, Size: int(counter)}
+	}
+	needsOriginal := errors.New("needs -original")
+
+	// MTGADIFF keeps the signatures and the full-file mode of the patch under every option
+	withFlags := func(flags uint32) *PatchFile {
+		variant := *patch
+		variant.Flags = flags | patch.Flags&(FLAG_SIGNATURES|FLAG_FULL_FILE)
+		return &variant
+	}
+
+	var estimates []SizeEstimate
+	estimates = append(estimates, estimate(FORMAT_MTGADIFF, func(counter *byteCounter) error {
+		return writePatchFile(withFlags(DEFAULT_PATCH_FLAGS), counter)
+	}))
+	estimates = append(estimates, estimate(FORMAT_MTGADIFF+" -compat", func(counter *byteCounter) error {
+		if patch.Flags&FLAG_SIGNATURES != 0 {
+			return errors.New("signatures need MTGADIFF 1.1")
+		}
+		variant := *patch
+		variant.Flags = 0
+		return writePatchFile(&variant, counter)
+	}))
+	estimates = append(estimates, estimate(fmt.Sprintf("%s -context=%d", FORMAT_MTGADIFF, opts.contextSize), func(counter *byteCounter) error {
+		if original == nil {
+			return needsOriginal
+		}
+		variant := withFlags(DEFAULT_PATCH_FLAGS)
+		variant.PatchItems = append([]PatchItem{}, patch.PatchItems...)
+		addPatchContext(variant, original, opts.contextSize)
+		return writePatchFile(variant, counter)
+	}))
+	estimates = append(estimates, estimate(fmt.Sprintf("%s -parity=%s", FORMAT_MTGADIFF, opts.parity), func(counter *byteCounter) error {
+		percent, err := parseParityPercent(opts.parity)
+		if err != nil {
+			return err
+		}
+		if err := writePatchFile(withFlags(DEFAULT_PATCH_FLAGS), counter); err != nil {
+			return err
+		}
+		nsym := paritySymbols(percent)
+		*counter += byteCounter(parityCodewords(int(*counter), nsym)*nsym + PARITY_FOOTER_SIZE)
+		return nil
+	}))
+
+	for _, format := range PATCH_FORMATS {
+		if format == FORMAT_MTGADIFF {
+			continue
+		}
+		estimates = append(estimates, estimate(format, func(counter *byteCounter) error {
+			if original == nil {
+				return needsOriginal
+			}
+			if isSignatureOnly(patch) {
+				return errors.New("signature patches are only written as MTGADIFF")
+			}
+			return writePatchFormat(format, patch, original, counter)
+		}))
+	}
+	return estimates
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"mtgapatcher/logging"
+)
+
+const STREAM_WINDOW_SIZE = 4 << 20 // Bytes read from each input at a time, and the largest item a streamed patch holds
+
+// checkPatchLength rejects inputs MTGADIFF cannot describe: lengths and offsets are uint32.
+func checkPatchLength(name string, length int64) error {
+	if length > math.MaxUint32 {
+		return fmt.Errorf("%s file is %d bytes, MTGADIFF lengths and offsets stop at %d (4 GiB)", name, length, uint64(math.MaxUint32))
+	}
+	return nil
+}
+
+// streamDiff carries the state of a windowed diff between windows.
+type streamDiff struct {
+	writer   io.Writer
+	flags    uint32
+	maxItem  int
+	items    uint32
+	runStart int64
+	run      []byte
+}
+
+// flush writes the pending run of differing bytes as a patch item.
+func (d *streamDiff) flush() error {
+	if len(d.run) == 0 {
+		return nil
+	}
+	if d.items == math.MaxUint32 {
+		return errors.New("patch has more items than MTGADIFF can count")
+	}
+
+	item := PatchItem{Offset: uint32(d.runStart), Content: d.run}
+	if err := writePatchItem(d.writer, item, d.flags); err != nil {
+		return err
+	}
+	d.items++
+	d.run = d.run[:0]
+	return nil
+}
+
+// add appends a differing byte at offset to the pending run, starting a new item when the run is full.
+func (d *streamDiff) add(offset int64, b byte) error {
+	if len(d.run) == d.maxItem {
+		if err := d.flush(); err != nil {
+			return err
+		}
+	}
+	if len(d.run) == 0 {
+		d.runStart = offset
+	}
+	d.run = append(d.run, b)
+	return nil
+}
+
+/*
+Diffs two inputs window by window and streams the MTGADIFF patch to out.
+
+Produces the same items as generatePatch, except that runs of differing
+bytes longer than window are split, while holding only two windows and one
+pending item in memory. Steps:
+
+ 1. Writes a header with zero lengths, checksums and item count as a placeholder
+ 2. Reads both inputs a window at a time, hashing them, and writes every run of differing bytes as it ends
+ 3. Writes the bytes past the end of the original as items of at most one window
+ 4. Seeks back and rewrites the header with the real lengths, checksums and item count
+ 5. Re-reads the file to append the whole-patch checksum, when the flags ask for one
+
+Returns the header of the patch and its item count.
+*/
+func streamPatch(original, modified io.Reader, out io.ReadWriteSeeker, flags uint32, window int) (*PatchFile, uint32, error) {
+	defer logging.Trace("stream patch")()
+
+	patch := &PatchFile{Flags: flags}
+	bufWriter := bufio.NewWriter(out)
+	if _, err := bufWriter.Write([]byte(IDENTIFIER)); err != nil {
+		return nil, 0, err
+	}
+	if err := writePatchHeader(bufWriter, patch, 0); err != nil {
+		return nil, 0, err
+	}
+
+	originalHash, modifiedHash := sha256.New(), sha256.New()
+	original = io.TeeReader(original, originalHash)
+	modified = io.TeeReader(modified, modifiedHash)
+
+	diff := &streamDiff{writer: bufWriter, flags: flags, maxItem: window, run: make([]byte, 0, window)}
+	originalWindow, modifiedWindow := make([]byte, window), make([]byte, window)
+	var originalLength, modifiedLength int64
+	originalDone, modifiedDone := false, false
+
+	for !modifiedDone {
+		n, err := readWindow(modified, modifiedWindow)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading new file: %w", err)
+		}
+		modifiedDone = n < window
+
+		m := 0
+		if !originalDone {
+			if m, err = readWindow(original, originalWindow[:n]); err != nil {
+				return nil, 0, fmt.Errorf("error reading original file: %w", err)
+			}
+			originalDone = m < n
+		}
+
+		// Differing bytes where both files have data
+		for i := 0; i < m; i++ {
+			if originalWindow[i] != modifiedWindow[i] {
+				if err := diff.add(modifiedLength+int64(i), modifiedWindow[i]); err != nil {
+					return nil, 0, err
+				}
+			} else if err := diff.flush(); err != nil {
+				return nil, 0, err
+			}
+		}
+		originalLength += int64(m)
+
+		// Bytes past the end of the original are appended, as generatePatch does
+		if m < n {
+			if err := diff.flush(); err != nil {
+				return nil, 0, err
+			}
+			for i := m; i < n; i++ {
+				if err := diff.add(modifiedLength+int64(i), modifiedWindow[i]); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+
+		modifiedLength += int64(n)
+		if err := checkPatchLength("new", modifiedLength); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := diff.flush(); err != nil {
+		return nil, 0, err
+	}
+
+	// The rest of a longer original only needs hashing
+	if !originalDone {
+		n, err := io.Copy(io.Discard, original)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading original file: %w", err)
+		}
+		originalLength += n
+	}
+	if err := checkPatchLength("original", originalLength); err != nil {
+		return nil, 0, err
+	}
+	if originalLength == 0 || modifiedLength == 0 {
+		return nil, 0, errEmptyInput
+	}
+	if err := bufWriter.Flush(); err != nil {
+		return nil, 0, err
+	}
+
+	// Fill in the header now the lengths and checksums are known
+	patch.OriginalLength = uint32(originalLength)
+	patch.PatchedLength = uint32(modifiedLength)
+	copy(patch.OriginalChecksum[:], originalHash.Sum(nil))
+	copy(patch.PatchedChecksum[:], modifiedHash.Sum(nil))
+	if _, err := out.Seek(int64(len(IDENTIFIER)), io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	if err := writePatchHeader(out, patch, diff.items); err != nil {
+		return nil, 0, err
+	}
+
+	if flags&FLAG_PATCH_CHECKSUM != 0 {
+		if err := appendPatchChecksum(out); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return patch, diff.items, nil
+}
+
+// readWindow fills buf from reader as far as it goes, returning a short count only at the end of the input.
+func readWindow(reader io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(reader, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return n, nil
+	}
+	return n, err
+}
+
+// appendPatchChecksum hashes everything in out and appends the hash, as the MTGADIFF trailer.
+func appendPatchChecksum(out io.ReadWriteSeeker) error {
+	hasher := sha256.New()
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, out); err != nil {
+		return err
+	}
+	_, err := out.Write(hasher.Sum(nil))
+	return err
+}
+
+// createStreamingPatch creates a patch with streamPatch, for inputs too large to hold in memory.
+func createStreamingPatch(opts *CLIOptions) error {
+	switch {
+	case opts.format != FORMAT_MTGADIFF:
+		return errors.New("streamed patches are only written as MTGADIFF")
+	case opts.parity != "" || opts.contextSize > 0:
+		return errors.New("-parity and -context need the whole patch in memory, drop them or -stream")
+	case opts.outputPath == STDIO_PATH:
+		return errors.New("streamed patches need a seekable output file, not stdout")
+	}
+
+	original, err := openInput(opts.originalPath)
+	if err != nil {
+		return fmt.Errorf("error opening original file: %w", err)
+	}
+	defer original.Close()
+	modified, err := openInput(opts.newPath)
+	if err != nil {
+		return fmt.Errorf("error opening new file: %w", err)
+	}
+	defer modified.Close()
+
+	flags := uint32(DEFAULT_PATCH_FLAGS)
+	if opts.compat {
+		flags = 0
+	}
+
+	var patch *PatchFile
+	var items uint32
+	err = replaceFileAtomic(opts.outputPath, func(temp *os.File) error {
+		if patch, items, err = streamPatch(original, modified, temp, flags, STREAM_WINDOW_SIZE); err != nil {
+			return err
+		}
+		if err := temp.Sync(); err != nil {
+			return err
+		}
+		return verifyStreamedPatch(temp.Name(), patch, items)
+	})
+	if err != nil {
+		return fmt.Errorf("error writing patch file: %w", err)
+	}
+
+	recordPatchHeader(patch, int(items))
+	logging.Info("Successfully created patch file", "output", opts.outputPath, "items", items)
+	return nil
+}
+
+/*
+Reads a streamed patch back from disk before it replaces the output, as writeFileAtomic does for other writes.
+
+The header must hold what streamPatch wrote and, with FLAG_PATCH_CHECKSUM,
+the trailer must match the hash of everything before it. The file is hashed
+as it is read, so patches too large to hold in memory are checked too.
+*/
+func verifyStreamedPatch(path string, patch *PatchFile, items uint32) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Verify the header
+	header, count, err := readPatchHeader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("error reading back patch header: %w", err)
+	}
+	if header.Flags != patch.Flags || count != items ||
+		header.OriginalLength != patch.OriginalLength || header.OriginalChecksum != patch.OriginalChecksum ||
+		header.PatchedLength != patch.PatchedLength || header.PatchedChecksum != patch.PatchedChecksum {
+		return fmt.Errorf("%w: written patch header differs from the inputs", errCorruptPatch)
+	}
+
+	// Verify the trailer
+	if patch.Flags&FLAG_PATCH_CHECKSUM == 0 {
+		return nil
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < sha256.Size {
+		return io.ErrUnexpectedEOF
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	if _, err := io.CopyN(hasher, file, stat.Size()-sha256.Size); err != nil {
+		return err
+	}
+	return verifyPatchChecksum(file, hasher.Sum(nil))
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"mtgapatcher/logging"
+)
+
+const (
+	JOURNAL_NAME     = ".mtgapatcher-journal.json"
+	BACKUP_EXTENSION = ".mtgabak"
+
+	RECOVER_FORWARD  = "forward"
+	RECOVER_ROLLBACK = "rollback"
+
+	// File states as seen by recovery
+	STATE_BEFORE = "before"
+	STATE_AFTER  = "after"
+)
+
+// ApplyPlan lists the files of a game directory to patch together, as read from -plan.
+type ApplyPlan struct {
+	Files []struct {
+		Path  string `json:"path"`  // File to patch, relative to the game directory
+		Patch string `json:"patch"` // Patch to apply, relative to the plan file
+	} `json:"files"`
+}
+
+// JournalEntry records one file of a transaction: where it is, how to restore it and what it should hash to.
+type JournalEntry struct {
+	Path           string `json:"path"`            // File being patched, relative to the game directory
+	Patch          string `json:"patch"`           // Absolute path of the patch applied to it
+	Backup         string `json:"backup"`          // Copy of the original file, relative to the game directory
+	BeforeChecksum string `json:"before_checksum"` // SHA-256 (hex) of the file before patching
+	AfterChecksum  string `json:"after_checksum"`  // SHA-256 (hex) of the file after patching
+}
+
+// Journal is the on-disk record of a multi-file apply. It only exists while a transaction is in flight.
+type Journal struct {
+	Entries []JournalEntry `json:"entries"`
+}
+
+func journalPath(dir string) string {
+	return filepath.Join(dir, JOURNAL_NAME)
+}
+
+func readJournal(dir string) (*Journal, error) {
+	data, err := os.ReadFile(journalPath(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &Journal{}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, fmt.Errorf("invalid journal: %w", err)
+	}
+	return journal, nil
+}
+
+func writeJournal(dir string, journal *Journal) error {
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeBytesAtomic(journalPath(dir), data)
+}
+
+// finishJournal removes the backups and the journal once a transaction is settled either way.
+func finishJournal(dir string, journal *Journal) error {
+	for _, entry := range journal.Entries {
+		if err := os.Remove(filepath.Join(dir, entry.Backup)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Remove(journalPath(dir)); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+/*
+Applies a set of patches to a game directory as one transaction.
+
+Steps:
+
+ 1. Verifies every file matches its patch before anything is touched
+ 2. Records the journal: files, patches, backups and checksums before/after
+ 3. Backs up each file, then applies its patch
+ 4. Removes the backups and the journal once every file is patched
+
+If a file fails to patch, the files already patched are restored from
+their backups and the journal is removed. If the process dies midway, the
+journal is left behind and the next run refuses to start until it is
+recovered with -recover=forward or -recover=rollback.
+Recovery tells patched files from the others by their checksums, so the
+journal is only written once.
+*/
+func applyTransaction(opts *CLIOptions) error {
+	defer logging.Trace("apply transaction")()
+
+	if _, err := os.Stat(journalPath(opts.gameDir)); err == nil {
+		if opts.recoverMode == "" {
+			return fmt.Errorf("an interrupted transaction was found in %s, rerun with -recover=%s or -recover=%s", opts.gameDir, RECOVER_FORWARD, RECOVER_ROLLBACK)
+		}
+		return recoverTransaction(opts.gameDir, opts.recoverMode)
+	} else if opts.recoverMode != "" {
+		return fmt.Errorf("no interrupted transaction found in %s", opts.gameDir)
+	}
+
+	if opts.planPath == "" {
+		return fmt.Errorf("%w: plan file path is required", errInvalidArguments)
+	}
+	journal, err := prepareTransaction(opts.gameDir, opts.planPath)
+	if err != nil {
+		return err
+	}
+
+	if err := writeJournal(opts.gameDir, journal); err != nil {
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+
+	for i := range journal.Entries {
+		entry := &journal.Entries[i]
+		path := filepath.Join(opts.gameDir, entry.Path)
+
+		original, err := os.ReadFile(path)
+		if err != nil {
+			return abortTransaction(opts.gameDir, journal, i, fmt.Errorf("error reading %s: %w", entry.Path, err))
+		}
+		if err := writeBytesAtomic(filepath.Join(opts.gameDir, entry.Backup), original); err != nil {
+			return abortTransaction(opts.gameDir, journal, i, fmt.Errorf("error backing up %s: %w", entry.Path, err))
+		}
+
+		if err := applyJournalEntry(opts.gameDir, entry, original); err != nil {
+			return abortTransaction(opts.gameDir, journal, i, err)
+		}
+		logging.Info("Patched file", "file", entry.Path, "step", i+1, "files", len(journal.Entries))
+	}
+
+	if err := finishJournal(opts.gameDir, journal); err != nil {
+		return fmt.Errorf("error removing journal: %w", err)
+	}
+
+	files := make([]string, len(journal.Entries))
+	for i, entry := range journal.Entries {
+		files[i] = entry.Path
+	}
+	recordDetails(map[string]any{"dir": opts.gameDir, "files": files})
+	logging.Info("Successfully patched files", "count", len(journal.Entries), "dir", opts.gameDir)
+	return nil
+}
+
+// abortTransaction rolls back the first applied entries of a failed transaction and removes the journal, returning cause.
+// If rolling back fails too, the journal is kept so the transaction can still be recovered.
+func abortTransaction(dir string, journal *Journal, applied int, cause error) error {
+	for i := applied - 1; i >= 0; i-- {
+		if err := rollbackEntry(dir, &journal.Entries[i]); err != nil {
+			return fmt.Errorf("%w (rolling back failed: %v, rerun with -recover=%s)", cause, err, RECOVER_ROLLBACK)
+		}
+	}
+	if err := finishJournal(dir, journal); err != nil {
+		return fmt.Errorf("%w (error removing journal: %v)", cause, err)
+	}
+
+	logging.Info("Rolled back failed transaction", "files", applied, "dir", dir)
+	return cause
+}
+
+// prepareTransaction reads the plan and checks every file against its patch, building the journal to record.
+func prepareTransaction(dir, planPath string) (*Journal, error) {
+	data, err := os.ReadFile(planPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan: %w", err)
+	}
+	plan := &ApplyPlan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("invalid plan: %w", err)
+	}
+	if len(plan.Files) == 0 {
+		return nil, errors.New("plan lists no files")
+	}
+
+	journal := &Journal{}
+	seen := map[string]bool{}
+	for _, file := range plan.Files {
+		if !filepath.IsLocal(file.Path) {
+			return nil, fmt.Errorf("plan path %s must stay inside the game directory", file.Path)
+		}
+		// A second entry would back up the first one's output and break recovery
+		if seen[filepath.Clean(file.Path)] {
+			return nil, fmt.Errorf("plan lists %s more than once", file.Path)
+		}
+		seen[filepath.Clean(file.Path)] = true
+
+		patchPath, err := filepath.Abs(filepath.Join(filepath.Dir(planPath), file.Patch))
+		if err != nil {
+			return nil, err
+		}
+		patch, err := readPatchPath(patchPath)
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := checksumFile(filepath.Join(dir, file.Path))
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", file.Path, err)
+		}
+		if current != patch.OriginalChecksum {
+			return nil, fmt.Errorf("%s does not match the original checksum of %s: %w", file.Path, file.Patch, errChecksumMismatch)
+		}
+
+		journal.Entries = append(journal.Entries, JournalEntry{
+			Path:           file.Path,
+			Patch:          patchPath,
+			Backup:         file.Path + BACKUP_EXTENSION,
+			BeforeChecksum: hex.EncodeToString(patch.OriginalChecksum[:]),
+			AfterChecksum:  hex.EncodeToString(patch.PatchedChecksum[:]),
+		})
+	}
+
+	return journal, nil
+}
+
+// applyJournalEntry patches original with the entry's patch and writes the result over the entry's file.
+func applyJournalEntry(dir string, entry *JournalEntry, original []byte) error {
+	patch, err := readPatchPath(entry.Patch)
+	if err != nil {
+		return err
+	}
+
+	result, err := applyPatch(original, patch)
+	if err != nil {
+		return fmt.Errorf("error applying patch to %s: %w", entry.Path, err)
+	}
+	if hex.EncodeToString(patch.PatchedChecksum[:]) != entry.AfterChecksum {
+		return fmt.Errorf("patch %s changed since the journal was written", entry.Patch)
+	}
+
+	if err := writeBytesAtomic(filepath.Join(dir, entry.Path), result); err != nil {
+		return fmt.Errorf("error writing %s: %w", entry.Path, err)
+	}
+	return nil
+}
+
+func readPatchPath(path string) (*PatchFile, error) {
+	patchFile, err := openInput(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening patch file: %w", err)
+	}
+	defer patchFile.Close()
+
+	patch, err := readPatchFile(patchFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading patch file %s: %w", path, err)
+	}
+	return patch, nil
+}
+
+/*
+Settles an interrupted transaction.
+
+Files are always written atomically, so each one holds either its before
+or its after checksum. Rolling forward patches the files still at their
+before checksum; rolling back restores the backups of files already
+patched. A file matching neither, with no usable backup, stops recovery.
+*/
+func recoverTransaction(dir, mode string) error {
+	defer logging.Trace("recover transaction")()
+
+	if mode != RECOVER_FORWARD && mode != RECOVER_ROLLBACK {
+		return fmt.Errorf("unknown recover mode %q, expected %s or %s", mode, RECOVER_FORWARD, RECOVER_ROLLBACK)
+	}
+
+	journal, err := readJournal(dir)
+	if err != nil {
+		return fmt.Errorf("error reading journal: %w", err)
+	}
+
+	for i := range journal.Entries {
+		entry := &journal.Entries[i]
+
+		current, err := os.ReadFile(filepath.Join(dir, entry.Path))
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", entry.Path, err)
+		}
+		state := fileState(current, entry)
+
+		// A file matching neither checksum can only be recovered from its backup
+		if state == "" {
+			backup, err := os.ReadFile(filepath.Join(dir, entry.Backup))
+			if err != nil || fileState(backup, entry) != STATE_BEFORE {
+				return fmt.Errorf("%s matches neither checksum and has no valid backup", entry.Path)
+			}
+			current, state = backup, STATE_BEFORE
+			if mode == RECOVER_ROLLBACK {
+				if err := writeBytesAtomic(filepath.Join(dir, entry.Path), backup); err != nil {
+					return fmt.Errorf("error restoring %s: %w", entry.Path, err)
+				}
+			}
+		}
+
+		switch {
+		case mode == RECOVER_FORWARD && state == STATE_BEFORE:
+			if err := applyJournalEntry(dir, entry, current); err != nil {
+				return err
+			}
+			logging.Info("Rolled forward", "file", entry.Path)
+
+		case mode == RECOVER_ROLLBACK && state == STATE_AFTER:
+			if err := rollbackEntry(dir, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := finishJournal(dir, journal); err != nil {
+		return fmt.Errorf("error removing journal: %w", err)
+	}
+
+	logging.Info("Recovered interrupted transaction", "mode", mode, "dir", dir)
+	return nil
+}
+
+// rollbackEntry restores the entry's file from its backup, refusing a backup that does not hold the original.
+func rollbackEntry(dir string, entry *JournalEntry) error {
+	backup, err := os.ReadFile(filepath.Join(dir, entry.Backup))
+	if err != nil || fileState(backup, entry) != STATE_BEFORE {
+		return fmt.Errorf("cannot roll back %s: no valid backup", entry.Path)
+	}
+	if err := writeBytesAtomic(filepath.Join(dir, entry.Path), backup); err != nil {
+		return fmt.Errorf("error restoring %s: %w", entry.Path, err)
+	}
+	logging.Info("Rolled back", "file", entry.Path)
+	return nil
+}
+
+// fileState reports whether data matches the entry's checksum before or after patching, or neither.
+func fileState(data []byte, entry *JournalEntry) string {
+	checksum := sha256.Sum256(data)
+	switch hex.EncodeToString(checksum[:]) {
+	case entry.BeforeChecksum:
+		return STATE_BEFORE
+	case entry.AfterChecksum:
+		return STATE_AFTER
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"mtgapatcher/logging"
+)
+
+// pathNode is a checksum waiting in the queue of findUpgradePath, ordered by the bytes needed to reach it.
+type pathNode struct {
+	checksum [32]byte
+	cost     int64
+}
+
+type pathQueue []pathNode
+
+func (q pathQueue) Len() int           { return len(q) }
+func (q pathQueue) Less(i, j int) bool { return q[i].cost < q[j].cost }
+func (q pathQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *pathQueue) Push(x any)        { *q = append(*q, x.(pathNode)) }
+func (q *pathQueue) Pop() any {
+	old := *q
+	node := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return node
+}
+
+/*
+Finds the cheapest chain of catalog patches turning a file with checksum from into one with checksum to.
+
+Every catalog entry is an edge OriginalChecksum → PatchedChecksum weighted by the
+size of the patch file, so the returned chain is the one with the smallest total download.
+Returns an empty chain when from already equals to.
+*/
+func (c *Catalog) findUpgradePath(from, to [32]byte) ([]CatalogEntry, error) {
+	defer logging.Trace("find upgrade path")()
+
+	cost := map[[32]byte]int64{from: 0}
+	via := make(map[[32]byte]int) // checksum -> index of the entry used to reach it
+	done := make(map[[32]byte]bool)
+
+	queue := &pathQueue{{checksum: from}}
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(pathNode)
+		if done[node.checksum] {
+			continue
+		}
+		done[node.checksum] = true
+
+		if node.checksum == to {
+			break
+		}
+
+		for _, i := range c.byOriginal[node.checksum] {
+			entry := c.Entries[i]
+			next := node.cost + entry.Size
+			if known, ok := cost[entry.PatchedChecksum]; ok && known <= next {
+				continue
+			}
+			cost[entry.PatchedChecksum] = next
+			via[entry.PatchedChecksum] = i
+			heap.Push(queue, pathNode{checksum: entry.PatchedChecksum, cost: next})
+		}
+	}
+
+	if !done[to] {
+		return nil, fmt.Errorf("no chain of patches leads from %x to %x", from, to)
+	}
+
+	// Walk back from the target to build the chain in apply order
+	var chain []CatalogEntry
+	for checksum := to; checksum != from; {
+		entry := c.Entries[via[checksum]]
+		chain = append([]CatalogEntry{entry}, chain...)
+		checksum = entry.OriginalChecksum
+	}
+
+	return chain, nil
+}
+
+/*
+Applies a chain of patches in order, verifying every intermediate result.
+
+Each step checks that the patch file still carries the header the catalog
+indexed and that its output hashes to the checksum the next step expects.
+*/
+func applyPatchChain(original []byte, chain []CatalogEntry) ([]byte, error) {
+	defer logging.Trace("apply patch chain")()
+
+	current := original
+	for i, entry := range chain {
+		patchFile, err := os.Open(entry.Path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening patch file: %w", err)
+		}
+
+		patch, err := readPatchFile(patchFile)
+		patchFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading patch file %s: %w", entry.Path, err)
+		}
+		if patch.OriginalChecksum != entry.OriginalChecksum || patch.PatchedChecksum != entry.PatchedChecksum {
+			return nil, fmt.Errorf("patch file %s changed since the catalog was loaded", entry.Path)
+		}
+
+		result, err := applyPatch(current, patch)
+		if err != nil {
+			return nil, fmt.Errorf("error applying patch %s: %w", entry.Path, err)
+		}
+		if sha256.Sum256(result) != entry.PatchedChecksum {
+			return nil, fmt.Errorf("intermediate %w after %s", errChecksumMismatch, entry.Path)
+		}
+
+		logging.Info("Applied upgrade step", "patch", entry.Path, "step", i+1, "steps", len(chain))
+		current = result
+	}
+
+	return current, nil
+}
+
+// upgradePatch brings the original file to the target checksum using the cheapest chain of catalog patches.
+func upgradePatch(opts *CLIOptions) error {
+	target, err := parseChecksum(opts.targetChecksum)
+	if err != nil {
+		return fmt.Errorf("invalid target checksum: %w", err)
+	}
+
+	original, release, err := readInputFile(opts.originalPath, opts.mmap)
+	if err != nil {
+		return fmt.Errorf("error reading original file: %w", err)
+	}
+	defer release()
+
+	catalog, err := loadCatalog(opts.catalogPath)
+	if err != nil {
+		return fmt.Errorf("error loading catalog: %w", err)
+	}
+
+	chain, err := catalog.findUpgradePath(sha256.Sum256(original), target)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, entry := range chain {
+		total += entry.Size
+	}
+	logging.Info("Found upgrade path", "patches", len(chain), "bytes", total)
+
+	steps := make([]string, len(chain))
+	for i, entry := range chain {
+		steps[i] = entry.Path
+	}
+	recordDetails(map[string]any{"chain": steps, "chain_bytes": total})
+
+	result, err := applyPatchChain(original, chain)
+	if err != nil {
+		return err
+	}
+
+	recordFiles(original, result)
+	if err := writeBytesAtomic(opts.outputPath, result); err != nil {
+		return fmt.Errorf("error writing output file: %w", err)
+	}
+
+	logging.Info("Successfully upgraded file", "output", opts.outputPath)
+	return nil
+}
+
+// parseChecksum decodes a hex encoded SHA-256 checksum.
+func parseChecksum(s string) ([32]byte, error) {
+	var checksum [32]byte
+
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return checksum, err
+	}
+	if len(decoded) != len(checksum) {
+		return checksum, fmt.Errorf("expected %d bytes, got %d", len(checksum), len(decoded))
+	}
+
+	copy(checksum[:], decoded)
+	return checksum, nil
+}
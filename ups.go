@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"mtgapatcher/logging"
+)
+
+/*
+UPS patch support.
+
+A UPS patch is "UPS1", the input and output sizes, then hunks of a relative
+skip followed by XOR bytes ending in a zero byte, and finally the CRC32 of
+the input, the output and the patch itself.
+*/
+
+const UPS_HEADER = "UPS1"
+
+// readBeatVarint reads the variable length integer shared by UPS and BPS.
+func readBeatVarint(reader io.ByteReader) (uint64, error) {
+	var value uint64
+	shift := uint64(1)
+	for i := 0; i < 10; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		value += uint64(b&0x7F) * shift
+		if b&0x80 != 0 {
+			return value, nil
+		}
+		shift <<= 7
+		value += shift
+	}
+	return 0, errors.New("integer too long")
+}
+
+// appendBeatVarint appends value in the variable length encoding shared by UPS and BPS.
+func appendBeatVarint(buf []byte, value uint64) []byte {
+	for {
+		x := byte(value & 0x7F)
+		value >>= 7
+		if value == 0 {
+			return append(buf, 0x80|x)
+		}
+		buf = append(buf, x)
+		value--
+	}
+}
+
+// appendPatchCRCs appends the source and target CRC32s, then the CRC32 of everything written so far.
+func appendPatchCRCs(out, source, target []byte) []byte {
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(source))
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(target))
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+}
+
+// verifyPatchCRCs checks the three trailing CRC32s of a UPS or BPS patch, given its source.
+// It returns the expected target CRC32 once the source and patch checksums hold.
+func verifyPatchCRCs(data, source []byte) (uint32, error) {
+	footer := data[len(data)-12:]
+	if crc32.ChecksumIEEE(data[:len(data)-4]) != binary.LittleEndian.Uint32(footer[8:]) {
+		return 0, fmt.Errorf("%w: patch checksum mismatch", errCorruptPatch)
+	}
+	if crc32.ChecksumIEEE(source) != binary.LittleEndian.Uint32(footer[:4]) {
+		return 0, fmt.Errorf("original file %w", errChecksumMismatch)
+	}
+	return binary.LittleEndian.Uint32(footer[4:8]), nil
+}
+
+/*
+Writes a patch in UPS format.
+
+UPS hunks are the XOR of original and patched bytes, so the patched file is
+rebuilt through applyPatch first and the XOR taken over the regions it covers.
+*/
+func writeUPS(patch *PatchFile, original []byte, writer io.Writer) error {
+	defer logging.Trace("write ups")()
+
+	modified, err := applyPatch(original, patch)
+	if err != nil {
+		return err
+	}
+
+	out := []byte(UPS_HEADER)
+	out = appendBeatVarint(out, uint64(len(original)))
+	out = appendBeatVarint(out, uint64(len(modified)))
+
+	byteAt := func(data []byte, i int) byte {
+		if i < len(data) {
+			return data[i]
+		}
+		return 0
+	}
+
+	// Position just past the last hunk terminator
+	position := 0
+	length := max(len(original), len(modified))
+	for i := 0; i < length; i++ {
+		if byteAt(original, i) == byteAt(modified, i) {
+			continue
+		}
+
+		out = appendBeatVarint(out, uint64(i-position))
+		for ; i < length && byteAt(original, i) != byteAt(modified, i); i++ {
+			out = append(out, byteAt(original, i)^byteAt(modified, i))
+		}
+		out = append(out, 0)
+		position = i + 1
+	}
+
+	_, err = writer.Write(appendPatchCRCs(out, original, modified))
+	return err
+}
+
+// applyUPS applies a UPS patch to original and returns the result, verifying all three CRC32s.
+func applyUPS(original []byte, reader io.Reader) ([]byte, error) {
+	defer logging.Trace("apply ups")()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(UPS_HEADER)+12 || !bytes.HasPrefix(data, []byte(UPS_HEADER)) {
+		return nil, errors.New("invalid ups file format")
+	}
+
+	targetCRC, err := verifyPatchCRCs(data, original)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bytes.NewReader(data[len(UPS_HEADER) : len(data)-12])
+	inputSize, err := readBeatVarint(body)
+	if err != nil {
+		return nil, err
+	}
+	outputSize, err := readBeatVarint(body)
+	if err != nil {
+		return nil, err
+	}
+	if inputSize != uint64(len(original)) {
+		return nil, fmt.Errorf("original file %w", errLengthMismatch)
+	}
+	if outputSize > 1<<32-1 {
+		return nil, fmt.Errorf("output size %d too large", outputSize)
+	}
+
+	result := make([]byte, outputSize)
+	copy(result, original)
+
+	position := uint64(0)
+	for body.Len() > 0 {
+		skip, err := readBeatVarint(body)
+		if err != nil {
+			return nil, err
+		}
+		position += skip
+
+		for {
+			x, err := body.ReadByte()
+			if err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if x == 0 {
+				position++
+				break
+			}
+			// XOR bytes past the output only undo data the output drops
+			if position < outputSize {
+				result[position] ^= x
+			}
+			position++
+		}
+	}
+
+	if crc32.ChecksumIEEE(result) != targetCRC {
+		return nil, fmt.Errorf("patched file %w", errChecksumMismatch)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"sort"
+
+	"mtgapatcher/logging"
+)
+
+/*
+VCDIFF (RFC 3284) support.
+
+Only the default instruction code table is understood. Secondary
+compression and custom code tables are rejected, the Adler-32 window
+checksum written by xdelta3 (VCD_ADLER32) is verified when present.
+*/
+
+var VCDIFF_MAGIC = []byte{0xD6, 0xC3, 0xC4, 0x00}
+
+const (
+	// Hdr_Indicator bits
+	VCD_DECOMPRESS = 0x01
+	VCD_CODETABLE  = 0x02
+	VCD_APPHEADER  = 0x04 // xdelta3 extension
+
+	// Win_Indicator bits
+	VCD_SOURCE  = 0x01
+	VCD_TARGET  = 0x02
+	VCD_ADLER32 = 0x04 // xdelta3 extension
+
+	// Instruction types
+	VCD_NOOP = 0
+	VCD_ADD  = 1
+	VCD_RUN  = 2
+	VCD_COPY = 3
+
+	// Address cache sizes of the default code table
+	VCD_NEAR_SIZE = 4
+	VCD_SAME_SIZE = 3
+
+	// Gaps shorter than this are cheaper to ADD than to COPY
+	VCD_MIN_COPY = 4
+
+	VCD_MAX_TARGET_WINDOW = 1<<32 - 1
+)
+
+type vcdInstruction struct {
+	kind byte
+	size byte
+	mode byte
+}
+
+// vcdCodeTable is the default instruction code table from section 5.6 of RFC 3284.
+var vcdCodeTable = buildDefaultCodeTable()
+
+func buildDefaultCodeTable() [256][2]vcdInstruction {
+	var table [256][2]vcdInstruction
+	i := 0
+
+	// RUN, ADD and COPY alone
+	table[i][0] = vcdInstruction{kind: VCD_RUN}
+	i++
+	for size := 0; size <= 17; size++ {
+		table[i][0] = vcdInstruction{kind: VCD_ADD, size: byte(size)}
+		i++
+	}
+	for mode := 0; mode <= 8; mode++ {
+		table[i][0] = vcdInstruction{kind: VCD_COPY, mode: byte(mode)}
+		i++
+		for size := 4; size <= 18; size++ {
+			table[i][0] = vcdInstruction{kind: VCD_COPY, size: byte(size), mode: byte(mode)}
+			i++
+		}
+	}
+
+	// ADD followed by COPY
+	for mode := 0; mode <= 8; mode++ {
+		copySizes := []int{4, 5, 6}
+		if mode >= 6 {
+			copySizes = []int{4}
+		}
+		for addSize := 1; addSize <= 4; addSize++ {
+			for _, copySize := range copySizes {
+				table[i][0] = vcdInstruction{kind: VCD_ADD, size: byte(addSize)}
+				table[i][1] = vcdInstruction{kind: VCD_COPY, size: byte(copySize), mode: byte(mode)}
+				i++
+			}
+		}
+	}
+
+	// COPY followed by ADD
+	for mode := 0; mode <= 8; mode++ {
+		table[i][0] = vcdInstruction{kind: VCD_COPY, size: 4, mode: byte(mode)}
+		table[i][1] = vcdInstruction{kind: VCD_ADD, size: 1}
+		i++
+	}
+
+	return table
+}
+
+// vcdAddressCache implements the near/same address caches of RFC 3284 section 5.1.
+type vcdAddressCache struct {
+	near     [VCD_NEAR_SIZE]uint64
+	nextSlot int
+	same     [VCD_SAME_SIZE * 256]uint64
+}
+
+func (c *vcdAddressCache) update(addr uint64) {
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % VCD_NEAR_SIZE
+	c.same[addr%uint64(len(c.same))] = addr
+}
+
+func (c *vcdAddressCache) decode(here uint64, mode byte, addrs *bytes.Reader) (uint64, error) {
+	var addr uint64
+
+	switch {
+	case mode == 0: // VCD_SELF
+		value, err := readVarint(addrs)
+		if err != nil {
+			return 0, err
+		}
+		addr = value
+	case mode == 1: // VCD_HERE
+		value, err := readVarint(addrs)
+		if err != nil {
+			return 0, err
+		}
+		if value > here {
+			return 0, errors.New("vcdiff: address before start of window")
+		}
+		addr = here - value
+	case int(mode) < 2+VCD_NEAR_SIZE:
+		value, err := readVarint(addrs)
+		if err != nil {
+			return 0, err
+		}
+		addr = c.near[mode-2] + value
+	case int(mode) < 2+VCD_NEAR_SIZE+VCD_SAME_SIZE:
+		b, err := addrs.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		addr = c.same[int(mode-2-VCD_NEAR_SIZE)*256+int(b)]
+	default:
+		return 0, fmt.Errorf("vcdiff: invalid address mode %d", mode)
+	}
+
+	if addr >= here {
+		return 0, errors.New("vcdiff: copy address out of range")
+	}
+
+	c.update(addr)
+	return addr, nil
+}
+
+// readVarint reads a VCDIFF integer: base 128, most significant digit first.
+func readVarint(reader io.ByteReader) (uint64, error) {
+	var value uint64
+	for i := 0; i < 10; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if value > (1<<64-1)>>7 {
+			return 0, errors.New("vcdiff: integer overflow")
+		}
+		value = value<<7 | uint64(b&0x7F)
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("vcdiff: integer too long")
+}
+
+// appendVarint appends value as a VCDIFF integer.
+func appendVarint(buf []byte, value uint64) []byte {
+	var digits [10]byte
+	n := len(digits) - 1
+	digits[n] = byte(value & 0x7F)
+	for value >>= 7; value > 0; value >>= 7 {
+		n--
+		digits[n] = byte(value&0x7F) | 0x80
+	}
+	return append(buf, digits[n:]...)
+}
+
+/*
+Applies a VCDIFF delta to original and returns the decoded target.
+
+Every window is decoded into the growing target; VCD_SOURCE windows copy
+from the original, VCD_TARGET windows from the target decoded so far.
+*/
+func applyVCDIFF(original []byte, reader io.Reader) ([]byte, error) {
+	defer logging.Trace("apply vcdiff")()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	delta := bytes.NewReader(data)
+
+	// Read and verify header
+	magic := make([]byte, len(VCDIFF_MAGIC))
+	if _, err := io.ReadFull(delta, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, VCDIFF_MAGIC) {
+		return nil, errors.New("invalid vcdiff file format")
+	}
+
+	indicator, err := delta.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if indicator&VCD_DECOMPRESS != 0 {
+		return nil, errors.New("vcdiff secondary compression is not supported")
+	}
+	if indicator&VCD_CODETABLE != 0 {
+		return nil, errors.New("vcdiff custom code tables are not supported")
+	}
+	if indicator&VCD_APPHEADER != 0 {
+		length, err := readVarint(delta)
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(delta.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if _, err := delta.Seek(int64(length), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+
+	var target []byte
+	for delta.Len() > 0 {
+		if target, err = decodeVCDIFFWindow(delta, original, target); err != nil {
+			return nil, err
+		}
+	}
+
+	return target, nil
+}
+
+// decodeVCDIFFWindow decodes the next window of delta and appends its output to target.
+func decodeVCDIFFWindow(delta *bytes.Reader, original, target []byte) ([]byte, error) {
+	indicator, err := delta.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// Locate the source segment
+	var source []byte
+	if indicator&(VCD_SOURCE|VCD_TARGET) != 0 {
+		if indicator&VCD_SOURCE != 0 && indicator&VCD_TARGET != 0 {
+			return nil, errors.New("vcdiff: window uses both source and target segments")
+		}
+		length, err := readVarint(delta)
+		if err != nil {
+			return nil, err
+		}
+		position, err := readVarint(delta)
+		if err != nil {
+			return nil, err
+		}
+
+		segmentOf := original
+		if indicator&VCD_TARGET != 0 {
+			segmentOf = target
+		}
+		if position > uint64(len(segmentOf)) || length > uint64(len(segmentOf))-position {
+			return nil, errors.New("vcdiff: source segment out of range")
+		}
+		source = segmentOf[position : position+length]
+	}
+
+	// Read window lengths
+	if _, err := readVarint(delta); err != nil { // delta encoding length
+		return nil, err
+	}
+	targetLength, err := readVarint(delta)
+	if err != nil {
+		return nil, err
+	}
+	if targetLength > VCD_MAX_TARGET_WINDOW || uint64(len(target))+targetLength > VCD_MAX_TARGET_WINDOW {
+		return nil, errors.New("vcdiff: target window too large")
+	}
+	deltaIndicator, err := delta.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if deltaIndicator != 0 {
+		return nil, errors.New("vcdiff: compressed sections are not supported")
+	}
+
+	var sectionLengths [3]uint64
+	for i := range sectionLengths {
+		if sectionLengths[i], err = readVarint(delta); err != nil {
+			return nil, err
+		}
+	}
+
+	var checksum []byte
+	if indicator&VCD_ADLER32 != 0 {
+		checksum = make([]byte, 4)
+		if _, err := io.ReadFull(delta, checksum); err != nil {
+			return nil, err
+		}
+	}
+
+	var sections [3][]byte
+	for i, length := range sectionLengths {
+		if length > uint64(delta.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		sections[i] = make([]byte, length)
+		if _, err := io.ReadFull(delta, sections[i]); err != nil {
+			return nil, err
+		}
+	}
+	dataSection := bytes.NewReader(sections[0])
+	instSection := bytes.NewReader(sections[1])
+	addrSection := bytes.NewReader(sections[2])
+
+	// Execute instructions
+	windowStart := len(target)
+	sourceLength := uint64(len(source))
+	cache := &vcdAddressCache{}
+
+	for instSection.Len() > 0 {
+		index, _ := instSection.ReadByte()
+		for _, inst := range vcdCodeTable[index] {
+			if inst.kind == VCD_NOOP {
+				continue
+			}
+
+			size := uint64(inst.size)
+			if size == 0 {
+				if size, err = readVarint(instSection); err != nil {
+					return nil, err
+				}
+			}
+			if uint64(len(target)-windowStart)+size > targetLength {
+				return nil, errors.New("vcdiff: instructions exceed target window")
+			}
+
+			switch inst.kind {
+			case VCD_ADD:
+				if size > uint64(dataSection.Len()) {
+					return nil, io.ErrUnexpectedEOF
+				}
+				start := len(target)
+				target = append(target, make([]byte, size)...)
+				dataSection.Read(target[start:])
+
+			case VCD_RUN:
+				b, err := dataSection.ReadByte()
+				if err != nil {
+					return nil, io.ErrUnexpectedEOF
+				}
+				for i := uint64(0); i < size; i++ {
+					target = append(target, b)
+				}
+
+			case VCD_COPY:
+				here := sourceLength + uint64(len(target)-windowStart)
+				addr, err := cache.decode(here, inst.mode, addrSection)
+				if err != nil {
+					return nil, err
+				}
+				// Copies may overlap the bytes they produce, so go byte by byte
+				for i := uint64(0); i < size; i++ {
+					position := addr + i
+					if position < sourceLength {
+						target = append(target, source[position])
+					} else {
+						target = append(target, target[windowStart+int(position-sourceLength)])
+					}
+				}
+			}
+		}
+	}
+
+	if uint64(len(target)-windowStart) != targetLength {
+		return nil, fmt.Errorf("vcdiff: target window %w", errLengthMismatch)
+	}
+	if checksum != nil {
+		expected := uint32(checksum[0])<<24 | uint32(checksum[1])<<16 | uint32(checksum[2])<<8 | uint32(checksum[3])
+		if adler32.Checksum(target[windowStart:]) != expected {
+			return nil, fmt.Errorf("vcdiff: window %w", errChecksumMismatch)
+		}
+	}
+
+	return target, nil
+}
+
+/*
+Writes a patch as a single VCDIFF window using the original as source segment.
+
+The patch items become ADD instructions and the unchanged stretches between
+them COPY instructions from the same offset of the original, so the delta
+describes exactly the regions generatePatch found. Items must be sorted and
+must not overlap, which generatePatch guarantees.
+*/
+func writeVCDIFF(patch *PatchFile, original []byte, writer io.Writer) error {
+	defer logging.Trace("write vcdiff")()
+
+	if uint32(len(original)) != patch.OriginalLength {
+		return fmt.Errorf("original file %w", errLengthMismatch)
+	}
+
+	items := make([]PatchItem, len(patch.PatchItems))
+	copy(items, patch.PatchItems)
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Offset < items[j].Offset })
+
+	var data, inst, addr []byte
+	position := uint64(0)
+	targetLength := uint64(patch.PatchedLength)
+
+	// pending collects bytes for the next ADD so short gaps merge with neighbouring items
+	var pending []byte
+	flushAdd := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if len(pending) <= 17 {
+			inst = append(inst, byte(1+len(pending)))
+		} else {
+			inst = append(inst, 1)
+			inst = appendVarint(inst, uint64(len(pending)))
+		}
+		data = append(data, pending...)
+		pending = nil
+	}
+
+	emitGap := func(end uint64) {
+		for position < end {
+			if position >= uint64(len(original)) {
+				// Bytes past the original that no item covers are zero, as in applyPatch
+				flushAdd()
+				inst = append(inst, 0)
+				inst = appendVarint(inst, end-position)
+				data = append(data, 0)
+				position = end
+				return
+			}
+
+			copyEnd := min(end, uint64(len(original)))
+			if copyEnd-position < VCD_MIN_COPY {
+				pending = append(pending, original[position:copyEnd]...)
+			} else {
+				flushAdd()
+				size := copyEnd - position
+				if size <= 18 {
+					inst = append(inst, byte(20+size-4))
+				} else {
+					inst = append(inst, 19)
+					inst = appendVarint(inst, size)
+				}
+				addr = appendVarint(addr, position) // VCD_SELF
+			}
+			position = copyEnd
+		}
+	}
+
+	for _, item := range items {
+		start := uint64(item.Offset)
+		end := start + uint64(len(item.Content))
+		if start < position {
+			return errors.New("patch items overlap")
+		}
+		if end > targetLength {
+			return errors.New("patch item exceeds patched length")
+		}
+
+		emitGap(start)
+		pending = append(pending, item.Content...)
+		position = end
+	}
+	emitGap(targetLength)
+	flushAdd()
+
+	// Assemble the window
+	var body []byte
+	body = appendVarint(body, targetLength)
+	body = append(body, 0) // Delta_Indicator
+	body = appendVarint(body, uint64(len(data)))
+	body = appendVarint(body, uint64(len(inst)))
+	body = appendVarint(body, uint64(len(addr)))
+	body = append(body, data...)
+	body = append(body, inst...)
+	body = append(body, addr...)
+
+	out := append([]byte{}, VCDIFF_MAGIC...)
+	out = append(out, 0) // Hdr_Indicator
+	if targetLength > 0 {
+		out = append(out, VCD_SOURCE)
+		out = appendVarint(out, uint64(len(original)))
+		out = appendVarint(out, 0)
+		out = appendVarint(out, uint64(len(body)))
+		out = append(out, body...)
+	}
+
+	_, err := writer.Write(out)
+	return err
+}